@@ -1,24 +1,48 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"github.com/tiktoken-go/tokenizer"
 	"gopkg.in/yaml.v3"
 )
 
@@ -27,24 +51,189 @@ var embeddedVersion string
 
 // fileConfig represents the YAML config file structure
 type fileConfig struct {
-	Provider    string `yaml:"provider"`     // "openrouter" or "ollama"
-	APIKey      string `yaml:"api_key"`      // For OpenRouter
-	APIEndpoint string `yaml:"api_endpoint"` // Custom endpoint (optional)
-	Model       string `yaml:"model"`
-	Debug       bool   `yaml:"debug"`
-	Verbose     bool   `yaml:"verbose"`
-	MaxLines    int    `yaml:"max_lines"`
+	Provider      string   `yaml:"provider"`     // "openrouter", "openai", "anthropic" or "ollama"
+	APIKey        string   `yaml:"api_key"`      // For OpenRouter, OpenAI or Anthropic
+	APIEndpoint   string   `yaml:"api_endpoint"` // Custom endpoint (optional)
+	Model         string   `yaml:"model"`
+	Debug         bool     `yaml:"debug"`
+	Verbose       bool     `yaml:"verbose"`
+	MaxLines      int      `yaml:"max_lines"`
+	AuthorContext bool     `yaml:"author_context"` // Include the git user in the prompt
+	FocusHint     bool     `yaml:"focus_hint"`     // Tell the model which directory most changes are in
+	Codeowners    string   `yaml:"codeowners"`     // "prompt" names the owners of the changed files, "scope" also scopes by them
+	MaxFiles      int      `yaml:"max_files"`      // Summarize instead of diffing above this many files
+	PromptPrefix  string   `yaml:"prompt_prefix"`  // Prepended to the prompt
+	PromptSuffix  string   `yaml:"prompt_suffix"`  // Appended to the prompt
+	Temperature   *float64 `yaml:"temperature"`    // Sampling temperature (optional)
+	MaxTokens     int      `yaml:"max_tokens"`     // Response token limit (optional)
+	// Model id prefixes treated as reasoning models (OpenRouter/OpenAI-compatible only)
+	ReasoningModelPrefixes []string `yaml:"reasoning_model_prefixes"`
+	RetryEmpty             *int     `yaml:"retry_empty"` // Retries when the model returns nothing (default 1)
+	Output                 string   `yaml:"output"`      // "commit" (default), "pr", "note" or "review-md"
+	// Prompt templates keyed by model id or model id prefix
+	ModelPrompts  map[string]string `yaml:"model_prompts"`
+	Conventional  bool              `yaml:"conventional"`   // Conventional Commits style messages
+	SubjectFormat string            `yaml:"subject_format"` // "plain" or "conventional", overrides conventional
+	BodyFormat    string            `yaml:"body_format"`    // "prose", "bullets" or "none" (default: model's choice)
+	MinInterval   time.Duration     `yaml:"min_interval"`   // Skip runs closer together than this, e.g. "30s"
+	Timeout       *time.Duration    `yaml:"timeout"`        // Limit for each API attempt, e.g. "30s"; default 2m, 0 for none
+	Deadline      time.Duration     `yaml:"deadline"`       // Limit for a request including its retries, e.g. "2m"
+	StaleAfter    time.Duration     `yaml:"stale_after"`    // Warn when the index is older than this, e.g. "72h"
+	ForceHTTP1    bool              `yaml:"force_http1"`    // Never use HTTP/2 for API requests
+	// Extra directory names to skip, added to the built-in list
+	IgnoreDirs        []string `yaml:"ignore_dirs"`
+	ReplaceIgnoreDirs bool     `yaml:"replace_ignore_dirs"` // Use ignore_dirs instead of the built-in list
+	// Model to switch to when the prompt is too large for the primary model
+	LargeContextModel string `yaml:"large_context_model"`
+	ContextWindow     int    `yaml:"context_window"`   // Primary model's context size in tokens (optional)
+	BinaryFiles       string `yaml:"binary_files"`     // "note" (default) or "skip"
+	BinarySummary     string `yaml:"binary_summary"`   // "skip", "name", "name-size" or "mime" (default)
+	SubjectPrefix     string `yaml:"subject_prefix"`   // Prepended to the subject, "auto" derives it from the changed paths
+	RenameHandling    string `yaml:"rename_handling"`  // "content" (default), "note" or "ignore"
+	DetectMoves       bool   `yaml:"detect_moves"`     // Pair identical deleted and added files as renames
+	UseGitTemplate    bool   `yaml:"use_git_template"` // Fill in git's commit.template
+	BlameContext      bool   `yaml:"blame_context"`    // Tell the model how old the changed lines are
+	SkipUnchanged     bool   `yaml:"skip_unchanged"`   // Stay silent when the diff is the one last described
+	Polish            bool   `yaml:"polish"`           // Second pass to fix grammar and tighten the message
+	PolishModel       string `yaml:"polish_model"`     // Model for the polish pass (defaults to model)
+	ReadConcurrency   int    `yaml:"read_concurrency"` // Files read at once when classifying (default GOMAXPROCS)
+	Preset            string `yaml:"preset"`           // Built-in prompt template: concise, detailed, conventional or angular
+	// External diff tool run by sh as "<diff_command> old new", e.g. "difft --display inline"
+	DiffCommand string `yaml:"diff_command"`
+	DiffFormat  string `yaml:"diff_format"`  // "unified" (default), "side-by-side" or "before-after"
+	RecordStats bool   `yaml:"record_stats"` // Keep local per-repo usage stats for -stats
+	// Command whose output is included in the prompt, e.g. "go test ./..."
+	ContextCommand        string        `yaml:"context_command"`
+	ContextCommandTimeout time.Duration `yaml:"context_command_timeout"` // Default 30s
+	// Shell command run after -commit, e.g. "git push"
+	PostCommit string `yaml:"post_commit"`
+	// Undo the commit when the post-commit command fails
+	RollbackOnFailure bool `yaml:"rollback_on_failure"`
+	// Add a Gerrit Change-Id trailer to commits made with -commit
+	GerritChangeID bool `yaml:"gerrit_change_id"`
+	// Regular expressions whose matches are removed from the model's response
+	ResponseStripPatterns []string `yaml:"response_strip_patterns"`
+	// Quality checks on the response; a failing response is retried once
+	MinSubjectLength int  `yaml:"min_subject_length"` // Reject shorter subject lines
+	RequireBody      bool `yaml:"require_body"`       // Reject messages without a body
+	RejectEcho       bool `yaml:"reject_echo"`        // Reject responses that repeat the diff
+	// Print the response as it is generated (OpenRouter, OpenAI and Ollama)
+	Stream bool `yaml:"stream"`
+	// Diff size in lines from which the subject length rule is repeated
+	// after the diff (default 400, 0 disables)
+	SubjectReminderLines *int `yaml:"subject_reminder_lines"`
+	// Lines from the top of each added file shown under its entry when
+	// max_files summarizes the changes (default 0)
+	SummaryHeadLines int `yaml:"summary_head_lines"`
+	// Turn markdown headings and bullets in commit messages and notes into
+	// plain text (default false)
+	CleanMarkdown bool `yaml:"clean_markdown"`
+	// Warn on stderr about files with unstaged changes left out of the
+	// description (default true)
+	UnstagedWarning *bool `yaml:"unstaged_warning"`
+	// Rules enforced on the subject line: "capital" or "lowercase",
+	// "no-period" and "imperative"
+	SubjectStyle []string `yaml:"subject_style"`
 }
 
 // config represents the runtime configuration
 type config struct {
-	provider    string
-	apiKey      string
-	apiEndpoint string
-	model       string
-	debug       bool
-	verbose     bool
-	maxLines    int
+	provider               string
+	apiKey                 string
+	apiEndpoint            string
+	model                  string
+	debug                  bool
+	verbose                bool
+	maxLines               int
+	authorContext          bool
+	focusHint              bool // name the directory most changes are in
+	useGitTemplate         bool // ask the model to fill in git's commit.template
+	blameContext           bool // blame the changed lines and tell the model whether they are recent
+	maxFiles               int
+	summaryHeadLines       int      // first lines of added files shown in a max_files summary
+	compareFiles           []string // old and new file when describing files outside git
+	promptPrefix           string
+	promptSuffix           string
+	instructions           []string // extra instructions appended after the suffix
+	temperature            *float64 // nil leaves the provider default
+	maxTokens              int      // 0 leaves the provider default
+	reasoningModelPrefixes []string
+	interactive            bool
+	retryEmpty             int
+	subjectReminderLines   int                      // repeat the subject length rule after diffs this long, 0 never
+	subjectStyle           []string                 // rules applied to the subject line, from subjectStyles
+	cleanMarkdown          bool                     // unwrap headings and normalize bullets in plain-text output
+	output                 string                   // "commit", "pr", "note" or "review-md"
+	contextFrom            string                   // file with background text for the prompt
+	codeowners             string                   // "off", "prompt" to name the CODEOWNERS owners, "scope" to also scope by them
+	contextCommand         string                   // shell command whose output is included in the prompt
+	contextCommandTimeout  time.Duration            // limit for contextCommand
+	commit                 bool                     // commit the staged changes with the generated message
+	author                 string                   // "Name <email>" author override for -commit
+	promptTemplate         *template.Template       // replaces the built-in commit prompt when set
+	promptFile             string                   // template file that replaces the whole prompt for this run
+	messageFile            string                   // write the message here, e.g. COMMIT_EDITMSG
+	messagePlacement       string                   // "replace" messageFile, or keep its content and insert at the "top" or "bottom"
+	interactiveHunks       bool                     // choose which staged hunks to describe
+	selectFiles            bool                     // choose which staged files to describe
+	debugDiff              bool                     // dump how each file's diff was computed
+	conventional           bool                     // write Conventional Commits messages
+	bodyFormat             string                   // "prose", "bullets", "none" or empty for no constraint
+	scope                  string                   // forced conventional commit scope
+	minInterval            time.Duration            // minimum time between successful runs
+	skipUnchanged          bool                     // do nothing when the diff matches the last one described
+	force                  bool                     // run even when min_interval or skip_unchanged would skip
+	timeout                time.Duration            // limit for each API attempt, 0 or less for none
+	deadline               time.Duration            // limit for all attempts of one request, 0 for none
+	forceHTTP1             bool                     // talk HTTP/1.1 to the API even when HTTP/2 is offered
+	staleAfter             time.Duration            // warn when the index was last changed longer ago, 0 to never warn
+	unstagedWarning        bool                     // warn about files with unstaged changes the description leaves out
+	jsonOutput             bool                     // print subject and body as JSON
+	subjectFile            string                   // write the subject line here
+	bodyFile               string                   // write the body here
+	addNote                string                   // describe this revision and attach the result as a git note
+	against                string                   // diff the staged tree against this ref's tree instead of HEAD
+	withStash              string                   // also describe the changes of this stash entry
+	rebase                 bool                     // describe the commit an in-progress rebase or cherry-pick is working on
+	ignoreDirs             []string                 // extra directory names to skip
+	pathspecs              []pathspec               // only describe paths matching these
+	replaceIgnoreDirs      bool                     // skip only ignoreDirs, not the built-in list
+	largeContextModel      string                   // fallback model for prompts that don't fit
+	contextWindow          int                      // primary model's context size in tokens, 0 if unknown
+	compareModels          []string                 // run the prompt through each of these models side by side
+	binaryFiles            string                   // "note" lists binary files in the diff, "skip" leaves them out
+	binarySummary          string                   // detail of a binary file note: "name", "name-size" or "mime"
+	subjectPrefix          string                   // prepended to the subject line, "auto" for the top-level directory
+	renameHandling         string                   // renames send their "content" delta, only a "note", or are ignored
+	detectMoves            bool                     // pair content-identical deletes and adds as renames
+	skipBinaryCheck        bool                     // treat every staged file as text without reading it
+	polish                 bool                     // send the message through a grammar and tightening pass
+	polishModel            string                   // model for the polish pass, empty for the main model
+	review                 bool                     // also ask for observations about possible issues in the diff
+	trailersFromAnalysis   bool                     // have the model classify the change and append it as git trailers
+	readConcurrency        int                      // files read at once when checking for binaries
+	diffFile               string                   // read a unified diff from this file ("-" for stdin) instead of git
+	suggestSplit           bool                     // propose smaller commits when max_lines is exceeded
+	truncateOnLimit        bool                     // cut the patch at max_lines instead of failing
+	diffCommand            string                   // external diff tool used in place of the built-in diff
+	diffFormat             string                   // how file changes are rendered for the model, from diffFormats
+	maxHunksPerFile        int                      // keep only this many of a file's largest hunks, 0 for all
+	dropWhitespaceHunks    bool                     // leave out hunks that only change whitespace
+	recordStats            bool                     // accumulate per-repo usage stats in the cache dir
+	showStats              bool                     // print the recorded stats and exit
+	printConfig            bool                     // print the resolved settings and exit
+	settings               []setting                // resolved settings for printConfig
+	postCommit             string                   // shell command run after -commit
+	rollbackOnFailure      bool                     // undo the commit when postCommit fails
+	gerritChangeID         bool                     // give -commit commits a Change-Id trailer
+	responseStrip          []*regexp.Regexp         // matches removed from every model response
+	minSubjectLength       int                      // reject responses with a shorter subject line
+	requireBody            bool                     // reject responses without a body
+	rejectEcho             bool                     // reject responses that repeat the diff
+	stream                 bool                     // print the response as it is generated
+	streamTo               io.Writer                // receives streamed fragments, set by run for the main request
+	sinceLast              bool                     // describe only what changed since the last -since-last run
+	baseline               map[string]plumbing.Hash // per-path blobs described by the last -since-last run
 }
 
 // responseMetadata holds stats from the LLM API response
@@ -61,6 +250,9 @@ var debugLog = func(format string, args ...interface{}) {
 	// no-op by default
 }
 
+// stdin is read by the interactive modes; tests replace it
+var stdin io.Reader = os.Stdin
+
 // ignoredDirs contains directory names that should be skipped
 var ignoredDirs = []string{
 	"vendor",
@@ -78,11 +270,20 @@ var ignoredDirs = []string{
 	".venv",
 }
 
+// skippedDirs returns the directory names to skip: the built-in list plus
+// any configured extras, or only the extras when the list is replaced
+func (c config) skippedDirs() []string {
+	if c.replaceIgnoreDirs {
+		return c.ignoreDirs
+	}
+	return append(append([]string{}, ignoredDirs...), c.ignoreDirs...)
+}
+
 // shouldIgnorePath checks if a path should be ignored based on directory patterns
-func shouldIgnorePath(path string) bool {
+func shouldIgnorePath(path string, dirs []string) bool {
 	parts := strings.Split(filepath.ToSlash(path), "/")
 	for _, part := range parts {
-		for _, ignored := range ignoredDirs {
+		for _, ignored := range dirs {
 			if part == ignored {
 				return true
 			}
@@ -91,6 +292,145 @@ func shouldIgnorePath(path string) bool {
 	return false
 }
 
+// pathspec is a parsed git pathspec, see gitglossary(7). Patterns are
+// matched against paths relative to the repository root.
+type pathspec struct {
+	exclude bool
+	re      *regexp.Regexp
+}
+
+// parsePathspec parses a git pathspec with optional magic: the long form
+// ":(glob,exclude,icase,literal,top)pattern" or the short forms ":!pattern",
+// ":^pattern" and ":/pattern". Without glob magic "*" also matches "/",
+// like git's default fnmatch matching.
+func parsePathspec(spec string) (pathspec, error) {
+	var ps pathspec
+	glob, icase, literal := false, false, false
+	pattern := spec
+	switch {
+	case strings.HasPrefix(spec, ":("):
+		end := strings.Index(spec, ")")
+		if end < 0 {
+			return pathspec{}, fmt.Errorf("invalid pathspec %q: missing )", spec)
+		}
+		for _, magic := range strings.Split(spec[2:end], ",") {
+			switch strings.TrimSpace(magic) {
+			case "glob":
+				glob = true
+			case "exclude":
+				ps.exclude = true
+			case "icase":
+				icase = true
+			case "literal":
+				literal = true
+			case "top", "":
+			default:
+				return pathspec{}, fmt.Errorf("unsupported pathspec magic %q in %q", magic, spec)
+			}
+		}
+		pattern = spec[end+1:]
+	case strings.HasPrefix(spec, ":!"), strings.HasPrefix(spec, ":^"):
+		ps.exclude = true
+		pattern = strings.TrimPrefix(spec[2:], "/")
+	case strings.HasPrefix(spec, ":/"):
+		pattern = spec[2:]
+	}
+	pattern = strings.TrimPrefix(strings.TrimSuffix(pattern, "/"), "./")
+
+	expr := regexp.QuoteMeta(pattern)
+	switch {
+	case pattern == "" || pattern == ".":
+		expr = ".*" // the whole repository
+	case !literal:
+		expr = pathspecRegexp(pattern, glob)
+	}
+	if icase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return pathspec{}, fmt.Errorf("invalid pathspec %q: %w", spec, err)
+	}
+	ps.re = re
+	return ps, nil
+}
+
+// pathspecRegexp translates a pathspec pattern into a regular expression.
+// With glob, "*" and "?" stay within one path component and "**" spans
+// directories; otherwise they match "/" as well.
+func pathspecRegexp(pattern string, glob bool) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case glob && strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case glob && strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*' && glob:
+			b.WriteString("[^/]*")
+		case c == '*':
+			b.WriteString(".*")
+		case c == '?' && glob:
+			b.WriteString("[^/]")
+		case c == '?':
+			b.WriteString(".")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// matches reports whether the pattern matches path or one of the
+// directories leading to it, so "docs" covers everything below docs/
+func (ps pathspec) matches(path string) bool {
+	path = filepath.ToSlash(path)
+	if ps.re.MatchString(path) {
+		return true
+	}
+	for i := range path {
+		if path[i] == '/' && ps.re.MatchString(path[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathspecs reports whether path is selected by specs: it must match
+// one of the positive pathspecs, if there are any, and none of the
+// excluding ones. No pathspecs select everything.
+func matchPathspecs(path string, specs []pathspec) bool {
+	included, hasPositive := false, false
+	for _, ps := range specs {
+		if ps.exclude {
+			if ps.matches(path) {
+				return false
+			}
+			continue
+		}
+		hasPositive = true
+		if ps.matches(path) {
+			included = true
+		}
+	}
+	return included || !hasPositive
+}
+
 // isBinary checks if a file appears to be binary by examining its contents
 func isBinary(path string) (bool, error) {
 	f, err := os.Open(path)
@@ -99,22 +439,54 @@ func isBinary(path string) (bool, error) {
 	}
 	defer f.Close()
 
-	// Read a sample — 8KB is enough to classify most files.
-	buf := make([]byte, 8192)
-	n, err := f.Read(buf)
-	if err != nil && err != io.EOF {
+	sample, err := readSample(f)
+	if err != nil {
+		return false, err
+	}
+	return isBinaryContent(sample), nil
+}
+
+// isBinaryFile is isBinary for a file in a worktree filesystem
+func isBinaryFile(fs billy.Filesystem, path string) (bool, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sample, err := readSample(f)
+	if err != nil {
 		return false, err
 	}
-	buf = buf[:n]
+	return isBinaryContent(sample), nil
+}
+
+// readSample reads the start of r for the binary heuristics — 8KB is enough
+// to classify most files. Short reads are retried until the sample is full
+// or r is exhausted.
+func readSample(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 8192)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// isBinaryContent applies the binary heuristics to a sample of file content
+func isBinaryContent(buf []byte) bool {
+	if len(buf) > 8192 {
+		buf = buf[:8192]
+	}
 
 	// Empty files are not binary
-	if n == 0 {
-		return false, nil
+	if len(buf) == 0 {
+		return false
 	}
 
 	// Heuristic: if any NUL (0x00) bytes exist, assume binary.
 	if bytes.IndexByte(buf, 0x00) != -1 {
-		return true, nil
+		return true
 	}
 
 	// Heuristic: count printable ASCII and UTF-8 valid characters.
@@ -125,7 +497,7 @@ func isBinary(path string) (bool, error) {
 		}
 	}
 	ratio := float64(printable) / float64(len(buf))
-	return ratio < 0.95, nil // mostly printable = text
+	return ratio < 0.95 // mostly printable = text
 }
 
 func main() {
@@ -157,33 +529,526 @@ func run(ctx context.Context, output io.Writer, argv []string) error {
 		debugLog("Model: %s", runConfig.model)
 	}
 
-	debugLog("Opening git repository")
-	repo, err := git.PlainOpen(".")
-	if err != nil {
-		return fmt.Errorf("failed to open repository: %w", err)
+	if runConfig.printConfig {
+		printSettings(output, runConfig.settings, runConfig.verbose)
+		return nil
+	}
+
+	if runConfig.showStats {
+		stats, err := loadUsageStats()
+		if err != nil {
+			return fmt.Errorf("loadUsageStats: %w", err)
+		}
+		printUsageStats(output, stats)
+		return nil
 	}
 
-	debugLog("Getting staged changes")
-	changes, err := getStagedChanges(repo, runConfig)
+	if runConfig.minInterval > 0 && !runConfig.force {
+		last, err := lastRunTime()
+		if err != nil {
+			return fmt.Errorf("lastRunTime: %w", err)
+		}
+		if since := time.Since(last); since < runConfig.minInterval {
+			fmt.Fprintf(os.Stderr, "Skipping: last run was %s ago (min interval %s)\n", since.Round(time.Second), runConfig.minInterval)
+			return nil
+		}
+	}
+
+	var repo *git.Repository
+	var noteTarget *plumbing.Hash
+	var sinceLastPath string
+	var stashNotes string
+	var shallowNote string
+	var changes string
+	var files []stagedFile
+	var truncated bool
+	if len(runConfig.compareFiles) == 2 {
+		debugLog("Comparing %s with %s", runConfig.compareFiles[0], runConfig.compareFiles[1])
+		changes, err = diffFiles(runConfig.compareFiles[0], runConfig.compareFiles[1])
+		if err != nil {
+			return fmt.Errorf("diffFiles: %w", err)
+		}
+		added, removed := countDiffLines(changes)
+		files = []stagedFile{{path: runConfig.compareFiles[1], status: git.Modified, added: added, removed: removed}}
+		changes = renderPatch(changes, runConfig.diffFormat)
+		if changes == "" {
+			_, _ = fmt.Fprintf(output, "Files are identical.\n")
+			return nil
+		}
+	} else if runConfig.diffFile != "" {
+		debugLog("Reading diff from %s", runConfig.diffFile)
+		limit := runConfig.maxLines
+		if runConfig.truncateOnLimit {
+			limit = 0
+		}
+		changes, files, err = readDiffFile(runConfig.diffFile, limit)
+		if err != nil {
+			return fmt.Errorf("readDiffFile: %w", err)
+		}
+		if runConfig.truncateOnLimit {
+			changes, truncated = truncatePatch(changes, runConfig.maxLines)
+		}
+		changes = renderPatch(changes, runConfig.diffFormat)
+		if changes == "" {
+			_, _ = fmt.Fprintf(output, "Diff is empty.\n")
+			return nil
+		}
+	} else {
+		debugLog("Opening git repository")
+		repo, err = openRepository(".")
+		if err != nil {
+			return err
+		}
+
+		if runConfig.sinceLast {
+			if sinceLastPath, err = sinceLastFile(repo); err != nil {
+				return fmt.Errorf("sinceLastFile: %w", err)
+			}
+			if runConfig.baseline, err = loadSinceLast(sinceLastPath); err != nil {
+				return fmt.Errorf("loadSinceLast: %w", err)
+			}
+			debugLog("Comparing against %d previously described files", len(runConfig.baseline))
+		}
+
+		var staged stagedChanges
+		if runConfig.addNote != "" {
+			noteTarget, err = repo.ResolveRevision(plumbing.Revision(runConfig.addNote))
+			if err != nil {
+				return fmt.Errorf("failed to resolve %s: %w", runConfig.addNote, err)
+			}
+			debugLog("Getting changes of commit %s", noteTarget)
+			staged, err = getCommitChanges(ctx, repo, runConfig, *noteTarget)
+			if err != nil {
+				return fmt.Errorf("getCommitChanges: %w", err)
+			}
+			shallowNote = staged.note
+		} else if runConfig.rebase {
+			staged, err = getRebaseChanges(ctx, repo, runConfig)
+			if err != nil {
+				return fmt.Errorf("getRebaseChanges: %w", err)
+			}
+		} else if runConfig.against != "" {
+			debugLog("Getting staged changes against %s", runConfig.against)
+			staged, err = getChangesAgainst(ctx, repo, runConfig, runConfig.against)
+			if err != nil {
+				return fmt.Errorf("getChangesAgainst: %w", err)
+			}
+		} else {
+			debugLog("Getting staged changes")
+			staged, err = getStagedChanges(ctx, repo, runConfig)
+			if err != nil {
+				return fmt.Errorf("getStagedChanges: %w", err)
+			}
+			if runConfig.withStash != "" {
+				debugLog("Getting changes of %s", runConfig.withStash)
+				stashed, note, err := getStashChanges(ctx, repo, runConfig, runConfig.withStash)
+				if err != nil {
+					return fmt.Errorf("getStashChanges: %w", err)
+				}
+				var overlaps []string
+				staged, overlaps = mergeChanges(staged, stashed)
+				// Each side was checked against max_lines on its own
+				if lineCount := strings.Count(staged.patch, "\n"); runConfig.maxLines > 0 && lineCount > runConfig.maxLines {
+					if !runConfig.truncateOnLimit {
+						return lineLimitError(staged.patch, lineCount, runConfig.maxLines, runConfig.suggestSplit)
+					}
+					var cut bool
+					staged.patch, cut = truncatePatch(staged.patch, runConfig.maxLines)
+					staged.truncated = staged.truncated || cut
+				}
+				if note != "" {
+					overlaps = append([]string{note}, overlaps...)
+				}
+				stashNotes = strings.Join(overlaps, "\n")
+			}
+			if runConfig.staleAfter > 0 && staged.patch != "" {
+				if modified, ok := indexModTime(repo); ok && time.Since(modified) > runConfig.staleAfter {
+					fmt.Fprintf(os.Stderr, "Warning: the staged changes were last touched %s ago (%s); make sure they are still what you mean to describe\n",
+						time.Since(modified).Round(time.Minute), modified.Format("2006-01-02 15:04"))
+				}
+			}
+		}
+		// Set by every path that reads the index, including -rebase
+		if runConfig.unstagedWarning && staged.patch != "" && len(staged.unstaged) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: these files have unstaged changes that the description leaves out (git add them to include them):\n")
+			for _, path := range staged.unstaged {
+				fmt.Fprintf(os.Stderr, "  %s\n", path)
+			}
+		}
+		changes = staged.patch
+		files = staged.files
+		truncated = staged.truncated
+
+		if runConfig.selectFiles && changes != "" {
+			changes, files, err = selectFiles(changes, files, stdin, os.Stderr)
+			if err != nil {
+				return fmt.Errorf("selectFiles: %w", err)
+			}
+		}
+		if runConfig.interactiveHunks && changes != "" {
+			changes, files, err = selectHunks(changes, files, stdin, os.Stderr)
+			if err != nil {
+				return fmt.Errorf("selectHunks: %w", err)
+			}
+		}
+
+		if changes == "" && noteTarget != nil {
+			_, _ = fmt.Fprintf(output, "No changes found in %s.\n", runConfig.addNote)
+			return nil
+		}
+		if changes == "" {
+			debugLog("No staged changes found")
+			_, _ = fmt.Fprintf(output, "No staged changes found.\n")
+			return nil
+		}
+	}
+
+	if runConfig.dropWhitespaceHunks {
+		changes, files = dropWhitespaceHunks(changes, files)
+		if changes == "" {
+			_, _ = fmt.Fprintf(output, "Only whitespace changes found.\n")
+			return nil
+		}
+	}
+	if runConfig.maxHunksPerFile > 0 {
+		var dropped bool
+		changes, dropped = limitHunks(changes, runConfig.maxHunksPerFile)
+		truncated = truncated || dropped
+	}
+	var lastDiffPath string
+	if runConfig.skipUnchanged {
+		if lastDiffPath, err = lastDiffFile(repo); err != nil {
+			return fmt.Errorf("lastDiffFile: %w", err)
+		}
+		if !runConfig.force && diffUnchanged(lastDiffPath, changes) {
+			debugLog("Diff is unchanged since the last run, skipping")
+			if runConfig.commit || runConfig.addNote != "" {
+				// Staying silent would look like the commit or note was made
+				fmt.Fprintf(os.Stderr, "The diff is unchanged since the last run, so nothing was written (use -force to run anyway)\n")
+			}
+			return nil
+		}
+	}
+	debugLog("Found changes (%d bytes)", len(changes))
+	for _, f := range files {
+		debugLog("Diff stat: %s +%d -%d", f.path, f.added, f.removed)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	data := promptData{
+		Changes:   changes,
+		Files:     paths,
+		FileCount: len(files),
+		DiffStat:  formatDiffStat(files),
+		Languages: strings.Join(detectLanguages(paths), ", "),
+		Stash:     stashNotes,
+		Shallow:   shallowNote,
+		Truncated: truncated,
+	}
+	for _, f := range files {
+		data.Added += f.added
+		data.Removed += f.removed
+	}
+	if repo != nil {
+		data.Branch = currentBranch(repo)
+	}
+	if runConfig.contextFrom != "" {
+		if budget, ok := contextBudget(runConfig.maxLines, changes); !ok {
+			fmt.Fprintf(os.Stderr, "Leaving out %s: the diff already fills max_lines\n", runConfig.contextFrom)
+		} else {
+			var cut bool
+			data.Background, cut, err = readContextFile(runConfig.contextFrom, budget)
+			if err != nil {
+				return fmt.Errorf("readContextFile: %w", err)
+			}
+			data.Truncated = data.Truncated || cut
+			debugLog("Background context from %s (%d bytes)", runConfig.contextFrom, len(data.Background))
+		}
+	}
+	if runConfig.contextCommand != "" {
+		if budget, ok := contextBudget(runConfig.maxLines, changes, data.Background); !ok {
+			fmt.Fprintf(os.Stderr, "Leaving out the output of %q: the prompt already fills max_lines\n", runConfig.contextCommand)
+		} else {
+			dir := "."
+			if repo != nil {
+				if w, err := repo.Worktree(); err == nil {
+					dir = w.Filesystem.Root()
+				}
+			}
+			var cut bool
+			data.CommandOutput, cut, err = runContextCommand(ctx, runConfig.contextCommand, dir, runConfig.contextCommandTimeout, budget)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Leaving out the output of %q: %v\n", runConfig.contextCommand, err)
+			}
+			data.Truncated = data.Truncated || cut
+			debugLog("Command context from %q (%d bytes)", runConfig.contextCommand, len(data.CommandOutput))
+		}
+	}
+	ownerScope := ""
+	if runConfig.codeowners != "off" && repo != nil {
+		if w, err := repo.Worktree(); err == nil {
+			rules, err := readCodeowners(w.Filesystem)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Leaving out code owners: %v\n", err)
+			}
+			data.Owners, ownerScope = codeOwners(rules, paths)
+			debugLog("Code owners: %q, scope %q", data.Owners, ownerScope)
+		}
+	}
+	// Templates may use the scope whether or not -conventional is set
+	if runConfig.conventional || runConfig.promptTemplate != nil {
+		data.Scope = runConfig.scope
+		if data.Scope == "" && runConfig.codeowners == "scope" {
+			data.Scope = ownerScope
+		}
+		if data.Scope == "" {
+			data.Scope = inferScope(paths)
+		}
+		debugLog("Conventional commit scope: %q", data.Scope)
+	}
+	if runConfig.focusHint {
+		data.Focus = focusArea(files)
+		debugLog("Focus area: %q", data.Focus)
+	}
+	if runConfig.authorContext && repo != nil {
+		author, date, ok := revisionAuthor(repo, runConfig, noteTarget)
+		if ok {
+			data.AuthorDate = date.Format(time.RFC3339)
+		} else {
+			author = gitUser(repo)
+		}
+		data.Author = author
+		debugLog("Author context: %q %s", data.Author, data.AuthorDate)
+	}
+	if runConfig.useGitTemplate && repo != nil && runConfig.output == "commit" {
+		var cut bool
+		data.Template, cut, err = gitCommitTemplate(repo)
+		data.Truncated = data.Truncated || cut
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Leaving out the commit template: %v\n", err)
+		} else if data.Template == "" {
+			debugLog("commit.template is not set")
+		}
+	}
+	if runConfig.blameContext && repo != nil && !runConfig.sinceLast {
+		base, err := blameBase(repo, runConfig, noteTarget)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Leaving out blame context: %v\n", err)
+		} else if base != nil {
+			data.Blame, err = blameContext(ctx, base, changes, gitEmail(repo), time.Now())
+			if err != nil {
+				return fmt.Errorf("blameContext: %w", err)
+			}
+			debugLog("Blame context against %s (%d bytes)", base.Hash, len(data.Blame))
+		}
+	}
+	prompt, err := buildPrompt(runConfig, data)
 	if err != nil {
-		return fmt.Errorf("getStagedChanges: %w", err)
+		return fmt.Errorf("buildPrompt: %w", err)
 	}
 
-	if changes == "" {
-		debugLog("No staged changes found")
-		_, _ = fmt.Fprintf(output, "No staged changes found.\n")
+	messages := []chatMessage{{Role: "user", Content: prompt}}
+	if len(runConfig.compareModels) > 0 {
+		compareModels(ctx, runConfig, output, messages)
 		return nil
 	}
-
-	debugLog("Found staged changes (%d bytes)", len(changes))
 	debugLog("Calling %s API", runConfig.provider)
-	description, meta, err := describeChanges(ctx, runConfig, changes)
+	streamConfig := runConfig
+	var streamed *streamRecorder
+	if runConfig.stream {
+		streamed = &streamRecorder{w: output}
+		streamConfig.streamTo = streamed
+	}
+	description, meta, err := describeChanges(ctx, streamConfig, messages)
 	if err != nil {
 		return fmt.Errorf("describeChanges: %w", err)
 	}
+	if problem := checkQuality(runConfig, description, changes); problem != "" {
+		fmt.Fprintf(os.Stderr, "Rejected response (%s), retrying\n", problem)
+		if runConfig.stream {
+			_, _ = fmt.Fprintln(output)
+		}
+		retry, retryMeta, err := describeChanges(ctx, streamConfig, messages)
+		if err != nil {
+			return fmt.Errorf("describeChanges: %w", err)
+		}
+		meta.promptTokens += retryMeta.promptTokens
+		meta.completionTokens += retryMeta.completionTokens
+		meta.totalTokens += retryMeta.totalTokens
+		meta.duration += retryMeta.duration
+		if problem := checkQuality(runConfig, retry, changes); problem != "" {
+			return fmt.Errorf("model response failed the quality check twice: %s", problem)
+		}
+		description = retry
+	}
 
 	debugLog("Received description from API (%d bytes)", len(description))
-	_, _ = fmt.Fprintf(output, "%s\n", description)
+	var trailers []trailer
+	if runConfig.trailersFromAnalysis {
+		description, trailers = splitAnalysis(description)
+		debugLog("Trailers from analysis: %v", trailers)
+	}
+	var observations string
+	if runConfig.review {
+		description, observations = splitObservations(description)
+	}
+	if runConfig.polish {
+		polished, polishMeta, err := polishMessage(ctx, runConfig, description)
+		if err != nil {
+			return fmt.Errorf("polishMessage: %w", err)
+		}
+		description = polished
+		meta.promptTokens += polishMeta.promptTokens
+		meta.completionTokens += polishMeta.completionTokens
+		meta.totalTokens += polishMeta.totalTokens
+		meta.duration += polishMeta.duration
+	}
+	if runConfig.output == "commit" || runConfig.output == "note" {
+		description = plainText(description, runConfig.cleanMarkdown)
+	}
+	prefix := ""
+	if runConfig.output == "commit" {
+		prefix = subjectPrefix(runConfig.subjectPrefix, paths)
+		description = applySubjectStyle(description, runConfig.subjectStyle)
+		description = separateSubject(description, runConfig.bodyFormat != "none")
+	}
+	description = addSubjectPrefix(description, prefix)
+	// Refinement works on the message without the trailers added here, so
+	// a model that drops them cannot lose them
+	untrailed := description
+	description = appendTrailers(description, trailers)
+	header := ""
+	if runConfig.output == "pr" {
+		header = formatDiffStat(files) + "\n"
+	}
+	if runConfig.output == "review-md" {
+		description = reviewMarkdown(description, changes, files)
+	}
+	if runConfig.stream {
+		// The message was printed as it arrived
+		finishStream(output, streamed.text.String(), untrailed, description, trailers)
+	} else if !runConfig.jsonOutput {
+		_, _ = fmt.Fprintf(output, "%s%s\n", header, description)
+		if observations != "" {
+			_, _ = fmt.Fprintf(output, "\n%s\n%s\n", reviewSeparator, observations)
+		}
+	}
+
+	if runConfig.interactive {
+		description, meta, err = refineInteractively(ctx, runConfig, output, messages, untrailed, trailers, meta)
+		if err != nil {
+			return err
+		}
+		if runConfig.output == "commit" || runConfig.output == "note" {
+			description = plainText(description, runConfig.cleanMarkdown)
+		}
+		if runConfig.output == "commit" {
+			description = applySubjectStyle(description, runConfig.subjectStyle)
+			description = separateSubject(description, runConfig.bodyFormat != "none")
+		}
+		description = appendTrailers(addSubjectPrefix(description, prefix), trailers)
+	}
+
+	// The pr header is part of the document, not of its title or text
+	subject, body := splitMessage(description)
+	if runConfig.jsonOutput {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(jsonOutput{Subject: subject, Body: body, Message: header + description, Stats: diffStats(files), Observations: observations, Trailers: trailerMap(trailers)}); err != nil {
+			return fmt.Errorf("failed to write JSON output: %w", err)
+		}
+	}
+	if runConfig.subjectFile != "" {
+		if err := os.WriteFile(runConfig.subjectFile, []byte(subject+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write subject file: %w", err)
+		}
+	}
+	if runConfig.bodyFile != "" {
+		if err := os.WriteFile(runConfig.bodyFile, []byte(normalizeCommitMessage(body)), 0o644); err != nil {
+			return fmt.Errorf("failed to write body file: %w", err)
+		}
+	}
+
+	if runConfig.recordStats {
+		tokens := meta.totalTokens
+		if tokens == 0 {
+			tokens, _ = countTokens(runConfig.model, append(slices.Clone(messages), chatMessage{Role: "assistant", Content: description}))
+		}
+		if err := recordUsage(statsKey(repo), runConfig.provider, tokens); err != nil {
+			debugLog("Failed to record usage stats: %v", err)
+		}
+	}
+
+	if runConfig.messageFile != "" {
+		debugLog("Writing message to %s", runConfig.messageFile)
+		content := normalizeCommitMessage(header + description)
+		if runConfig.messagePlacement != "replace" {
+			existing, err := os.ReadFile(runConfig.messageFile)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to read message file: %w", err)
+			}
+			content = placeMessage(string(existing), content, runConfig.messagePlacement)
+		}
+		if err := os.WriteFile(runConfig.messageFile, []byte(content), 0o644); err != nil {
+			return fmt.Errorf("failed to write message file: %w", err)
+		}
+	}
+
+	if noteTarget != nil {
+		if err := addNote(repo, *noteTarget, description); err != nil {
+			return fmt.Errorf("addNote: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Added note to %s\n", noteTarget.String()[:7])
+	}
+
+	if runConfig.commit {
+		message := description
+		if runConfig.gerritChangeID {
+			if message, err = addChangeID(repo, message, time.Now()); err != nil {
+				return fmt.Errorf("addChangeID: %w", err)
+			}
+		}
+		hash, err := commitChanges(repo, message, runConfig.author)
+		if err != nil {
+			return fmt.Errorf("commitChanges: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Committed %s\n", hash.String()[:7])
+
+		if runConfig.postCommit != "" {
+			if err := runPostCommit(ctx, repo, runConfig.postCommit); err != nil {
+				if !runConfig.rollbackOnFailure {
+					fmt.Fprintf(os.Stderr, "Commit %s was kept; undo it with \"git reset --soft HEAD~1\" or use -rollback-on-failure\n", hash.String()[:7])
+					return fmt.Errorf("post-commit command failed: %w", err)
+				}
+				if rbErr := rollbackCommit(repo, hash); rbErr != nil {
+					return fmt.Errorf("post-commit command failed: %w (rollback failed: %v)", err, rbErr)
+				}
+				fmt.Fprintf(os.Stderr, "Rolled back %s, the changes are still staged\n", hash.String()[:7])
+				return fmt.Errorf("post-commit command failed: %w", err)
+			}
+		}
+	}
+
+	// Only a run whose message was delivered counts for -since-last,
+	// min_interval and skip_unchanged, so a failed one is simply rerun
+	if runConfig.sinceLast {
+		if err := saveSinceLast(sinceLastPath, runConfig.baseline, files); err != nil {
+			return fmt.Errorf("saveSinceLast: %w", err)
+		}
+	}
+
+	if runConfig.minInterval > 0 {
+		if err := recordRunTime(time.Now()); err != nil {
+			debugLog("Failed to record run time: %v", err)
+		}
+	}
+	if runConfig.skipUnchanged {
+		if err := os.WriteFile(lastDiffPath, []byte(diffHash(changes)+"\n"), 0o644); err != nil {
+			debugLog("Failed to record the diff hash: %v", err)
+		}
+	}
 
 	if runConfig.verbose {
 		printVerboseStats(meta)
@@ -191,6 +1056,85 @@ func run(ctx context.Context, output io.Writer, argv []string) error {
 	return nil
 }
 
+// jsonOutput is the structure printed by -json
+type jsonOutput struct {
+	Subject string              `json:"subject"`
+	Body    string              `json:"body"`
+	Message string              `json:"message"`
+	Stats   map[string]fileStat `json:"stats"`
+	// Potential issues listed by -review, kept out of the message
+	Observations string `json:"observations,omitempty"`
+	// Trailers added by -trailers-from-analysis, also part of the message
+	Trailers map[string]string `json:"trailers,omitempty"`
+}
+
+// fileStat is the per-file line count reported under "stats" by -json
+type fileStat struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+// diffStats maps each described file to its added and removed line counts
+func diffStats(files []stagedFile) map[string]fileStat {
+	stats := make(map[string]fileStat, len(files))
+	for _, f := range files {
+		stats[f.path] = fileStat{Added: f.added, Removed: f.removed}
+	}
+	return stats
+}
+
+// splitMessage splits a message into its first line and the body that
+// follows the blank separator line
+func splitMessage(message string) (subject, body string) {
+	message = strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n"))
+	subject, body, _ = strings.Cut(message, "\n")
+	return strings.TrimSpace(subject), strings.TrimSpace(body)
+}
+
+// errAborted is returned when the user quits an interactive session
+var errAborted = errors.New("aborted by user")
+
+// refineInteractively reads follow-up instructions from stdin and asks the
+// model to revise its message until the user accepts it with an empty line.
+// description goes without trailers, which are only added to what is shown,
+// and the token counts and duration of every round are added to meta.
+func refineInteractively(ctx context.Context, cfg config, output io.Writer, messages []chatMessage, description string, trailers []trailer, meta responseMetadata) (string, responseMetadata, error) {
+	scanner := bufio.NewScanner(stdin)
+	for {
+		fmt.Fprint(os.Stderr, "\nRefine (instruction, empty line to accept, q to quit): ")
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", meta, fmt.Errorf("failed to read input: %w", err)
+			}
+			// EOF accepts the current message
+			return description, meta, nil
+		}
+		feedback := strings.TrimSpace(scanner.Text())
+		switch feedback {
+		case "":
+			return description, meta, nil
+		case "q", "quit":
+			return "", meta, errAborted
+		}
+
+		messages = append(messages,
+			chatMessage{Role: "assistant", Content: description},
+			chatMessage{Role: "user", Content: feedback + "\n\nReply with the complete revised text only."},
+		)
+		debugLog("Refining message (%d messages in conversation)", len(messages))
+		revised, revisedMeta, err := describeChanges(ctx, cfg, messages)
+		if err != nil {
+			return "", meta, fmt.Errorf("describeChanges: %w", err)
+		}
+		description = revised
+		meta.promptTokens += revisedMeta.promptTokens
+		meta.completionTokens += revisedMeta.completionTokens
+		meta.totalTokens += revisedMeta.totalTokens
+		meta.duration += revisedMeta.duration
+		_, _ = fmt.Fprintf(output, "\n%s\n", appendTrailers(description, trailers))
+	}
+}
+
 func printVerboseStats(meta responseMetadata) {
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "--- Stats ---")
@@ -207,36 +1151,483 @@ func printVerboseStats(meta responseMetadata) {
 	}
 }
 
-// loadConfigFile loads configuration from the YAML file
-func loadConfigFile() (fileConfig, error) {
-	// Get config directory using stdlib
-	configDir, err := os.UserConfigDir()
-	if err != nil {
-		return fileConfig{}, fmt.Errorf("failed to get config directory: %w", err)
+// compareModels sends the same messages to each of cfg.compareModels in turn
+// and prints every result with its latency and token usage. A failing model
+// is reported and the comparison moves on.
+func compareModels(ctx context.Context, cfg config, output io.Writer, messages []chatMessage) {
+	for i, model := range cfg.compareModels {
+		if i > 0 {
+			fmt.Fprintln(output)
+		}
+		cfg.model = model
+		start := time.Now()
+		description, meta, err := describeChanges(ctx, cfg, messages)
+		elapsed := time.Since(start).Seconds()
+		if err != nil {
+			fmt.Fprintf(output, "=== %s (failed after %.2fs) ===\n%v\n", model, elapsed, err)
+			continue
+		}
+		fmt.Fprintf(output, "=== %s (%.2fs, %d prompt + %d completion tokens) ===\n%s\n",
+			model, elapsed, meta.promptTokens, meta.completionTokens, description)
 	}
+}
 
-	configPath := filepath.Join(configDir, "describe", "config.yaml")
+// stringList is a flag.Value that collects repeated string flags
+type stringList []string
 
-	// If config file doesn't exist, return defaults
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		debugLog("No config file found at %s, using defaults", configPath)
-		return fileConfig{
-			Provider:    "ollama",
-			APIEndpoint: "http://localhost:11434",
-			Model:       "llama3.2",
-			MaxLines:    10000,
-		}, nil
-	}
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
 
-	debugLog("Loading config from %s", configPath)
-	data, err := os.ReadFile(configPath)
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// cacheDir returns describe's cache directory, creating it if needed
+func cacheDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get cache directory: %w", err)
+	}
+	dir := filepath.Join(base, "describe")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return dir, nil
+}
+
+// lastRunFile is the cache file holding the time of the last successful run
+const lastRunFile = "last-run"
+
+// lastRunTime returns when describe last completed successfully, or the
+// zero time if it has not been recorded
+func lastRunTime() (time.Time, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return time.Time{}, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, lastRunFile))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		debugLog("Ignoring unreadable %s: %v", lastRunFile, err)
+		return time.Time{}, nil
+	}
+	return t, nil
+}
+
+// recordRunTime stores t as the time of the last successful run
+func recordRunTime(t time.Time) error {
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, lastRunFile), []byte(t.Format(time.RFC3339Nano)+"\n"), 0o644)
+}
+
+// configCandidates lists the config file locations in lookup order:
+// $XDG_CONFIG_HOME, then ~/.config, then the platform config directory
+// (which differs from ~/.config on macOS and Windows)
+func configCandidates() []string {
+	var dirs []string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		dirs = append(dirs, xdg)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config"))
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "describe", "config.yaml")
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// findConfigFile returns the first existing config file, or the preferred
+// location and false when there is none
+func findConfigFile() (string, bool) {
+	candidates := configCandidates()
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[len(candidates)-1], false
+}
+
+// sinceLastFile returns the cache file holding what -since-last last
+// described in repo, one file per worktree
+func sinceLastFile(repo *git.Repository) (string, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("repo.Worktree: %w", err)
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(w.Filesystem.Root()))
+	return filepath.Join(dir, "since-last-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// lastDiffFile returns the cache file holding the hash of the diff
+// skip_unchanged last described, one file per worktree or, outside a
+// repository, per working directory
+func lastDiffFile(repo *git.Repository) (string, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if repo != nil {
+		w, err := repo.Worktree()
+		if err != nil {
+			return "", fmt.Errorf("repo.Worktree: %w", err)
+		}
+		root = w.Filesystem.Root()
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(dir, "last-diff-"+hex.EncodeToString(sum[:8])), nil
+}
+
+// diffHash returns the hex SHA-256 of changes
+func diffHash(changes string) string {
+	sum := sha256.Sum256([]byte(changes))
+	return hex.EncodeToString(sum[:])
+}
+
+// diffUnchanged reports whether the file at path records the hash of changes
+func diffUnchanged(path, changes string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(data)) == diffHash(changes)
+}
+
+// loadSinceLast reads the per-path blob hashes stored by saveSinceLast
+func loadSinceLast(path string) (map[string]plumbing.Hash, error) {
+	baseline := make(map[string]plumbing.Hash)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return baseline, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored map[string]string
+	if err := json.Unmarshal(data, &stored); err != nil {
+		debugLog("Ignoring unreadable %s: %v", path, err)
+		return baseline, nil
+	}
+	for p, hash := range stored {
+		baseline[p] = plumbing.NewHash(hash)
+	}
+	return baseline, nil
+}
+
+// saveSinceLast records the content of files as described, on top of the
+// previous baseline. Deleted files are stored with a zero hash.
+func saveSinceLast(path string, baseline map[string]plumbing.Hash, files []stagedFile) error {
+	stored := make(map[string]string, len(baseline)+len(files))
+	for p, hash := range baseline {
+		stored[p] = hash.String()
+	}
+	for _, f := range files {
+		stored[f.path] = f.hash.String()
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// usageStatsFile is the cache file holding the -record-stats totals
+const usageStatsFile = "stats.json"
+
+// repoUsage is what -record-stats accumulates for one repository
+type repoUsage struct {
+	Invocations     int            `json:"invocations"`
+	EstimatedTokens int            `json:"estimated_tokens"`
+	Providers       map[string]int `json:"providers"` // invocations per provider
+}
+
+// statsKey identifies the repository stats are recorded for: the worktree
+// root, or the current directory when describe ran without a repository
+func statsKey(repo *git.Repository) string {
+	if repo != nil {
+		if w, err := repo.Worktree(); err == nil {
+			return w.Filesystem.Root()
+		}
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "unknown"
+	}
+	return dir
+}
+
+// loadUsageStats reads the recorded stats keyed by repository path
+func loadUsageStats() (map[string]repoUsage, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]repoUsage)
+	data, err := os.ReadFile(filepath.Join(dir, usageStatsFile))
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		debugLog("Ignoring unreadable %s: %v", usageStatsFile, err)
+		return make(map[string]repoUsage), nil
+	}
+	return stats, nil
+}
+
+// recordUsage adds one invocation using tokens to the stats for key
+func recordUsage(key, provider string, tokens int) error {
+	stats, err := loadUsageStats()
+	if err != nil {
+		return err
+	}
+	usage := stats[key]
+	usage.Invocations++
+	usage.EstimatedTokens += tokens
+	if usage.Providers == nil {
+		usage.Providers = make(map[string]int)
+	}
+	usage.Providers[provider]++
+	stats[key] = usage
+
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, usageStatsFile), append(data, '\n'), 0o644)
+}
+
+// printUsageStats writes a per-repository summary of stats to w
+func printUsageStats(w io.Writer, stats map[string]repoUsage) {
+	if len(stats) == 0 {
+		fmt.Fprintln(w, "No stats recorded. Enable them with -record-stats or record_stats: true.")
+		return
+	}
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		usage := stats[key]
+		providers := make([]string, 0, len(usage.Providers))
+		for provider, count := range usage.Providers {
+			providers = append(providers, fmt.Sprintf("%s %d", provider, count))
+		}
+		sort.Strings(providers)
+		fmt.Fprintf(w, "%s\n", key)
+		fmt.Fprintf(w, "  Invocations: %d\n", usage.Invocations)
+		fmt.Fprintf(w, "  Tokens:      ~%d\n", usage.EstimatedTokens)
+		fmt.Fprintf(w, "  Providers:   %s\n", strings.Join(providers, ", "))
+	}
+}
+
+// systemConfigFile is the machine-wide config, overridden by all others
+const systemConfigFile = "/etc/describe/config.yaml"
+
+// repoConfigFile is the per-repository config, read from the worktree root
+const repoConfigFile = ".describe.yaml"
+
+// configLayer is one config file; repo marks the repository's .describe.yaml
+type configLayer struct {
+	path string
+	repo bool
+}
+
+// configLayers lists the config files that exist, lowest precedence first:
+// the system-wide file, the user's config file, the repository's
+// .describe.yaml and the file named by $DESCRIBE_CONFIG
+func configLayers() ([]configLayer, error) {
+	var layers []configLayer
+	if _, err := os.Stat(systemConfigFile); err == nil {
+		layers = append(layers, configLayer{path: systemConfigFile})
+	}
+	if path, found := findConfigFile(); found {
+		layers = append(layers, configLayer{path: path})
+	}
+	if repo, err := openRepository("."); err == nil {
+		if w, err := repo.Worktree(); err == nil {
+			path := filepath.Join(w.Filesystem.Root(), repoConfigFile)
+			if _, err := os.Stat(path); err == nil {
+				layers = append(layers, configLayer{path: path, repo: true})
+			}
+		}
+	}
+	if path := os.Getenv("DESCRIBE_CONFIG"); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("DESCRIBE_CONFIG: %w", err)
+		}
+		layers = append(layers, configLayer{path: path})
+	}
+	return layers, nil
+}
+
+// repoSafeKeys are the settings a repository's .describe.yaml may change on
+// its own: prompt wording, message style and limits. Keys that run
+// commands, pick the provider, endpoint or key, or change how describe runs
+// are only read from repositories listed in trusted_repos, since anyone can
+// commit a .describe.yaml.
+var repoSafeKeys = map[string]bool{
+	"model": true, "max_lines": true, "max_files": true, "max_tokens": true,
+	"temperature": true, "reasoning_model_prefixes": true, "retry_empty": true,
+	"timeout": true, "deadline": true, "large_context_model": true, "context_window": true,
+	"read_concurrency": true, "author_context": true, "focus_hint": true, "codeowners": true,
+	"prompt_prefix": true, "prompt_suffix": true, "model_prompts": true, "preset": true,
+	"output": true, "conventional": true, "subject_format": true, "body_format": true,
+	"subject_prefix": true, "subject_style": true, "subject_reminder_lines": true,
+	"clean_markdown": true, "gerrit_change_id": true, "response_strip_patterns": true,
+	"min_subject_length": true, "require_body": true, "reject_echo": true,
+	"ignore_dirs": true, "replace_ignore_dirs": true, "binary_files": true, "binary_summary": true,
+	"rename_handling": true, "detect_moves": true, "diff_format": true, "summary_head_lines": true,
+	"use_git_template": true, "blame_context": true,
+}
+
+// trustedRepos returns trusted_repos from the config files outside the
+// repository; like other lists, a later file replaces an earlier one's
+func trustedRepos(layers []configLayer) ([]string, error) {
+	var trusted []string
+	for _, layer := range layers {
+		if layer.repo {
+			continue
+		}
+		data, err := os.ReadFile(layer.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		var cfg struct {
+			TrustedRepos []string `yaml:"trusted_repos"`
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", layer.path, err)
+		}
+		if cfg.TrustedRepos != nil {
+			trusted = cfg.TrustedRepos
+		}
+	}
+	return trusted, nil
+}
+
+// isTrustedRepo reports whether root is one of the trusted paths, which may
+// start with "~/"
+func isTrustedRepo(root string, trusted []string) bool {
+	home, _ := os.UserHomeDir()
+	for _, path := range trusted {
+		if rest, ok := strings.CutPrefix(path, "~/"); ok && home != "" {
+			path = filepath.Join(home, rest)
+		}
+		if abs, err := filepath.Abs(path); err == nil && abs == filepath.Clean(root) {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigLayer returns the contents of a config file. For the
+// .describe.yaml of a repository that is not trusted, keys outside
+// repoSafeKeys are removed and returned as ignored.
+func readConfigLayer(layer configLayer, trusted []string) (data []byte, ignored []string, err error) {
+	data, err = os.ReadFile(layer.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if !layer.repo || isTrustedRepo(filepath.Dir(layer.path), trusted) {
+		return data, nil, nil
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file %s: %w", layer.path, err)
+	}
+	for key := range raw {
+		if !repoSafeKeys[key] {
+			ignored = append(ignored, key)
+			delete(raw, key)
+		}
+	}
+	if len(ignored) == 0 {
+		return data, nil, nil
+	}
+	slices.Sort(ignored)
+	data, err = yaml.Marshal(raw)
+	return data, ignored, err
+}
+
+// loadConfigFile merges the config layers into one fileConfig. Each file
+// only overrides the keys it sets; model_prompts entries are merged by key,
+// while lists such as ignore_dirs are replaced as a whole.
+func loadConfigFile() (fileConfig, error) {
+	layers, err := configLayers()
 	if err != nil {
-		return fileConfig{}, fmt.Errorf("failed to read config file: %w", err)
+		return fileConfig{}, err
 	}
 
+	// If no config file exists, return defaults
+	if len(layers) == 0 {
+		debugLog("No config file found, using defaults")
+		return fileConfig{
+			Provider:    "ollama",
+			APIEndpoint: "http://localhost:11434",
+			Model:       "llama3.2",
+			MaxLines:    10000,
+		}, nil
+	}
+
+	trusted, err := trustedRepos(layers)
+	if err != nil {
+		return fileConfig{}, err
+	}
 	var cfg fileConfig
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return fileConfig{}, fmt.Errorf("failed to parse config file: %w", err)
+	for _, layer := range layers {
+		debugLog("Loading config from %s", layer.path)
+		data, ignored, err := readConfigLayer(layer, trusted)
+		if err != nil {
+			return fileConfig{}, err
+		}
+		if len(ignored) > 0 {
+			fmt.Fprintf(os.Stderr, "Ignoring %s in %s: add the repository to trusted_repos in your own config to allow them\n", strings.Join(ignored, ", "), layer.path)
+		}
+		// Decoding into the same struct leaves keys the file doesn't set alone
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return fileConfig{}, fmt.Errorf("failed to parse config file %s: %w", layer.path, err)
+		}
 	}
 
 	// Set defaults if not specified in config file
@@ -248,12 +1639,20 @@ func loadConfigFile() (fileConfig, error) {
 			cfg.APIEndpoint = "http://localhost:11434"
 		} else if cfg.Provider == "openrouter" {
 			cfg.APIEndpoint = "https://openrouter.ai/api/v1"
+		} else if cfg.Provider == "openai" {
+			cfg.APIEndpoint = "https://api.openai.com/v1"
+		} else if cfg.Provider == "anthropic" {
+			cfg.APIEndpoint = "https://api.anthropic.com/v1"
 		}
 	}
 	if cfg.Model == "" {
 		if cfg.Provider == "ollama" {
 			cfg.Model = "llama3.2"
-		} else {
+		} else if cfg.Provider == "openai" {
+			cfg.Model = "gpt-4o-mini"
+		} else if cfg.Provider == "anthropic" {
+			cfg.Model = "claude-3-5-sonnet-latest"
+		} else if cfg.Provider != "auto" {
 			cfg.Model = "anthropic/claude-4.5-sonnet"
 		}
 	}
@@ -264,6 +1663,54 @@ func loadConfigFile() (fileConfig, error) {
 	return cfg, nil
 }
 
+// providerKeyEnv names the environment variable holding the API key of
+// providers called directly; it takes precedence over api_key
+var providerKeyEnv = map[string]string{
+	"openai":    "OPENAI_API_KEY",
+	"anthropic": "ANTHROPIC_API_KEY",
+}
+
+// defaultOllamaEndpoint is where a local Ollama listens by default
+const defaultOllamaEndpoint = "http://localhost:11434"
+
+// autoProviders are the cloud providers "auto" falls back to, in order,
+// when no Ollama answers; the first with an API key is picked
+var autoProviders = []string{"openrouter", "openai", "anthropic"}
+
+// detectProvider picks a provider for "auto": a reachable Ollama at
+// ollamaEndpoint first, then the first of autoProviders with an API key.
+// openRouterKey is the api_key or OPENROUTER_API_KEY; the others are read
+// from providerKeyEnv. It returns the key to use with the provider.
+func detectProvider(ollamaEndpoint, openRouterKey string) (provider, apiKey string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ollamaEndpoint+"/api/tags", nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return "ollama", "", nil
+		}
+	}
+	debugLog("Ollama not reachable at %s: %v", ollamaEndpoint, err)
+	envs := make([]string, 0, len(autoProviders))
+	for _, p := range autoProviders {
+		env, ok := providerKeyEnv[p]
+		key := os.Getenv(env)
+		if !ok {
+			env, key = "OPENROUTER_API_KEY", openRouterKey
+		}
+		if key != "" {
+			return p, key, nil
+		}
+		envs = append(envs, env)
+	}
+	return "", "", fmt.Errorf("provider auto: Ollama is not reachable at %s and none of %s is set", ollamaEndpoint, strings.Join(envs, ", "))
+}
+
 func getConfig(args []string) (config, bool, error) {
 	// Load config from file first
 	fileCfg, err := loadConfigFile()
@@ -280,30 +1727,233 @@ func getConfig(args []string) (config, bool, error) {
 	cfg.debug = fileCfg.Debug
 	cfg.verbose = fileCfg.Verbose
 	cfg.maxLines = fileCfg.MaxLines
+	cfg.authorContext = fileCfg.AuthorContext
+	cfg.focusHint = fileCfg.FocusHint
+	cfg.codeowners = fileCfg.Codeowners
+	if cfg.codeowners == "" {
+		cfg.codeowners = "off"
+	}
+	cfg.useGitTemplate = fileCfg.UseGitTemplate
+	cfg.blameContext = fileCfg.BlameContext
+	cfg.maxFiles = fileCfg.MaxFiles
+	cfg.summaryHeadLines = fileCfg.SummaryHeadLines
+	cfg.promptPrefix = fileCfg.PromptPrefix
+	cfg.promptSuffix = fileCfg.PromptSuffix
+	cfg.temperature = fileCfg.Temperature
+	cfg.maxTokens = fileCfg.MaxTokens
+	cfg.reasoningModelPrefixes = fileCfg.ReasoningModelPrefixes
+	if cfg.reasoningModelPrefixes == nil {
+		cfg.reasoningModelPrefixes = defaultReasoningModelPrefixes
+	}
+	cfg.conventional = fileCfg.Conventional
+	cfg.bodyFormat = fileCfg.BodyFormat
+	subjectFormat := fileCfg.SubjectFormat
+	cfg.minInterval = fileCfg.MinInterval
+	cfg.skipUnchanged = fileCfg.SkipUnchanged
+	// Without a limit a hung server would keep describe waiting forever
+	cfg.timeout = defaultTimeout
+	if fileCfg.Timeout != nil {
+		cfg.timeout = *fileCfg.Timeout
+	}
+	cfg.deadline = fileCfg.Deadline
+	cfg.forceHTTP1 = fileCfg.ForceHTTP1
+	cfg.staleAfter = fileCfg.StaleAfter
+	cfg.ignoreDirs = fileCfg.IgnoreDirs
+	cfg.replaceIgnoreDirs = fileCfg.ReplaceIgnoreDirs
+	cfg.largeContextModel = fileCfg.LargeContextModel
+	cfg.contextWindow = fileCfg.ContextWindow
+	cfg.subjectPrefix = fileCfg.SubjectPrefix
+	cfg.diffCommand = fileCfg.DiffCommand
+	cfg.diffFormat = fileCfg.DiffFormat
+	if cfg.diffFormat == "" {
+		cfg.diffFormat = "unified"
+	}
+	cfg.recordStats = fileCfg.RecordStats
+	cfg.contextCommand = fileCfg.ContextCommand
+	cfg.contextCommandTimeout = fileCfg.ContextCommandTimeout
+	if cfg.contextCommandTimeout <= 0 {
+		cfg.contextCommandTimeout = 30 * time.Second
+	}
+	cfg.postCommit = fileCfg.PostCommit
+	cfg.rollbackOnFailure = fileCfg.RollbackOnFailure
+	cfg.gerritChangeID = fileCfg.GerritChangeID
+	cfg.minSubjectLength = fileCfg.MinSubjectLength
+	cfg.requireBody = fileCfg.RequireBody
+	cfg.rejectEcho = fileCfg.RejectEcho
+	cfg.stream = fileCfg.Stream
+	cfg.readConcurrency = fileCfg.ReadConcurrency
+	if cfg.readConcurrency <= 0 {
+		cfg.readConcurrency = runtime.GOMAXPROCS(0)
+	}
+	cfg.polish = fileCfg.Polish
+	cfg.polishModel = fileCfg.PolishModel
+	cfg.renameHandling = fileCfg.RenameHandling
+	if cfg.renameHandling == "" {
+		cfg.renameHandling = "content"
+	}
+	cfg.detectMoves = fileCfg.DetectMoves
+	cfg.binaryFiles = fileCfg.BinaryFiles
+	if cfg.binaryFiles == "" {
+		cfg.binaryFiles = "note"
+	}
+	cfg.binarySummary = fileCfg.BinarySummary
+	if cfg.binarySummary == "" {
+		cfg.binarySummary = "mime"
+	}
+	cfg.output = fileCfg.Output
+	if cfg.output == "" {
+		cfg.output = "commit"
+	}
+	cfg.retryEmpty = 1
+	if fileCfg.RetryEmpty != nil {
+		cfg.retryEmpty = *fileCfg.RetryEmpty
+	}
+	cfg.subjectReminderLines = defaultSubjectReminderLines
+	if fileCfg.SubjectReminderLines != nil {
+		cfg.subjectReminderLines = *fileCfg.SubjectReminderLines
+	}
+	cfg.subjectStyle = fileCfg.SubjectStyle
+	cfg.cleanMarkdown = fileCfg.CleanMarkdown
+	cfg.unstagedWarning = true
+	if fileCfg.UnstagedWarning != nil {
+		cfg.unstagedWarning = *fileCfg.UnstagedWarning
+	}
 
-	var showhelp bool
+	var showhelp, noBody, noUnstagedWarning bool
 	var modelFlag, providerFlag, endpointFlag string
+	preset := fileCfg.Preset
 
-	// Determine config file path for help output
-	configDir, _ := os.UserConfigDir()
-	configPath := filepath.Join(configDir, "describe", "config.yaml")
+	// Determine config file paths for help output
+	configPath, _ := findConfigFile()
+	layers, _ := configLayers()
 
 	flagSet := flag.NewFlagSet("describe", flag.ContinueOnError)
-	flagSet.StringVar(&providerFlag, "provider", "", "API provider (openrouter or ollama)")
+	flagSet.StringVar(&providerFlag, "provider", "", "API provider (openrouter, openai, anthropic, ollama, or auto to pick one that is available)")
 	flagSet.StringVar(&modelFlag, "model", "", "Model to use for description")
 	flagSet.StringVar(&endpointFlag, "endpoint", "", "API endpoint URL")
 	flagSet.BoolVar(&cfg.debug, "debug", cfg.debug, "Enable debug logging")
+	flagSet.BoolVar(&cfg.debugDiff, "debug-diff", false, "Dump how the diff of each staged file was computed")
 	flagSet.BoolVar(&cfg.verbose, "verbose", cfg.verbose, "Show token usage and timing stats")
 	flagSet.BoolVar(&cfg.verbose, "v", cfg.verbose, "Show token usage and timing stats (shorthand)")
 	flagSet.IntVar(&cfg.maxLines, "max-lines", cfg.maxLines, "Maximum number of lines to process")
+	flagSet.BoolVar(&cfg.dropWhitespaceHunks, "drop-whitespace-hunks", false, "Leave out hunks whose changed lines differ only in whitespace")
+	flagSet.IntVar(&cfg.maxHunksPerFile, "max-hunks-per-file", 0, "Keep only the N largest hunks of each file and note how many were left out (0 = no limit)")
+	flagSet.BoolVar(&cfg.truncateOnLimit, "truncate-on-limit", false, "When -max-lines is exceeded, describe the first max-lines lines of the diff instead of failing")
+	flagSet.BoolVar(&cfg.suggestSplit, "suggest-split", false, "When -max-lines is exceeded, suggest how to split the files into smaller commits")
+	flagSet.IntVar(&cfg.maxFiles, "max-files", cfg.maxFiles, "Summarize instead of showing full diffs above this many files (0 = no limit)")
+	flagSet.IntVar(&cfg.summaryHeadLines, "summary-head-lines", cfg.summaryHeadLines, "Show the first N lines of each added file in a -max-files summary (0 = names only)")
+	flagSet.BoolVar(&cfg.authorContext, "author-context", cfg.authorContext, "Include the configured git user in the prompt")
+	flagSet.BoolVar(&cfg.useGitTemplate, "use-git-template", cfg.useGitTemplate, "Ask the model to fill in the file named by git's commit.template")
+	flagSet.BoolVar(&cfg.blameContext, "blame-context", cfg.blameContext, "Blame the changed lines and tell the model whether they are recent or long-standing code (slow on large histories)")
+	flagSet.StringVar(&cfg.codeowners, "codeowners", cfg.codeowners, "Use CODEOWNERS: prompt names the owners of the changed files, scope also makes the owning team the conventional commit scope, off")
+	flagSet.BoolVar(&cfg.focusHint, "focus-hint", cfg.focusHint, "Tell the model which directory most of the changes are in")
+	flagSet.Func("temperature", "Sampling temperature (provider default if unset)", func(value string) error {
+		t, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		cfg.temperature = &t
+		return nil
+	})
+	flagSet.StringVar(&cfg.largeContextModel, "large-context-model", cfg.largeContextModel, "Model to retry with when the prompt is too large for -model")
+	flagSet.IntVar(&cfg.contextWindow, "context-window", cfg.contextWindow, "Context size of -model in tokens, used to switch to -large-context-model up front (0 = unknown)")
+	flagSet.IntVar(&cfg.maxTokens, "max-tokens", cfg.maxTokens, "Maximum tokens in the response (0 = provider default)")
+	flagSet.StringVar(&preset, "preset", preset, "Built-in prompt style: "+strings.Join(presetNames(), ", "))
+	flagSet.StringVar(&cfg.promptFile, "prompt-file", "", "Template file used as the entire prompt for this run, overriding presets, model prompts and prompt prefix/suffix")
+	flagSet.StringVar(&cfg.promptPrefix, "prompt-prefix", cfg.promptPrefix, "Text prepended to the prompt")
+	flagSet.Var((*stringList)(&cfg.instructions), "instruction", "Extra instruction appended to the prompt (repeatable)")
+	flagSet.IntVar(&cfg.subjectReminderLines, "subject-reminder-lines", cfg.subjectReminderLines, "Repeat the subject length rule after diffs of at least this many lines (0 = never)")
+	flagSet.BoolVar(&cfg.cleanMarkdown, "clean-markdown", cfg.cleanMarkdown, "Turn a markdown heading into the subject line and normalize bullets in commit messages and notes")
+	flagSet.Func("subject-style", "Comma-separated subject rules to enforce: "+strings.Join(subjectStyles, ", ")+" (replaces subject_style)", func(value string) error {
+		cfg.subjectStyle = nil
+		for _, rule := range strings.Split(value, ",") {
+			if rule = strings.TrimSpace(rule); rule != "" {
+				cfg.subjectStyle = append(cfg.subjectStyle, rule)
+			}
+		}
+		return nil
+	})
+	flagSet.IntVar(&cfg.retryEmpty, "retry-empty", cfg.retryEmpty, "Number of retries when the model returns an empty response or an attempt times out")
+	flagSet.DurationVar(&cfg.timeout, "timeout", cfg.timeout, "Give up on an API attempt after this long and retry it (e.g. 30s, 0 for no limit)")
+	flagSet.BoolVar(&cfg.forceHTTP1, "force-http1", cfg.forceHTTP1, "Use HTTP/1.1 for API requests, for proxies that mishandle HTTP/2")
+	flagSet.DurationVar(&cfg.deadline, "deadline", cfg.deadline, "Give up on a request, retries included, after this long (e.g. 2m)")
+	flagSet.BoolVar(&noUnstagedWarning, "no-unstaged-warning", false, "Don't warn about files with unstaged changes that the description leaves out")
+	flagSet.DurationVar(&cfg.staleAfter, "stale-after", cfg.staleAfter, "Warn when the staged changes were last touched longer ago than this (e.g. 72h)")
+	flagSet.StringVar(&cfg.output, "output", cfg.output, "Output style: commit, pr (pull request description with diff stat), note or review-md (summary plus a collapsible diff per file, in markdown)")
+	flagSet.BoolVar(&cfg.rebase, "rebase", false, "Describe the commit being edited in an interactive rebase, or being built by a conflicted rebase or cherry-pick")
+	flagSet.StringVar(&cfg.withStash, "with-stash", "", "Describe the staged changes together with those of a stash entry, e.g. stash@{1}")
+	flagSet.StringVar(&cfg.against, "against", "", "Describe the staged tree's full difference from this ref's tip (not the merge-base), e.g. main")
+	flagSet.StringVar(&cfg.addNote, "add-note", "", "Describe the changes of this revision and attach the result as a git note")
+	flagSet.StringVar(&cfg.diffFormat, "diff-format", cfg.diffFormat, "How changes are shown to the model: "+strings.Join(diffFormats, ", "))
+	flagSet.StringVar(&cfg.diffCommand, "diff-command", cfg.diffCommand, "External diff tool run with the old and new file versions, e.g. \"difft --display inline\"")
+	flagSet.BoolVar(&cfg.sinceLast, "since-last", false, "Describe only the staged changes made since the last -since-last run")
+	flagSet.StringVar(&cfg.diffFile, "diff-file", "", "Describe the unified diff in this file (\"-\" for stdin) instead of staged changes; no git repository needed")
+	flagSet.StringVar(&cfg.contextFrom, "context-from", "", "File with background text (e.g. a design doc) to include in the prompt")
+	flagSet.StringVar(&cfg.contextCommand, "context-command", cfg.contextCommand, "Shell command whose output (e.g. of \"go test ./...\") is included in the prompt")
+	flagSet.BoolVar(&cfg.commit, "commit", false, "Commit the staged changes with the generated message")
+	flagSet.StringVar(&cfg.author, "author", "", "Override the commit author with \"Name <email>\" (requires -commit)")
+	flagSet.StringVar(&cfg.messageFile, "message-file", "", "Write the message to this file (e.g. .git/COMMIT_EDITMSG from a prepare-commit-msg hook)")
+	flagSet.StringVar(&cfg.messagePlacement, "message-placement", "replace", "How -message-file treats existing content: replace, top (message above it) or bottom (message below its text, above git's comments)")
+	flagSet.BoolVar(&cfg.interactiveHunks, "interactive-hunks", false, "Choose which staged hunks to describe, one at a time")
+	flagSet.BoolVar(&cfg.selectFiles, "select", false, "List the staged files and choose which to leave out of the description")
+	flagSet.BoolVar(&cfg.conventional, "conventional", cfg.conventional, "Write a Conventional Commits message (type(scope): subject)")
+	flagSet.StringVar(&subjectFormat, "subject-format", subjectFormat, "Subject line style: plain or conventional (overrides -conventional)")
+	flagSet.StringVar(&cfg.bodyFormat, "body-format", cfg.bodyFormat, "Body style: prose, bullets or none (subject only)")
+	flagSet.BoolVar(&noBody, "no-body", false, "Subject line only, dropping any body the model writes anyway (same as -body-format none)")
+	flagSet.StringVar(&cfg.subjectPrefix, "subject-prefix", cfg.subjectPrefix, "Text prepended to the subject line, e.g. [api]; auto uses the top-level directory of the changed files")
+	flagSet.StringVar(&cfg.scope, "scope", "", "Conventional commit scope to use instead of inferring it from the changed paths")
+	flagSet.BoolVar(&cfg.skipUnchanged, "skip-unchanged", cfg.skipUnchanged, "Print nothing and skip the API call when the diff is identical to the last one described")
+	flagSet.BoolVar(&cfg.force, "force", false, "Run even when -min-interval or -skip-unchanged would skip")
+	flagSet.DurationVar(&cfg.minInterval, "min-interval", cfg.minInterval, "Do nothing if the last successful run was less than this long ago (e.g. 30s)")
+	flagSet.BoolVar(&cfg.jsonOutput, "json", false, "Print the subject and body as JSON")
+	flagSet.BoolVar(&cfg.stream, "stream", cfg.stream, "Print the response as it is generated (openrouter, openai and ollama only)")
+	flagSet.StringVar(&cfg.subjectFile, "subject-file", "", "Write the subject line to this file")
+	flagSet.StringVar(&cfg.bodyFile, "body-file", "", "Write the message body to this file")
+	flagSet.BoolVar(&cfg.detectMoves, "detect-moves", cfg.detectMoves, "Describe a deleted file and an added file with identical content as a rename")
+	flagSet.StringVar(&cfg.renameHandling, "rename-handling", cfg.renameHandling, "How renames are described: content (rename plus content changes), note (rename only) or ignore")
+	flagSet.IntVar(&cfg.readConcurrency, "read-concurrency", cfg.readConcurrency, "Maximum number of staged files read at once (1 reads sequentially)")
+	flagSet.BoolVar(&cfg.skipBinaryCheck, "skip-binary-check", false, "Don't read staged files to detect binaries (faster for large all-text stages)")
+	flagSet.StringVar(&cfg.binaryFiles, "binary-files", cfg.binaryFiles, "How to handle binary files: note (one line with size and type) or skip")
+	flagSet.StringVar(&cfg.binarySummary, "binary-summary", cfg.binarySummary, "How much a binary file note says: name, name-size, mime (name, size and sniffed type) or skip to leave binary files out")
+	flagSet.Var((*stringList)(&cfg.ignoreDirs), "ignore-dir", "Extra directory name to skip (repeatable)")
+	var pathspecArgs []string
+	flagSet.Var((*stringList)(&pathspecArgs), "pathspec", "Only describe paths matching this git pathspec, e.g. ':(glob)**/*.go' or ':!docs' (repeatable)")
+	flagSet.BoolVar(&cfg.replaceIgnoreDirs, "replace-ignore-dirs", cfg.replaceIgnoreDirs, "Skip only the configured ignore dirs instead of adding them to the built-in list")
+	flagSet.Func("compare", "Comma-separated models to run the same diff through, printing each result with latency and token usage", func(value string) error {
+		for _, model := range strings.Split(value, ",") {
+			if model = strings.TrimSpace(model); model != "" {
+				cfg.compareModels = append(cfg.compareModels, model)
+			}
+		}
+		return nil
+	})
+	flagSet.BoolVar(&cfg.review, "review", false, "Also list potential issues noticed in the diff, printed after the message and left out of commits")
+	flagSet.BoolVar(&cfg.trailersFromAnalysis, "trailers-from-analysis", false, "Append Change-Type and Affected-Components git trailers classified by the model")
+	flagSet.BoolVar(&cfg.polish, "polish", cfg.polish, "Send the generated message through a second pass that fixes grammar and tightens it")
+	flagSet.StringVar(&cfg.polishModel, "polish-model", cfg.polishModel, "Model for the -polish pass (defaults to -model)")
+	flagSet.BoolVar(&cfg.interactive, "interactive", false, "Refine the message with follow-up instructions read from stdin")
+	flagSet.StringVar(&cfg.postCommit, "post-commit", cfg.postCommit, "Shell command to run after -commit, e.g. \"git push\"")
+	flagSet.BoolVar(&cfg.gerritChangeID, "gerrit-change-id", cfg.gerritChangeID, "Add a Gerrit Change-Id trailer to the -commit commit unless the message has one")
+	flagSet.BoolVar(&cfg.rollbackOnFailure, "rollback-on-failure", cfg.rollbackOnFailure, "Undo the commit, keeping the changes staged, when the -post-commit command fails")
+	flagSet.BoolVar(&cfg.recordStats, "record-stats", cfg.recordStats, "Record per-repo usage stats locally (see -stats)")
+	flagSet.BoolVar(&cfg.showStats, "stats", false, "Print the recorded per-repo usage stats and exit")
+	flagSet.BoolVar(&cfg.printConfig, "print-config", false, "Print the resolved settings and exit; with -verbose, show where each came from")
 	flagSet.BoolVar(&showhelp, "help", false, "Show help message")
 
 	flagSet.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: describe [options]\n\n")
-		fmt.Fprintf(os.Stderr, "Generate AI-powered descriptions of staged git changes.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: describe [options] [old-file new-file]\n\n")
+		fmt.Fprintf(os.Stderr, "Generate AI-powered descriptions of staged git changes.\n")
+		fmt.Fprintf(os.Stderr, "With two file arguments, explain the difference between them instead.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flagSet.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nConfig file: %s\n", configPath)
+		if len(layers) == 0 {
+			fmt.Fprintf(os.Stderr, "\nConfig file: %s\n", configPath)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\nConfig files (later ones override earlier ones):\n")
+		for _, layer := range layers {
+			fmt.Fprintf(os.Stderr, "  %s\n", layer.path)
+		}
 	}
 
 	err = flagSet.Parse(args)
@@ -324,6 +1974,10 @@ func getConfig(args []string) (config, bool, error) {
 				cfg.model = "llama3.2"
 			} else if cfg.provider == "openrouter" {
 				cfg.model = "anthropic/claude-4.5-sonnet"
+			} else if cfg.provider == "openai" {
+				cfg.model = "gpt-4o-mini"
+			} else if cfg.provider == "anthropic" {
+				cfg.model = "claude-3-5-sonnet-latest"
 			}
 		}
 		if endpointFlag == "" {
@@ -331,8 +1985,17 @@ func getConfig(args []string) (config, bool, error) {
 				cfg.apiEndpoint = "http://localhost:11434"
 			} else if cfg.provider == "openrouter" {
 				cfg.apiEndpoint = "https://openrouter.ai/api/v1"
+			} else if cfg.provider == "openai" {
+				cfg.apiEndpoint = "https://api.openai.com/v1"
+			} else if cfg.provider == "anthropic" {
+				cfg.apiEndpoint = "https://api.anthropic.com/v1"
+			} else if cfg.provider == "auto" {
+				cfg.apiEndpoint = ""
 			}
 		}
+		if modelFlag == "" && cfg.provider == "auto" {
+			cfg.model = ""
+		}
 	}
 	if modelFlag != "" {
 		cfg.model = modelFlag
@@ -340,66 +2003,528 @@ func getConfig(args []string) (config, bool, error) {
 	if endpointFlag != "" {
 		cfg.apiEndpoint = endpointFlag
 	}
+	if noBody {
+		cfg.bodyFormat = "none"
+	}
+	if noUnstagedWarning {
+		cfg.unstagedWarning = false
+	}
 
-	// check if there are any arguments left
-	if flagSet.NArg() > 0 {
-		return config{}, false, fmt.Errorf("unexpected arguments: %s", flagSet.Args())
+	// Two positional arguments compare files outside git; anything else is an error
+	switch flagSet.NArg() {
+	case 0:
+	case 2:
+		cfg.compareFiles = flagSet.Args()
+	default:
+		return config{}, false, fmt.Errorf("unexpected arguments: %s (expected none, or two files to compare)", flagSet.Args())
 	}
 
-	// Get API key from environment if not in config file (for OpenRouter)
-	if cfg.apiKey == "" {
+	// Get API key from environment if not in config file (for OpenRouter).
+	// OpenAI and Anthropic keys come from their own variable first, falling
+	// back to api_key.
+	if env, ok := providerKeyEnv[cfg.provider]; ok {
+		if key := os.Getenv(env); key != "" {
+			cfg.apiKey = key
+		}
+	} else if cfg.apiKey == "" {
 		cfg.apiKey = os.Getenv("OPENROUTER_API_KEY")
 	}
 
 	// Validate provider
-	if cfg.provider != "openrouter" && cfg.provider != "ollama" {
-		return config{}, false, fmt.Errorf("invalid provider: %s (must be 'openrouter' or 'ollama')", cfg.provider)
+	// Pick a provider from what is available on this machine; the model
+	// and endpoint then default for the chosen provider unless given
+	if cfg.provider == "auto" {
+		// A configured endpoint is where to look for Ollama
+		ollamaEndpoint := strings.TrimRight(cfg.apiEndpoint, "/")
+		if ollamaEndpoint == "" {
+			ollamaEndpoint = defaultOllamaEndpoint
+		}
+		cfg.provider, cfg.apiKey, err = detectProvider(ollamaEndpoint, cfg.apiKey)
+		if err != nil {
+			return config{}, false, err
+		}
+		debugLog("Auto-selected provider: %s", cfg.provider)
+		if cfg.provider == "ollama" {
+			cfg.apiEndpoint = ollamaEndpoint
+		} else if cfg.provider == "openrouter" {
+			cfg.apiEndpoint = "https://openrouter.ai/api/v1"
+		} else if cfg.provider == "openai" {
+			cfg.apiEndpoint = "https://api.openai.com/v1"
+		} else if cfg.provider == "anthropic" {
+			cfg.apiEndpoint = "https://api.anthropic.com/v1"
+		}
+		if cfg.model == "" {
+			if cfg.provider == "ollama" {
+				cfg.model = "llama3.2"
+			} else if cfg.provider == "openrouter" {
+				cfg.model = "anthropic/claude-4.5-sonnet"
+			} else if cfg.provider == "openai" {
+				cfg.model = "gpt-4o-mini"
+			} else if cfg.provider == "anthropic" {
+				cfg.model = "claude-3-5-sonnet-latest"
+			}
+		}
 	}
 
-	// Check API key for OpenRouter
-	if cfg.provider == "openrouter" && cfg.apiKey == "" {
-		return config{}, false, fmt.Errorf("OPENROUTER_API_KEY environment variable or api_key in config file required for OpenRouter provider")
+	// Paths are appended to the endpoint, so "http://host/v1/" would
+	// otherwise produce "//chat/completions"
+	cfg.apiEndpoint = strings.TrimRight(cfg.apiEndpoint, "/")
+
+	if _, ok := providers[cfg.provider]; !ok {
+		return config{}, false, fmt.Errorf("invalid provider: %s (must be one of %s or auto)", cfg.provider, strings.Join(providerNames(), ", "))
 	}
 
-	return cfg, false, nil
-}
+	// Model-specific prompts can only be resolved once the model is known,
+	// and take precedence over a preset. A -prompt-file beats both.
+	if cfg.promptFile != "" {
+		cfg.promptTemplate, err = loadPromptFile(cfg.promptFile)
+		if err != nil {
+			return config{}, false, err
+		}
+	} else if tmpl, ok := resolveModelPrompt(fileCfg.ModelPrompts, cfg.model); ok {
+		cfg.promptTemplate, err = template.New("prompt").Parse(tmpl)
+		if err != nil {
+			return config{}, false, fmt.Errorf("invalid prompt template for model %s: %w", cfg.model, err)
+		}
+	} else if preset != "" {
+		tmpl, ok := promptPresets[preset]
+		if !ok {
+			return config{}, false, fmt.Errorf("unknown preset: %s (available: %s)", preset, strings.Join(presetNames(), ", "))
+		}
+		cfg.promptTemplate = template.Must(template.New(preset).Parse(tmpl))
+	}
 
-func getStagedChanges(repo *git.Repository, cfg config) (string, error) {
-	debugLog("Getting worktree")
-	w, err := repo.Worktree()
-	if err != nil {
-		return "", fmt.Errorf("repo.Worktree: %w", err)
+	if cfg.output != "commit" && cfg.output != "pr" && cfg.output != "note" && cfg.output != "review-md" {
+		return config{}, false, fmt.Errorf("invalid output: %s (must be 'commit', 'pr', 'note' or 'review-md')", cfg.output)
+	}
+	if cfg.output == "review-md" && (cfg.interactive || cfg.stream || len(cfg.compareFiles) > 0 || cfg.commit || cfg.addNote != "" || cfg.messageFile != "") {
+		return config{}, false, fmt.Errorf("-output review-md cannot be combined with -interactive, -stream, file comparison, -commit, -add-note or -message-file")
 	}
 
-	debugLog("Getting status")
-	status, err := w.Status()
-	if err != nil {
-		return "", fmt.Errorf("worktree.Status: %w", err)
+	switch subjectFormat {
+	case "":
+	case "plain":
+		cfg.conventional = false
+	case "conventional":
+		cfg.conventional = true
+	default:
+		return config{}, false, fmt.Errorf("invalid subject-format: %s (must be 'plain' or 'conventional')", subjectFormat)
+	}
+	if _, ok := bodyFormats[cfg.bodyFormat]; !ok && cfg.bodyFormat != "" {
+		return config{}, false, fmt.Errorf("invalid body-format: %s (must be 'prose', 'bullets' or 'none')", cfg.bodyFormat)
 	}
 
-	// Try to get HEAD tree, handle case where there are no commits yet
-	debugLog("Getting HEAD")
-	head, err := repo.Head()
-	var headTree *object.Tree
-	if err == nil {
-		debugLog("HEAD found, getting commit")
-		headCommit, err := repo.CommitObject(head.Hash())
+	if cfg.renameHandling != "content" && cfg.renameHandling != "note" && cfg.renameHandling != "ignore" {
+		return config{}, false, fmt.Errorf("invalid rename_handling: %s (must be 'content', 'note' or 'ignore')", cfg.renameHandling)
+	}
+	if cfg.binaryFiles != "note" && cfg.binaryFiles != "skip" {
+		return config{}, false, fmt.Errorf("invalid binary_files: %s (must be 'note' or 'skip')", cfg.binaryFiles)
+	}
+	if cfg.codeowners != "off" && cfg.codeowners != "prompt" && cfg.codeowners != "scope" {
+		return config{}, false, fmt.Errorf("invalid codeowners: %s (must be 'off', 'prompt' or 'scope')", cfg.codeowners)
+	}
+	if !slices.Contains(diffFormats, cfg.diffFormat) {
+		return config{}, false, fmt.Errorf("invalid diff_format: %s (must be %s)", cfg.diffFormat, strings.Join(diffFormats, ", "))
+	}
+	if cfg.diffFormat != "unified" && (cfg.diffCommand != "" || cfg.interactiveHunks || cfg.dropWhitespaceHunks || cfg.maxHunksPerFile > 0 || cfg.blameContext || cfg.withStash != "") {
+		return config{}, false, fmt.Errorf("diff_format %s cannot be combined with diff_command, -interactive-hunks, -drop-whitespace-hunks, -max-hunks-per-file, blame_context or -with-stash, which work on unified hunks", cfg.diffFormat)
+	}
+	switch cfg.binarySummary {
+	case "name", "name-size", "mime":
+	case "skip":
+		cfg.binaryFiles = "skip"
+	default:
+		return config{}, false, fmt.Errorf("invalid binary_summary: %s (must be 'skip', 'name', 'name-size' or 'mime')", cfg.binarySummary)
+	}
+	for _, rule := range cfg.subjectStyle {
+		if !slices.Contains(subjectStyles, rule) {
+			return config{}, false, fmt.Errorf("invalid subject_style: %s (must be %s)", rule, strings.Join(subjectStyles, ", "))
+		}
+	}
+	if slices.Contains(cfg.subjectStyle, "capital") && slices.Contains(cfg.subjectStyle, "lowercase") {
+		return config{}, false, fmt.Errorf("subject_style cannot contain both 'capital' and 'lowercase'")
+	}
+	for _, pattern := range fileCfg.ResponseStripPatterns {
+		re, err := regexp.Compile(pattern)
 		if err != nil {
-			return "", fmt.Errorf("failed to get HEAD commit: %w", err)
+			return config{}, false, fmt.Errorf("invalid response_strip_patterns entry %q: %w", pattern, err)
 		}
-		headTree, err = headCommit.Tree()
+		cfg.responseStrip = append(cfg.responseStrip, re)
+	}
+
+	for _, arg := range pathspecArgs {
+		spec, err := parsePathspec(arg)
 		if err != nil {
-			return "", fmt.Errorf("failed to get HEAD tree: %w", err)
+			return config{}, false, err
 		}
-	} else {
+		cfg.pathspecs = append(cfg.pathspecs, spec)
+	}
+
+	if cfg.sinceLast && (len(cfg.compareFiles) > 0 || cfg.diffFile != "" || cfg.addNote != "" || cfg.interactiveHunks) {
+		return config{}, false, fmt.Errorf("-since-last only works with staged changes and cannot be combined with -interactive-hunks")
+	}
+	if cfg.diffFile != "" && (len(cfg.compareFiles) > 0 || cfg.commit || cfg.addNote != "") {
+		return config{}, false, fmt.Errorf("-diff-file cannot be combined with file comparison, -commit or -add-note")
+	}
+
+	if cfg.against != "" && (len(cfg.compareFiles) > 0 || cfg.diffFile != "" || cfg.addNote != "" || cfg.commit || cfg.sinceLast) {
+		return config{}, false, fmt.Errorf("-against cannot be combined with file comparison, -diff-file, -add-note, -commit or -since-last")
+	}
+	if cfg.rebase && (len(cfg.compareFiles) > 0 || cfg.diffFile != "" || cfg.addNote != "" || cfg.against != "" || cfg.withStash != "" || cfg.commit || cfg.sinceLast) {
+		return config{}, false, fmt.Errorf("-rebase cannot be combined with file comparison, -diff-file, -add-note, -against, -with-stash, -commit (use git commit --amend) or -since-last")
+	}
+	if cfg.withStash != "" && (len(cfg.compareFiles) > 0 || cfg.diffFile != "" || cfg.addNote != "" || cfg.against != "" || cfg.commit || cfg.sinceLast) {
+		return config{}, false, fmt.Errorf("-with-stash only works with staged changes and cannot be combined with -commit, which would leave the stash out, -against or -since-last")
+	}
+	if cfg.addNote != "" && (len(cfg.compareFiles) > 0 || cfg.commit || cfg.interactiveHunks) {
+		return config{}, false, fmt.Errorf("-add-note describes an existing commit and cannot be combined with file comparison, -commit or -interactive-hunks")
+	}
+
+	if cfg.commit && (len(cfg.compareFiles) > 0 || cfg.output != "commit") {
+		return config{}, false, fmt.Errorf("-commit only works with staged changes and commit output")
+	}
+	if len(cfg.compareModels) > 0 && (cfg.commit || cfg.interactive || cfg.addNote != "" || cfg.jsonOutput) {
+		return config{}, false, fmt.Errorf("-compare only prints results and cannot be combined with -commit, -interactive, -add-note or -json")
+	}
+	if cfg.jsonOutput && cfg.interactive {
+		return config{}, false, fmt.Errorf("-json cannot be combined with -interactive")
+	}
+	if cfg.commit && cfg.interactiveHunks {
+		return config{}, false, fmt.Errorf("-commit cannot be combined with -interactive-hunks, which only describes a subset of the staged changes")
+	}
+	if cfg.selectFiles && (len(cfg.compareFiles) > 0 || cfg.diffFile != "" || cfg.addNote != "" || cfg.commit || cfg.sinceLast) {
+		return config{}, false, fmt.Errorf("-select only works with staged changes and cannot be combined with -commit, which would commit the files left out, or -since-last")
+	}
+	if !cfg.commit {
+		// Config file values only apply to -commit runs; the flags are a mistake without it
+		var commitOnly bool
+		flagSet.Visit(func(f *flag.Flag) {
+			commitOnly = commitOnly || f.Name == "post-commit" || f.Name == "rollback-on-failure"
+		})
+		if commitOnly {
+			return config{}, false, fmt.Errorf("-post-commit and -rollback-on-failure require -commit")
+		}
+		cfg.postCommit, cfg.rollbackOnFailure = "", false
+	}
+	if cfg.messagePlacement != "replace" && cfg.messagePlacement != "top" && cfg.messagePlacement != "bottom" {
+		return config{}, false, fmt.Errorf("invalid message-placement: %s (must be 'replace', 'top' or 'bottom')", cfg.messagePlacement)
+	}
+	if cfg.messagePlacement != "replace" && cfg.messageFile == "" {
+		return config{}, false, fmt.Errorf("-message-placement requires -message-file")
+	}
+	// Streamed text is printed as is, so nothing may rewrite it afterwards
+	if cfg.stream && cfg.provider != "openrouter" && cfg.provider != "openai" && cfg.provider != "ollama" {
+		return config{}, false, fmt.Errorf("-stream is only supported with the openrouter, openai and ollama providers")
+	}
+	if cfg.trailersFromAnalysis && (cfg.output != "commit" || len(cfg.compareFiles) > 0 || len(cfg.compareModels) > 0 || cfg.interactive) {
+		return config{}, false, fmt.Errorf("-trailers-from-analysis only works with commit output and cannot be combined with file comparison, -compare or -interactive")
+	}
+	if cfg.stream && (cfg.jsonOutput || cfg.polish || cfg.review || cfg.trailersFromAnalysis || len(cfg.compareModels) > 0 || cfg.subjectPrefix != "" || len(cfg.subjectStyle) > 0 || len(cfg.responseStrip) > 0 || cfg.cleanMarkdown || cfg.bodyFormat == "none" || cfg.output == "pr") {
+		return config{}, false, fmt.Errorf("-stream cannot be combined with -json, -polish, -review, -trailers-from-analysis, -compare, -output pr, -no-body, subject_prefix, subject_style, response_strip_patterns or clean_markdown")
+	}
+	if cfg.author != "" {
+		if !cfg.commit {
+			return config{}, false, fmt.Errorf("-author requires -commit")
+		}
+		if _, err := parseAuthor(cfg.author); err != nil {
+			return config{}, false, err
+		}
+	}
+
+	if cfg.printConfig {
+		fileKeys, err := configFileKeys()
+		if err != nil {
+			return config{}, false, err
+		}
+		setFlags := make(map[string]bool)
+		flagSet.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+		cfg.settings = resolveSettings(cfg, preset, fileCfg.ModelPrompts, fileKeys, setFlags)
+		// Show the settings even when they are incomplete
+		return cfg, false, nil
+	}
+
+	// Check API key for OpenRouter
+	if cfg.provider == "openrouter" && cfg.apiKey == "" {
+		return config{}, false, fmt.Errorf("OPENROUTER_API_KEY environment variable or api_key in config file required for OpenRouter provider")
+	}
+	if env, ok := providerKeyEnv[cfg.provider]; ok && cfg.apiKey == "" {
+		return config{}, false, fmt.Errorf("%s environment variable or api_key in config file required for %s provider", env, cfg.provider)
+	}
+
+	return cfg, false, nil
+}
+
+// setting is one resolved option reported by -print-config
+type setting struct {
+	key    string // config file key
+	value  string
+	source string // "default", "file", "env" or "flag"
+}
+
+// settingFlags names the flag overriding each config file key where it
+// differs from the key with dashes for underscores
+var settingFlags = map[string]string{
+	"api_endpoint": "endpoint",
+	"api_key":      "",
+	"ignore_dirs":  "ignore-dir",
+}
+
+// configFileKeys returns the top-level keys set in any config file
+func configFileKeys() (map[string]bool, error) {
+	keys := make(map[string]bool)
+	layers, err := configLayers()
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := trustedRepos(layers)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		data, _, err := readConfigLayer(layer, trusted)
+		if err != nil {
+			return nil, err
+		}
+		var raw map[string]any
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", layer.path, err)
+		}
+		for key := range raw {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
+// resolveSettings lists the resolved value of every config file setting
+// and where it came from: a flag, the environment, the config file or the
+// built-in default
+func resolveSettings(cfg config, preset string, modelPrompts map[string]string, fileKeys, setFlags map[string]bool) []setting {
+	apiKey := ""
+	if cfg.apiKey != "" {
+		apiKey = "(set)"
+	}
+	temperature := ""
+	if cfg.temperature != nil {
+		temperature = strconv.FormatFloat(*cfg.temperature, 'g', -1, 64)
+	}
+	var stripPatterns []string
+	for _, re := range cfg.responseStrip {
+		stripPatterns = append(stripPatterns, re.String())
+	}
+	var promptModels []string
+	for model := range modelPrompts {
+		promptModels = append(promptModels, model)
+	}
+	sort.Strings(promptModels)
+
+	values := [][2]string{
+		{"provider", cfg.provider},
+		{"model", cfg.model},
+		{"api_endpoint", cfg.apiEndpoint},
+		{"api_key", apiKey},
+		{"debug", strconv.FormatBool(cfg.debug)},
+		{"verbose", strconv.FormatBool(cfg.verbose)},
+		{"output", cfg.output},
+		{"max_lines", strconv.Itoa(cfg.maxLines)},
+		{"max_files", strconv.Itoa(cfg.maxFiles)},
+		{"summary_head_lines", strconv.Itoa(cfg.summaryHeadLines)},
+		{"author_context", strconv.FormatBool(cfg.authorContext)},
+		{"use_git_template", strconv.FormatBool(cfg.useGitTemplate)},
+		{"blame_context", strconv.FormatBool(cfg.blameContext)},
+		{"focus_hint", strconv.FormatBool(cfg.focusHint)},
+		{"codeowners", cfg.codeowners},
+		{"prompt_prefix", cfg.promptPrefix},
+		{"prompt_suffix", cfg.promptSuffix},
+		{"preset", preset},
+		{"model_prompts", strings.Join(promptModels, ", ")},
+		{"temperature", temperature},
+		{"max_tokens", strconv.Itoa(cfg.maxTokens)},
+		{"reasoning_model_prefixes", strings.Join(cfg.reasoningModelPrefixes, ", ")},
+		{"retry_empty", strconv.Itoa(cfg.retryEmpty)},
+		{"subject_reminder_lines", strconv.Itoa(cfg.subjectReminderLines)},
+		{"subject_style", strings.Join(cfg.subjectStyle, ",")},
+		{"clean_markdown", strconv.FormatBool(cfg.cleanMarkdown)},
+		{"unstaged_warning", strconv.FormatBool(cfg.unstagedWarning)},
+		{"timeout", cfg.timeout.String()},
+		{"deadline", cfg.deadline.String()},
+		{"force_http1", strconv.FormatBool(cfg.forceHTTP1)},
+		{"stale_after", cfg.staleAfter.String()},
+		{"min_interval", cfg.minInterval.String()},
+		{"skip_unchanged", strconv.FormatBool(cfg.skipUnchanged)},
+		{"conventional", strconv.FormatBool(cfg.conventional)},
+		{"body_format", cfg.bodyFormat},
+		{"subject_prefix", cfg.subjectPrefix},
+		{"ignore_dirs", strings.Join(cfg.ignoreDirs, ", ")},
+		{"replace_ignore_dirs", strconv.FormatBool(cfg.replaceIgnoreDirs)},
+		{"large_context_model", cfg.largeContextModel},
+		{"context_window", strconv.Itoa(cfg.contextWindow)},
+		{"binary_files", cfg.binaryFiles},
+		{"binary_summary", cfg.binarySummary},
+		{"rename_handling", cfg.renameHandling},
+		{"detect_moves", strconv.FormatBool(cfg.detectMoves)},
+		{"polish", strconv.FormatBool(cfg.polish)},
+		{"polish_model", cfg.polishModel},
+		{"read_concurrency", strconv.Itoa(cfg.readConcurrency)},
+		{"diff_command", cfg.diffCommand},
+		{"diff_format", cfg.diffFormat},
+		{"context_command", cfg.contextCommand},
+		{"context_command_timeout", cfg.contextCommandTimeout.String()},
+		{"record_stats", strconv.FormatBool(cfg.recordStats)},
+		{"post_commit", cfg.postCommit},
+		{"rollback_on_failure", strconv.FormatBool(cfg.rollbackOnFailure)},
+		{"gerrit_change_id", strconv.FormatBool(cfg.gerritChangeID)},
+		{"response_strip_patterns", strings.Join(stripPatterns, ", ")},
+		{"min_subject_length", strconv.Itoa(cfg.minSubjectLength)},
+		{"require_body", strconv.FormatBool(cfg.requireBody)},
+		{"reject_echo", strconv.FormatBool(cfg.rejectEcho)},
+		{"stream", strconv.FormatBool(cfg.stream)},
+	}
+
+	settings := make([]setting, 0, len(values))
+	for _, v := range values {
+		key := v[0]
+		flagName, ok := settingFlags[key]
+		if !ok {
+			flagName = strings.ReplaceAll(key, "_", "-")
+		}
+		source := "default"
+		switch {
+		case flagName != "" && setFlags[flagName]:
+			source = "flag"
+		case key == "api_key" && cfg.apiKey != "" && (!fileKeys[key] || os.Getenv(providerKeyEnv[cfg.provider]) != ""):
+			source = "env"
+		case fileKeys[key]:
+			source = "file"
+		}
+		settings = append(settings, setting{key: key, value: v[1], source: source})
+	}
+	return settings
+}
+
+// printSettings writes settings as "key: value", with the source of each
+// value in a column between the two when verbose
+func printSettings(w io.Writer, settings []setting, verbose bool) {
+	width := 0
+	for _, s := range settings {
+		width = max(width, len(s.key)+1)
+	}
+	for _, s := range settings {
+		value := s.value
+		if strings.Contains(value, "\n") {
+			value = strconv.Quote(value)
+		}
+		if verbose {
+			fmt.Fprintf(w, "%-*s %-9s %s\n", width, s.key+":", "("+s.source+")", value)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", s.key, value)
+		}
+	}
+}
+
+// readDiffFile reads a pre-generated unified diff from path, or from stdin
+// when path is "-", and lists the files it touches
+func readDiffFile(path string, maxLines int) (string, []stagedFile, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	changes := string(data)
+	if strings.TrimSpace(changes) == "" {
+		return "", nil, nil
+	}
+	if lineCount := strings.Count(changes, "\n"); maxLines > 0 && lineCount > maxLines {
+		return "", nil, fmt.Errorf("diff exceeds maximum line limit of %d (currently at %d lines). Use the -max-lines flag to increase the limit", maxLines, lineCount)
+	}
+
+	var files []stagedFile
+	for _, f := range parsePatch(changes) {
+		added, removed := countDiffLines(strings.Join(f.hunks, ""))
+		status := git.Modified
+		switch {
+		case strings.Contains(f.header, "\nnew file mode"):
+			status = git.Added
+		case strings.Contains(f.header, "\ndeleted file mode"):
+			status = git.Deleted
+		}
+		files = append(files, stagedFile{path: f.path, status: status, added: added, removed: removed})
+	}
+	return changes, files, nil
+}
+
+// stagedFile is a file included in the staged changes
+type stagedFile struct {
+	path    string
+	status  git.StatusCode
+	added   int           // lines added
+	removed int           // lines removed
+	hash    plumbing.Hash // blob of the new content, zero for deleted files
+}
+
+// stagedChanges holds the assembled patch and the files it covers
+type stagedChanges struct {
+	patch string
+	files []stagedFile
+	note  string // caveat for the model about how the changes were found
+	// unstaged lists files with worktree changes the patch leaves out
+	unstaged []string
+	// truncated is set when the patch was cut or reduced to a file summary
+	truncated bool
+}
+
+func getStagedChanges(ctx context.Context, repo *git.Repository, cfg config) (stagedChanges, error) {
+	debugLog("Getting worktree")
+	w, err := repo.Worktree()
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("repo.Worktree: %w", err)
+	}
+
+	debugLog("Getting status")
+	status, err := w.Status()
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("worktree.Status: %w", err)
+	}
+
+	// Try to get HEAD tree, handle case where there are no commits yet
+	debugLog("Getting HEAD")
+	head, err := repo.Head()
+	var headTree *object.Tree
+	newRepo := false
+	if err == nil {
+		debugLog("HEAD found, getting commit")
+		headCommit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			return stagedChanges{}, fmt.Errorf("failed to get HEAD commit: %w", err)
+		}
+		headTree, err = headCommit.Tree()
+		if err != nil {
+			return stagedChanges{}, fmt.Errorf("failed to get HEAD tree: %w", err)
+		}
+	} else {
 		debugLog("No HEAD found (new repository)")
 		// For new repository, use empty tree
 		headTree = &object.Tree{}
+		newRepo = true
 	}
 
-	// Filter out binary files and ignored paths before generating diff
-	var filesToInclude []string
-	stagedFileCount := 0
+	// Filter out ignored paths and unstaged files before generating diff
+	skipDirs := cfg.skippedDirs()
+	var candidates, toCheck, unstaged []string
+	for path, fileStatus := range status {
+		if shouldIgnorePath(path, skipDirs) || !matchPathspecs(path, cfg.pathspecs) {
+			continue
+		}
+		if fileStatus.Worktree != git.Unmodified && fileStatus.Worktree != git.Untracked {
+			unstaged = append(unstaged, path)
+		}
+	}
+	sort.Strings(unstaged)
 	for path, fileStatus := range status {
 		// Only process files that are actually staged
 		if fileStatus.Staging == git.Unmodified || fileStatus.Staging == git.Untracked {
@@ -407,36 +2532,52 @@ func getStagedChanges(repo *git.Repository, cfg config) (string, error) {
 		}
 
 		// Skip ignored directories
-		if shouldIgnorePath(path) {
+		if shouldIgnorePath(path, skipDirs) {
 			debugLog("Skipping ignored path: %s", path)
 			continue
 		}
+		if !matchPathspecs(path, cfg.pathspecs) {
+			debugLog("Skipping path outside the pathspec: %s", path)
+			continue
+		}
 
-		// Skip binary files (unless deleted)
-		if fileStatus.Staging != git.Deleted {
-			binary, err := isBinary(path)
-			if err != nil {
-				debugLog("Error checking if file is binary: %s: %v", path, err)
-			} else if binary {
-				debugLog("Skipping binary file: %s", path)
-				continue
-			}
+		candidates = append(candidates, path)
+		// Deleted files have nothing on disk to classify
+		if fileStatus.Staging != git.Deleted && !cfg.skipBinaryCheck {
+			toCheck = append(toCheck, path)
 		}
+	}
 
-		stagedFileCount++
-		debugLog("Processing staged file: %s (status: %s)", path, stagingStatusString(fileStatus.Staging))
+	// Skip binary files, or remember them so they can be noted without
+	// their content
+	binaryPaths := detectBinaries(ctx, w.Filesystem, toCheck, cfg.readConcurrency)
+	if err := ctx.Err(); err != nil {
+		return stagedChanges{}, err
+	}
+	var filesToInclude []string
+	for _, path := range candidates {
+		if binaryPaths[path] && cfg.binaryFiles != "note" {
+			debugLog("Skipping binary file: %s", path)
+			continue
+		} else if binaryPaths[path] {
+			debugLog("Noting binary file: %s", path)
+		}
+		debugLog("Processing staged file: %s (status: %s)", path, stagingStatusString(status[path].Staging))
 		filesToInclude = append(filesToInclude, path)
 	}
 
-	if stagedFileCount == 0 {
-		return "", nil
+	if len(filesToInclude) == 0 {
+		return stagedChanges{}, nil
 	}
 
+	// Status is a map, so sort for a stable, git-like file order
+	sort.Strings(filesToInclude)
+
 	// Get the index to access staged file hashes
 	debugLog("Getting index")
 	idx, err := repo.Storer.Index()
 	if err != nil {
-		return "", fmt.Errorf("failed to get index: %w", err)
+		return stagedChanges{}, fmt.Errorf("failed to get index: %w", err)
 	}
 
 	// Create a map of paths to hashes from the index
@@ -445,236 +2586,4107 @@ func getStagedChanges(repo *git.Repository, cfg config) (string, error) {
 		indexMap[entry.Name] = entry.Hash
 	}
 
-	// Manually generate diffs by fetching blob contents
+	// Collect the HEAD and staged content of each file
+	var fileChanges []fileChange
+	for _, path := range filesToInclude {
+		// Reading blobs is the slow part of a large stage, so give up
+		// between files once the run is interrupted
+		if err := ctx.Err(); err != nil {
+			return stagedChanges{}, err
+		}
+		fileStatus := status[path]
+		change := fileChange{path: path, status: fileStatus.Staging, binary: binaryPaths[path]}
+
+		// Without a HEAD commit everything in the index is new, whatever
+		// status the worktree reports, and there is nothing to delete
+		if newRepo {
+			if change.status == git.Deleted {
+				debugLog("Skipping deleted file in new repository: %s", path)
+				continue
+			}
+			change.status = git.Added
+		}
+
+		// Get HEAD content
+		if change.status != git.Added && headTree != nil {
+			headFile, err := headTree.File(path)
+			if err == nil {
+				change.oldContent, _ = headFile.Contents()
+				change.oldHash = headFile.Hash
+			}
+		}
+
+		// Get staged content from index
+		if fileStatus.Staging != git.Deleted {
+			if hash, ok := indexMap[path]; ok {
+				change.newHash = hash
+				change.newContent, _ = blobContent(repo, hash)
+			}
+		}
+
+		// -since-last compares against what the previous run described
+		// instead of HEAD
+		if base, ok := cfg.baseline[path]; ok {
+			switch {
+			case base.IsZero() && change.status == git.Deleted:
+				debugLog("Deletion already described: %s", path)
+				continue
+			case base.IsZero():
+				change.status = git.Added
+				change.oldContent, change.oldHash = "", plumbing.ZeroHash
+			default:
+				content, err := blobContent(repo, base)
+				if err != nil {
+					debugLog("Previously described blob for %s unavailable, comparing with HEAD: %v", path, err)
+					break
+				}
+				change.oldContent, change.oldHash = content, base
+				if change.status == git.Added {
+					change.status = git.Modified
+				}
+			}
+		}
+		fileChanges = append(fileChanges, change)
+	}
+
+	changes, err := assembleChanges(ctx, cfg, fileChanges)
+	changes.unstaged = unstaged
+	return changes, err
+}
+
+// detectBinaries classifies paths in the worktree filesystem fs, with at
+// most concurrency files being read at once, and returns the paths that
+// are binary. No new reads are started once ctx is done.
+func detectBinaries(ctx context.Context, fs billy.Filesystem, paths []string, concurrency int) map[string]bool {
+	binaries := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	for _, path := range paths {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			binary, err := isBinaryFile(fs, path)
+			if err != nil {
+				debugLog("Error checking if file is binary: %s: %v", path, err)
+				return
+			}
+			if binary {
+				mu.Lock()
+				binaries[path] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return binaries
+}
+
+// fileLines is a file's share of the lines in a patch
+type fileLines struct {
+	path  string
+	lines int
+}
+
+// lineLimitError explains an exceeded max_lines by listing the files in the
+// patch by size, largest first, and optionally suggesting how to split them
+func lineLimitError(patch string, lineCount, maxLines int, suggest bool) error {
+	var files []fileLines
+	for _, f := range parsePatch(patch) {
+		files = append(files, fileLines{path: f.path, lines: strings.Count(f.String(), "\n")})
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].lines > files[j].lines })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "staged changes exceed maximum line limit of %d (currently at %d lines). Consider staging fewer files or using -max-lines flag to increase the limit", maxLines, lineCount)
+	if len(files) > 0 {
+		b.WriteString("\n\nLines per file:\n")
+		for _, f := range files {
+			fmt.Fprintf(&b, "  %6d  %s\n", f.lines, f.path)
+		}
+	}
+	if suggest && len(files) > 0 {
+		b.WriteString("\nSuggested split:\n")
+		for i, group := range suggestSplit(files, maxLines) {
+			total := 0
+			var paths []string
+			for _, f := range group {
+				total += f.lines
+				paths = append(paths, f.path)
+			}
+			note := ""
+			if total > maxLines {
+				note = ", over the limit on its own"
+			}
+			fmt.Fprintf(&b, "  %d. git add %s (%d lines%s)\n", i+1, strings.Join(paths, " "), total, note)
+		}
+	}
+	return errors.New(strings.TrimSuffix(b.String(), "\n"))
+}
+
+// truncatePatch cuts patch after maxLines lines, ending it with a
+// truncation marker that names the files left out entirely, and warns that
+// the description will be based on part of the diff. It reports whether
+// anything was cut.
+func truncatePatch(patch string, maxLines int) (string, bool) {
+	lines := strings.SplitAfter(patch, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if maxLines <= 0 || len(lines) <= maxLines {
+		return patch, false
+	}
+	fmt.Fprintf(os.Stderr, "Warning: the diff has %d lines, describing only the first %d (max_lines)\n", len(lines), maxLines)
+	kept := strings.Join(lines[:maxLines], "")
+	shown := make(map[string]bool)
+	for _, f := range parsePatch(kept) {
+		shown[f.path] = true
+	}
+	var omitted []string
+	for _, f := range parsePatch(patch) {
+		if !shown[f.path] {
+			omitted = append(omitted, f.path)
+		}
+	}
+	detail := "max_lines"
+	if len(omitted) > 0 {
+		detail += ", not shown: " + strings.Join(omitted, ", ")
+	}
+	if !strings.HasSuffix(kept, "\n") {
+		kept += "\n"
+	}
+	return kept + truncationMarker(len(lines)-maxLines, detail) + "\n", true
+}
+
+// suggestSplit groups files into commits of at most maxLines lines each,
+// keeping files from the same top-level directory together where possible.
+// A file larger than maxLines gets a group of its own.
+func suggestSplit(files []fileLines, maxLines int) [][]fileLines {
+	var dirs []string
+	byDir := make(map[string][]fileLines)
+	for _, f := range files {
+		dir, _, found := strings.Cut(f.path, "/")
+		if !found {
+			dir = ""
+		}
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], f)
+	}
+
+	var groups [][]fileLines
+	for _, dir := range dirs {
+		var current []fileLines
+		size := 0
+		for _, f := range byDir[dir] {
+			if len(current) > 0 && size+f.lines > maxLines {
+				groups = append(groups, current)
+				current, size = nil, 0
+			}
+			current = append(current, f)
+			size += f.lines
+		}
+		if len(current) > 0 {
+			groups = append(groups, current)
+		}
+	}
+	return groups
+}
+
+// blobContent reads the blob with the given hash
+func blobContent(repo *git.Repository, hash plumbing.Hash) (string, error) {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return "", err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	return string(content), err
+}
+
+// diffCommandTimeout limits each run of diff_command
+const diffCommandTimeout = 30 * time.Second
+
+// externalDiff runs command through sh, like context_command, with the old
+// and new versions of path written to temporary files appended as
+// arguments. The file name is kept so tools can detect the language. It
+// returns the command's output; exit status 1 means "files differ" for most
+// diff tools and is not treated as an error.
+func externalDiff(ctx context.Context, command, path, oldContent, newContent string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", errors.New("empty diff command")
+	}
+	dir, err := os.MkdirTemp("", "describe-diff-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	var files []string
+	for _, version := range []struct{ name, content string }{{"old", oldContent}, {"new", newContent}} {
+		file := filepath.Join(dir, version.name, filepath.Base(path))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(file, []byte(version.content), 0o644); err != nil {
+			return "", err
+		}
+		files = append(files, file)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, diffCommandTimeout)
+	defer cancel()
+	// "$@" passes the file names on without the shell splitting them
+	cmd := exec.CommandContext(ctx, "sh", append([]string{"-c", command + ` "$@"`, "sh"}, files...)...)
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", diffCommandTimeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return "", err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return "", errors.New("no output")
+	}
+	result := string(out)
+	if !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result, nil
+}
+
+// fileChange is the old and new content of one changed file
+type fileChange struct {
+	path       string
+	oldPath    string // previous path of a renamed file
+	status     git.StatusCode
+	oldContent string
+	newContent string
+	oldHash    plumbing.Hash
+	newHash    plumbing.Hash
+	binary     bool // noted by size and type instead of diffed
+}
+
+// pairMoves turns a deleted file and an added file with identical content
+// into a single rename, catching moves git's rename detection did not record.
+// Empty files are left alone since any two of them would match.
+func pairMoves(fileChanges []fileChange) []fileChange {
+	deleted := make(map[plumbing.Hash][]int)
+	for i, change := range fileChanges {
+		if change.status == git.Deleted && !change.oldHash.IsZero() && change.oldContent != "" {
+			deleted[change.oldHash] = append(deleted[change.oldHash], i)
+		}
+	}
+	if len(deleted) == 0 {
+		return fileChanges
+	}
+
+	// Identical deletions pair with additions in path order
+	source := make(map[int]int) // added index -> deleted index
+	moved := make(map[int]bool)
+	for i, change := range fileChanges {
+		candidates := deleted[change.newHash]
+		if change.status != git.Added || len(candidates) == 0 {
+			continue
+		}
+		source[i] = candidates[0]
+		moved[candidates[0]] = true
+		deleted[change.newHash] = candidates[1:]
+	}
+	if len(source) == 0 {
+		return fileChanges
+	}
+
+	var result []fileChange
+	for i, change := range fileChanges {
+		if moved[i] {
+			continue
+		}
+		if j, ok := source[i]; ok {
+			from := fileChanges[j]
+			debugLog("Pairing %s -> %s as a move", from.path, change.path)
+			change.status = git.Renamed
+			change.oldPath = from.path
+			change.oldContent = from.oldContent
+			change.oldHash = from.oldHash
+		}
+		result = append(result, change)
+	}
+	return result
+}
+
+// assembleChanges diffs each file and builds the patch, or a one-line
+// summary per file when there are more files than max_files
+func assembleChanges(ctx context.Context, cfg config, fileChanges []fileChange) (stagedChanges, error) {
+	if cfg.detectMoves {
+		fileChanges = pairMoves(fileChanges)
+	}
+
+	// Manually generate diffs from the collected contents
 	debugLog("Generating diffs for staged files")
 	var patchBuf strings.Builder
 
-	for _, path := range filesToInclude {
-		fileStatus := status[path]
+	// Too many files make per-file diffs overwhelming, so fall back to a
+	// list of names, statuses and line counts
+	summaryMode := cfg.maxFiles > 0 && len(fileChanges) > cfg.maxFiles
+	if summaryMode {
+		debugLog("%d staged files exceed max_files (%d), summarizing", len(fileChanges), cfg.maxFiles)
+		patchBuf.WriteString(fmt.Sprintf("%d files changed (summary only, full diffs omitted):\n", len(fileChanges)))
+	}
+
+	var included []stagedFile
+	for _, change := range fileChanges {
+		if err := ctx.Err(); err != nil {
+			return stagedChanges{}, err
+		}
+		path := change.path
+
+		if change.status == git.Renamed && cfg.renameHandling == "ignore" {
+			debugLog("Ignoring rename: %s -> %s", change.oldPath, path)
+			continue
+		}
+
+		if change.binary {
+			included = append(included, stagedFile{path: path, status: change.status, hash: change.newHash})
+			if !summaryMode {
+				patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
+			}
+			patchBuf.WriteString(binaryNote(change, cfg.binarySummary))
+			continue
+		}
+
+		// Generate unified diff content
+		diffContent := generateUnifiedDiffContent(change.oldContent, change.newContent)
+		if cfg.debugDiff {
+			analysis := analyzeDiff(splitLines(change.oldContent), splitLines(change.newContent))
+			fmt.Fprintf(os.Stderr, "[DIFF] %s (%s)\n", path, stagingStatusString(change.status))
+			for _, line := range strings.Split(strings.TrimSuffix(analysis.String(), "\n"), "\n") {
+				fmt.Fprintf(os.Stderr, "[DIFF]   %s\n", line)
+			}
+		}
+
+		// A modified file whose staged content matches HEAD (e.g. a mode
+		// change, or an edit that was staged and then reverted) has nothing
+		// to show, so leave it out rather than emit a header with no hunks
+		if diffContent == "" && change.status == git.Modified {
+			debugLog("Skipping staged file with no content changes: %s", path)
+			continue
+		}
+		added, removed := countDiffLines(diffContent)
+		if change.status == git.Renamed && cfg.renameHandling == "note" {
+			added, removed = 0, 0
+		}
+		included = append(included, stagedFile{path: path, status: change.status, added: added, removed: removed, hash: change.newHash})
+
+		if summaryMode && change.status == git.Renamed {
+			patchBuf.WriteString(fmt.Sprintf("Renamed %s -> %s (+%d -%d)\n", change.oldPath, path, added, removed))
+			continue
+		}
+		if summaryMode {
+			patchBuf.WriteString(fmt.Sprintf("%s %s (+%d -%d)\n", stagingStatusString(change.status), path, added, removed))
+			if change.status == git.Added {
+				patchBuf.WriteString(fileHead(change.newContent, cfg.summaryHeadLines))
+			}
+			continue
+		}
+
+		// Generate diff header
+		if change.status == git.Renamed {
+			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", change.oldPath, path))
+			patchBuf.WriteString(fmt.Sprintf("rename from %s\n", change.oldPath))
+			patchBuf.WriteString(fmt.Sprintf("rename to %s\n", path))
+			if cfg.renameHandling == "note" || diffContent == "" {
+				continue
+			}
+			patchBuf.WriteString(fmt.Sprintf("index %s..%s 100644\n", change.oldHash.String()[:7], change.newHash.String()[:7]))
+			patchBuf.WriteString(fmt.Sprintf("--- a/%s\n", change.oldPath))
+			patchBuf.WriteString(fmt.Sprintf("+++ b/%s\n", path))
+		} else if change.status == git.Added {
+			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
+			patchBuf.WriteString("new file mode 100644\n")
+			patchBuf.WriteString(fmt.Sprintf("index 0000000..%s\n", change.newHash.String()[:7]))
+			patchBuf.WriteString("--- /dev/null\n")
+			patchBuf.WriteString(fmt.Sprintf("+++ b/%s\n", path))
+		} else if change.status == git.Deleted {
+			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
+			patchBuf.WriteString("deleted file mode 100644\n")
+			patchBuf.WriteString(fmt.Sprintf("index %s..0000000\n", change.oldHash.String()[:7]))
+			patchBuf.WriteString(fmt.Sprintf("--- a/%s\n", path))
+			patchBuf.WriteString("+++ /dev/null\n")
+		} else {
+			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
+			patchBuf.WriteString(fmt.Sprintf("index %s..%s 100644\n", change.oldHash.String()[:7], change.newHash.String()[:7]))
+			patchBuf.WriteString(fmt.Sprintf("--- a/%s\n", path))
+			patchBuf.WriteString(fmt.Sprintf("+++ b/%s\n", path))
+		}
+		if cfg.diffCommand != "" {
+			external, err := externalDiff(ctx, cfg.diffCommand, path, change.oldContent, change.newContent)
+			if err != nil {
+				debugLog("diff_command failed for %s, using built-in diff: %v", path, err)
+			} else {
+				diffContent = external
+			}
+		}
+		patchBuf.WriteString(renderDiff(diffContent, cfg.diffFormat))
+	}
+
+	if len(included) == 0 {
+		return stagedChanges{}, nil
+	}
+
+	patchStr := patchBuf.String()
+	lineCount := strings.Count(patchStr, "\n")
+	truncated := summaryMode
+
+	// Check if we've exceeded the limit
+	if cfg.maxLines > 0 && lineCount > cfg.maxLines {
+		if !cfg.truncateOnLimit {
+			return stagedChanges{}, lineLimitError(patchStr, lineCount, cfg.maxLines, cfg.suggestSplit)
+		}
+		patchStr, truncated = truncatePatch(patchStr, cfg.maxLines)
+	}
+
+	debugLog("Processed %d staged files (%d total lines)", len(included), lineCount)
+	return stagedChanges{patch: patchStr, files: included, truncated: truncated}, nil
+}
+
+// fileHead returns the first n lines of content, indented under a file's
+// summary line, with a marker when the file is longer. A package clause,
+// imports or a docstring often tell the model what an added file is for.
+func fileHead(content string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	lines := splitLines(content)
+	var b strings.Builder
+	for i, line := range lines {
+		if i == n {
+			fmt.Fprintf(&b, "    ... (%d more %s)\n", len(lines)-n, plural(len(lines)-n, "line", "lines"))
+			break
+		}
+		fmt.Fprintf(&b, "%s\n", strings.TrimRight("    "+line, " \t"))
+	}
+	return b.String()
+}
+
+// binaryNote describes a binary file in one line, with as much detail as
+// summary asks for: "name" gives "binary file added: docs/shot.png",
+// "name-size" adds "(12kB)" and "mime" adds "(12kB, image/png)"
+func binaryNote(change fileChange, summary string) string {
+	note := fmt.Sprintf("binary file %s: %s", strings.ToLower(stagingStatusString(change.status)), change.path)
+	if summary == "name" {
+		return note + "\n"
+	}
+	size := len(change.newContent)
+	sizeStr := fmt.Sprintf("%dB", size)
+	if size >= 1024 {
+		sizeStr = fmt.Sprintf("%dkB", (size+512)/1024)
+	}
+	if summary == "name-size" {
+		return fmt.Sprintf("%s (%s)\n", note, sizeStr)
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType([]byte(change.newContent)), ";")
+	return fmt.Sprintf("%s (%s, %s)\n", note, sizeStr, contentType)
+}
+
+// firstParent returns the first parent of commit, or nil for a root commit
+// and for a commit whose parent is missing, as at the edge of a shallow
+// clone. missing reports the latter.
+func firstParent(commit *object.Commit) (parent *object.Commit, missing bool, err error) {
+	if commit.NumParents() == 0 {
+		return nil, false, nil
+	}
+	parent, err = commit.Parent(0)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, true, nil
+	}
+	return parent, false, err
+}
+
+// getCommitChanges returns the changes introduced by the commit at hash,
+// relative to its first parent or to an empty tree for a root commit. A
+// commit whose parent is missing from a shallow clone is also described
+// against an empty tree, with a note saying so.
+func getCommitChanges(ctx context.Context, repo *git.Repository, cfg config, hash plumbing.Hash) (stagedChanges, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get commit tree: %w", err)
+	}
+	parent, missing, err := firstParent(commit)
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get parent commit: %w", err)
+	}
+	var note string
+	if missing {
+		fmt.Fprintf(os.Stderr, "Warning: parent %s of commit %s is not in the repository (shallow clone?); showing every file in the commit as added\n",
+			commit.ParentHashes[0].String()[:7], hash.String()[:7])
+		note = fmt.Sprintf("The parent of commit %s is not available (shallow clone), so every file in the commit is shown as added. Most of it likely existed before; describe what the commit appears to change rather than listing the files.", hash.String()[:7])
+	}
+	var parentTree *object.Tree
+	if parent != nil {
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return stagedChanges{}, fmt.Errorf("failed to get parent tree: %w", err)
+		}
+	}
+
+	treeChanges, err := object.DiffTreeWithOptions(ctx, parentTree, tree, object.DefaultDiffTreeOptions)
+	if err != nil {
+		if ctx.Err() != nil {
+			return stagedChanges{}, ctx.Err()
+		}
+		return stagedChanges{}, fmt.Errorf("failed to diff commit: %w", err)
+	}
+
+	skipDirs := cfg.skippedDirs()
+	var fileChanges []fileChange
+	for _, tc := range treeChanges {
+		if err := ctx.Err(); err != nil {
+			return stagedChanges{}, err
+		}
+		action, err := tc.Action()
+		if err != nil {
+			return stagedChanges{}, err
+		}
+		change := fileChange{path: tc.To.Name, status: git.Modified}
+		switch action {
+		case merkletrie.Insert:
+			change.status = git.Added
+		case merkletrie.Delete:
+			change.path = tc.From.Name
+			change.status = git.Deleted
+		default:
+			if tc.From.Name != tc.To.Name {
+				change.oldPath = tc.From.Name
+				change.status = git.Renamed
+			}
+		}
+		if shouldIgnorePath(change.path, skipDirs) {
+			debugLog("Skipping ignored path: %s", change.path)
+			continue
+		}
+		if !matchPathspecs(change.path, cfg.pathspecs) {
+			debugLog("Skipping path outside the pathspec: %s", change.path)
+			continue
+		}
+
+		from, to, err := tc.Files()
+		if err != nil {
+			return stagedChanges{}, fmt.Errorf("failed to read %s: %w", change.path, err)
+		}
+		if from != nil {
+			change.oldHash = from.Hash
+			if change.oldContent, err = from.Contents(); err != nil {
+				return stagedChanges{}, fmt.Errorf("failed to read %s: %w", change.path, err)
+			}
+		}
+		if to != nil {
+			change.newHash = to.Hash
+			if change.newContent, err = to.Contents(); err != nil {
+				return stagedChanges{}, fmt.Errorf("failed to read %s: %w", change.path, err)
+			}
+			if isBinaryContent([]byte(change.newContent)) {
+				if cfg.binaryFiles != "note" {
+					debugLog("Skipping binary file: %s", change.path)
+					continue
+				}
+				change.binary = true
+			}
+		}
+		fileChanges = append(fileChanges, change)
+	}
+
+	sort.Slice(fileChanges, func(i, j int) bool { return fileChanges[i].path < fileChanges[j].path })
+	changes, err := assembleChanges(ctx, cfg, fileChanges)
+	changes.note = note
+	return changes, err
+}
+
+// getChangesAgainst describes how the staged tree differs from the tree at
+// the tip of ref, ignoring where the two histories diverged
+func getChangesAgainst(ctx context.Context, repo *git.Repository, cfg config, ref string) (stagedChanges, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get commit tree: %w", err)
+	}
+	refFiles := make(map[string]plumbing.Hash)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		refFiles[f.Name] = f.Hash
+		return nil
+	})
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to list %s: %w", ref, err)
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	skipDirs := cfg.skippedDirs()
+	var fileChanges []fileChange
+	addChange := func(change fileChange) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if shouldIgnorePath(change.path, skipDirs) {
+			debugLog("Skipping ignored path: %s", change.path)
+			return nil
+		}
+		if !matchPathspecs(change.path, cfg.pathspecs) {
+			debugLog("Skipping path outside the pathspec: %s", change.path)
+			return nil
+		}
+		if !change.oldHash.IsZero() {
+			if change.oldContent, err = blobContent(repo, change.oldHash); err != nil {
+				return fmt.Errorf("failed to read %s: %w", change.path, err)
+			}
+		}
+		if !change.newHash.IsZero() {
+			if change.newContent, err = blobContent(repo, change.newHash); err != nil {
+				return fmt.Errorf("failed to read %s: %w", change.path, err)
+			}
+			if isBinaryContent([]byte(change.newContent)) {
+				if cfg.binaryFiles != "note" {
+					debugLog("Skipping binary file: %s", change.path)
+					return nil
+				}
+				change.binary = true
+			}
+		}
+		fileChanges = append(fileChanges, change)
+		return nil
+	}
+
+	for _, e := range idx.Entries {
+		if e.Stage != 0 { // unmerged entries use stages 1-3
+			continue
+		}
+		oldHash, inRef := refFiles[e.Name]
+		delete(refFiles, e.Name)
+		change := fileChange{path: e.Name, status: git.Added, newHash: e.Hash}
+		if inRef {
+			if oldHash == e.Hash {
+				continue
+			}
+			change.status = git.Modified
+			change.oldHash = oldHash
+		}
+		if err := addChange(change); err != nil {
+			return stagedChanges{}, err
+		}
+	}
+	for path, oldHash := range refFiles {
+		if err := addChange(fileChange{path: path, status: git.Deleted, oldHash: oldHash}); err != nil {
+			return stagedChanges{}, err
+		}
+	}
+
+	sort.Slice(fileChanges, func(i, j int) bool { return fileChanges[i].path < fileChanges[j].path })
+	return assembleChanges(ctx, cfg, fileChanges)
+}
+
+// gitDir returns the filesystem of repo's .git directory, which only an
+// on-disk repository has
+func gitDir(repo *git.Repository) (billy.Filesystem, bool) {
+	storage, ok := repo.Storer.(interface{ Filesystem() billy.Filesystem })
+	if !ok {
+		return nil, false
+	}
+	return storage.Filesystem(), true
+}
+
+// rewriteState reports whether a rebase or cherry-pick is in progress and,
+// when an interactive rebase stopped to edit a commit, which commit that is
+func rewriteState(repo *git.Repository) (inProgress bool, editing plumbing.Hash, err error) {
+	dir, ok := gitDir(repo)
+	if !ok {
+		return false, plumbing.ZeroHash, errors.New("the repository has no git directory to read the rebase state from")
+	}
+	for _, name := range []string{"rebase-merge", "rebase-apply", "CHERRY_PICK_HEAD"} {
+		if _, err := dir.Stat(name); err == nil {
+			inProgress = true
+		}
+	}
+	if data, err := util.ReadFile(dir, "rebase-merge/amend"); err == nil {
+		editing = plumbing.NewHash(strings.TrimSpace(string(data)))
+	}
+	return inProgress, editing, nil
+}
+
+// getRebaseChanges returns the changes of the commit a rebase or
+// cherry-pick is working on. When a rebase stopped to edit the commit at
+// HEAD, the staged tree is compared with HEAD's parent, giving what
+// "git commit --amend" would record. Otherwise, as while resolving
+// conflicts, the commit is still being built in the index and the staged
+// changes are used.
+func getRebaseChanges(ctx context.Context, repo *git.Repository, cfg config) (stagedChanges, error) {
+	inProgress, editing, err := rewriteState(repo)
+	if err != nil {
+		return stagedChanges{}, err
+	}
+	if !inProgress {
+		return stagedChanges{}, errors.New("no rebase or cherry-pick in progress")
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	if editing.IsZero() || head.Hash() != editing {
+		debugLog("Describing the staged changes of the commit in progress")
+		return getStagedChanges(ctx, repo, cfg)
+	}
+	commit, err := repo.CommitObject(editing)
+	if err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get commit %s: %w", editing, err)
+	}
+	if commit.NumParents() == 0 {
+		return stagedChanges{}, fmt.Errorf("commit %s being edited has no parent to compare with", editing.String()[:7])
+	}
+	if _, missing, err := firstParent(commit); err != nil {
+		return stagedChanges{}, fmt.Errorf("failed to get parent commit: %w", err)
+	} else if missing {
+		return stagedChanges{}, fmt.Errorf("parent of commit %s being edited is not in the repository (shallow clone? try git fetch --deepen=1)", editing.String()[:7])
+	}
+	debugLog("Describing commit %s being edited, with any staged amendments", editing.String()[:7])
+	return getChangesAgainst(ctx, repo, cfg, commit.ParentHashes[0].String())
+}
+
+// stashEntry matches git's stash@{N} syntax
+var stashEntry = regexp.MustCompile(`^stash@\{(\d+)\}$`)
+
+// resolveStash returns the commit of a stash entry given as stash@{N}, or of
+// any other revision. Entries past the newest are read from the stash
+// reflog, which only an on-disk repository has.
+func resolveStash(repo *git.Repository, name string) (plumbing.Hash, error) {
+	m := stashEntry.FindStringSubmatch(name)
+	if m == nil {
+		hash, err := repo.ResolveRevision(plumbing.Revision(name))
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		return *hash, nil
+	}
+	n, _ := strconv.Atoi(m[1])
+	if n == 0 {
+		ref, err := repo.Reference("refs/stash", true)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("no stash entries found: %w", err)
+		}
+		return ref.Hash(), nil
+	}
+	dir, ok := gitDir(repo)
+	if !ok {
+		return plumbing.ZeroHash, fmt.Errorf("%s needs the stash reflog, which this repository does not have", name)
+	}
+	data, err := util.ReadFile(dir, "logs/refs/stash")
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("no stash entries found: %w", err)
+	}
+	// The reflog lists the newest entry last
+	entries := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if n >= len(entries) {
+		return plumbing.ZeroHash, fmt.Errorf("%s does not exist, there are %d stash entries", name, len(entries))
+	}
+	fields := strings.Fields(entries[len(entries)-1-n])
+	if len(fields) < 2 {
+		return plumbing.ZeroHash, fmt.Errorf("malformed stash reflog entry for %s", name)
+	}
+	return plumbing.NewHash(fields[1]), nil
+}
+
+// getStashChanges returns the changes a stash entry records relative to the
+// commit it was made on, along with a note when that commit is not HEAD
+func getStashChanges(ctx context.Context, repo *git.Repository, cfg config, name string) (stagedChanges, string, error) {
+	hash, err := resolveStash(repo, name)
+	if err != nil {
+		return stagedChanges{}, "", err
+	}
+	stash, err := repo.CommitObject(hash)
+	if err != nil {
+		return stagedChanges{}, "", fmt.Errorf("failed to get stash commit %s: %w", hash, err)
+	}
+	changes, err := getCommitChanges(ctx, repo, cfg, hash)
+	if err != nil {
+		return stagedChanges{}, "", err
+	}
+	note := ""
+	if head, err := repo.Head(); err == nil && stash.NumParents() > 0 && stash.ParentHashes[0] != head.Hash() {
+		note = fmt.Sprintf("The stash was made on commit %s, not HEAD; its line numbers refer to that commit.", stash.ParentHashes[0].String()[:7])
+	}
+	return changes, note, nil
+}
+
+// mergeChanges combines the staged changes with those of a stash into one
+// patch. A stash hunk identical to a staged one is kept once; hunks that
+// edit overlapping lines of the same file are both kept and reported, since
+// applying them together may conflict.
+func mergeChanges(staged, stashed stagedChanges) (stagedChanges, []string) {
+	stagedFiles, stashedFiles := parsePatch(staged.patch), parsePatch(stashed.patch)
+	if len(stagedFiles) == 0 || len(stashedFiles) == 0 {
+		// Summaries without file sections can only be put side by side
+		merged := stagedChanges{patch: staged.patch, files: slices.Clone(staged.files), unstaged: staged.unstaged, truncated: staged.truncated || stashed.truncated}
+		if staged.patch != "" && stashed.patch != "" {
+			merged.patch += "\n"
+		}
+		merged.patch += stashed.patch
+		for _, f := range stashed.files {
+			if !slices.ContainsFunc(merged.files, func(s stagedFile) bool { return s.path == f.path }) {
+				merged.files = append(merged.files, f)
+			}
+		}
+		return merged, nil
+	}
+
+	var overlaps []string
+	merged := stagedChanges{files: slices.Clone(staged.files), unstaged: staged.unstaged, truncated: staged.truncated || stashed.truncated}
+	byPath := make(map[string]int, len(stagedFiles))
+	for i, f := range stagedFiles {
+		byPath[f.path] = i
+	}
+	for _, f := range stashedFiles {
+		i, ok := byPath[f.path]
+		if !ok {
+			stagedFiles = append(stagedFiles, f)
+			if j := slices.IndexFunc(stashed.files, func(s stagedFile) bool { return s.path == f.path }); j >= 0 {
+				merged.files = append(merged.files, stashed.files[j])
+			}
+			continue
+		}
+		target := &stagedFiles[i]
+		stagedHunks := slices.Clone(target.hunks)
+		for _, hunk := range f.hunks {
+			if slices.Contains(stagedHunks, hunk) {
+				continue
+			}
+			for _, span := range changedSpans(hunk) {
+				for _, other := range stagedHunks {
+					for _, otherSpan := range changedSpans(other) {
+						if span[0] <= otherSpan[1] && otherSpan[0] <= span[1] {
+							overlaps = append(overlaps, fmt.Sprintf("%s: the stash changes %s, the staged changes %s", f.path, lineRange(span), lineRange(otherSpan)))
+						}
+					}
+				}
+			}
+			target.hunks = append(target.hunks, hunk)
+			if j := slices.IndexFunc(merged.files, func(s stagedFile) bool { return s.path == f.path }); j >= 0 {
+				added, removed := countDiffLines(hunk)
+				merged.files[j].added += added
+				merged.files[j].removed += removed
+			}
+		}
+		sort.SliceStable(target.hunks, func(a, b int) bool {
+			startA, _ := hunkSpan(target.hunks[a])
+			startB, _ := hunkSpan(target.hunks[b])
+			return startA < startB
+		})
+	}
+
+	var b strings.Builder
+	for _, f := range stagedFiles {
+		b.WriteString(f.String())
+	}
+	merged.patch = b.String()
+	return merged, overlaps
+}
+
+// hunkSpan returns the first and last old-side line a hunk covers. A hunk
+// that only inserts covers the line it inserts after.
+func hunkSpan(hunk string) (start, end int) {
+	count := 1
+	if _, err := fmt.Sscanf(hunk, "@@ -%d,%d", &start, &count); err != nil && start == 0 {
+		return 0, 0
+	}
+	return start, start + max(count, 1) - 1
+}
+
+// changedSpans returns the old-side lines each run of changes in a hunk
+// touches, leaving out its context lines: the removed lines, or for a run
+// that only inserts, the line it inserts after.
+func changedSpans(hunk string) [][2]int {
+	line, _ := hunkSpan(hunk)
+	var spans [][2]int
+	runStart, removed, inRun := 0, 0, false
+	endRun := func() {
+		if removed > 0 {
+			spans = append(spans, [2]int{runStart, runStart + removed - 1})
+		} else {
+			after := max(runStart-1, 1)
+			spans = append(spans, [2]int{after, after})
+		}
+		inRun = false
+	}
+	for _, l := range splitLines(hunk)[1:] {
+		switch {
+		case strings.HasPrefix(l, "-"), strings.HasPrefix(l, "+"):
+			if !inRun {
+				runStart, removed, inRun = line, 0, true
+			}
+			if l[0] == '-' {
+				removed++
+				line++
+			}
+		case strings.HasPrefix(l, " "):
+			if inRun {
+				endRun()
+			}
+			line++
+		}
+	}
+	if inRun {
+		endRun()
+	}
+	return spans
+}
+
+// lineRange formats an inclusive line span as "line n" or "lines n-m"
+func lineRange(span [2]int) string {
+	if span[0] == span[1] {
+		return fmt.Sprintf("line %d", span[0])
+	}
+	return fmt.Sprintf("lines %d-%d", span[0], span[1])
+}
+
+// notesRef is the ref git reads notes from by default
+const notesRef = plumbing.ReferenceName("refs/notes/commits")
+
+// addNote attaches note to the commit at target, replacing any note it
+// already has, and advances refs/notes/commits. Notes stored by git in a
+// fan-out layout are kept as they are.
+func addNote(repo *git.Repository, target plumbing.Hash, note string) error {
+	sig, err := configSignature(repo)
+	if err != nil {
+		return err
+	}
+
+	var entries []object.TreeEntry
+	var parents []plumbing.Hash
+	ref, err := repo.Reference(notesRef, true)
+	switch {
+	case err == nil:
+		notesCommit, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return fmt.Errorf("failed to get notes commit: %w", err)
+		}
+		notesTree, err := notesCommit.Tree()
+		if err != nil {
+			return fmt.Errorf("failed to get notes tree: %w", err)
+		}
+		for _, entry := range notesTree.Entries {
+			if entry.Name != target.String() {
+				entries = append(entries, entry)
+			}
+		}
+		parents = []plumbing.Hash{ref.Hash()}
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		debugLog("Creating %s", notesRef)
+	default:
+		return fmt.Errorf("failed to read %s: %w", notesRef, err)
+	}
+
+	blob := repo.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, normalizeCommitMessage(note)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	blobHash, err := repo.Storer.SetEncodedObject(blob)
+	if err != nil {
+		return fmt.Errorf("failed to store note: %w", err)
+	}
+
+	entries = append(entries, object.TreeEntry{Name: target.String(), Mode: filemode.Regular, Hash: blobHash})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	treeHash, err := storeObject(repo, &object.Tree{Entries: entries})
+	if err != nil {
+		return fmt.Errorf("failed to store notes tree: %w", err)
+	}
+
+	commitHash, err := storeObject(repo, &object.Commit{
+		Author:       *sig,
+		Committer:    *sig,
+		Message:      "Notes added by 'describe'\n",
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store notes commit: %w", err)
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(notesRef, commitHash))
+}
+
+// storeObject encodes obj into the repository's object store
+func storeObject(repo *git.Repository, obj interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	encoded := repo.Storer.NewEncodedObject()
+	if err := obj.Encode(encoded); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(encoded)
+}
+
+// languagesByExtension maps file extensions to language names used as
+// prompt hints
+var languagesByExtension = map[string]string{
+	".go":    "Go",
+	".py":    "Python",
+	".js":    "JavaScript",
+	".jsx":   "JavaScript",
+	".mjs":   "JavaScript",
+	".ts":    "TypeScript",
+	".tsx":   "TypeScript",
+	".rs":    "Rust",
+	".java":  "Java",
+	".kt":    "Kotlin",
+	".c":     "C",
+	".h":     "C",
+	".cc":    "C++",
+	".cpp":   "C++",
+	".hpp":   "C++",
+	".cs":    "C#",
+	".rb":    "Ruby",
+	".php":   "PHP",
+	".swift": "Swift",
+	".sh":    "Shell",
+	".bash":  "Shell",
+	".sql":   "SQL",
+	".html":  "HTML",
+	".css":   "CSS",
+	".scss":  "SCSS",
+	".md":    "Markdown",
+	".yaml":  "YAML",
+	".yml":   "YAML",
+	".json":  "JSON",
+	".toml":  "TOML",
+	".proto": "Protocol Buffers",
+	".tf":    "Terraform",
+}
+
+// languagesByFilename covers files identified by name rather than extension
+var languagesByFilename = map[string]string{
+	"Makefile":   "Makefile",
+	"Dockerfile": "Dockerfile",
+	"go.mod":     "Go modules",
+}
+
+// detectLanguages returns the sorted, de-duplicated languages of paths
+func detectLanguages(paths []string) []string {
+	seen := make(map[string]bool)
+	var languages []string
+	for _, path := range paths {
+		base := filepath.Base(path)
+		lang, ok := languagesByFilename[base]
+		if !ok {
+			lang, ok = languagesByExtension[strings.ToLower(filepath.Ext(base))]
+		}
+		if ok && !seen[lang] {
+			seen[lang] = true
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// authorPattern matches the "Name <email>" form accepted by -author
+var authorPattern = regexp.MustCompile(`^\s*([^<>]*[^<>\s])\s*<([^<>\s]+)>\s*$`)
+
+// parseAuthor parses a "Name <email>" identity into a signature timestamped now
+func parseAuthor(author string) (*object.Signature, error) {
+	m := authorPattern.FindStringSubmatch(author)
+	if m == nil {
+		return nil, fmt.Errorf("invalid author %q (expected \"Name <email>\")", author)
+	}
+	return &object.Signature{Name: m[1], Email: m[2], When: time.Now()}, nil
+}
+
+// indexModTime returns when the index was last written, which is when
+// something was last staged. ok is false for repositories without an index
+// file, such as in-memory ones.
+func indexModTime(repo *git.Repository) (modified time.Time, ok bool) {
+	storage, isFS := repo.Storer.(*filesystem.Storage)
+	if !isFS {
+		return time.Time{}, false
+	}
+	info, err := storage.Filesystem().Stat("index")
+	if err != nil {
+		debugLog("Cannot stat index: %v", err)
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// errNotARepository explains what to do when describe runs outside git
+var errNotARepository = errors.New("not a git repository (or any parent directory): run describe inside one, describe a saved diff with -diff-file (\"-\" reads stdin), or compare two files with \"describe old new\"")
+
+// openRepository opens the git repository containing dir, looking in
+// parent directories so describe works from anywhere in a worktree
+func openRepository(dir string) (*git.Repository, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, errNotARepository
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	return repo, nil
+}
+
+// configSignature returns the identity configured in git (user.name and
+// user.email) as a signature timestamped now
+func configSignature(repo *git.Repository) (*object.Signature, error) {
+	cfg, err := repo.ConfigScoped(gitconfig.GlobalScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read git config: %w", err)
+	}
+	if cfg.User.Name == "" || cfg.User.Email == "" {
+		return nil, fmt.Errorf("user.name and user.email must be set in git config")
+	}
+	return &object.Signature{Name: cfg.User.Name, Email: cfg.User.Email, When: time.Now()}, nil
+}
+
+// normalizeCommitMessage prepares a message for git: the subject must be on
+// the first line, and the message ends with exactly one newline. Blank lines
+// within the body are preserved.
+func normalizeCommitMessage(message string) string {
+	lines := strings.Split(strings.ReplaceAll(message, "\r\n", "\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// separatorLine matches a line some models put between the subject and the
+// body instead of a blank line, such as "---" or "==="
+var separatorLine = regexp.MustCompile(`^\s*(?:(?:-\s*){3,}|(?:=\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+
+// separateSubject gives message git's structure: the subject line, exactly
+// one blank line and the body. Missing blank lines are inserted, extra ones
+// and separator lines such as "---" are removed. Without body, only the
+// subject is kept.
+func separateSubject(message string, body bool) string {
+	subject, rest, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	subject = strings.TrimSpace(subject)
+	lines := strings.Split(rest, "\n")
+	for len(lines) > 0 && (strings.TrimSpace(lines[0]) == "" || separatorLine.MatchString(lines[0])) {
+		lines = lines[1:]
+	}
+	rest = strings.TrimRightFunc(strings.Join(lines, "\n"), unicode.IsSpace)
+	if !body || rest == "" {
+		return subject
+	}
+	return subject + "\n\n" + rest
+}
+
+// placeMessage inserts message into the existing content of a commit
+// message file such as a template or merge summary. "top" puts it above
+// everything; "bottom" puts it after the existing text but above the
+// trailing block of git's "#" comments.
+func placeMessage(existing, message, placement string) string {
+	existing = strings.ReplaceAll(existing, "\r\n", "\n")
+	if strings.TrimSpace(existing) == "" {
+		return message
+	}
+	if placement == "top" {
+		return message + "\n" + strings.TrimLeft(existing, "\n")
+	}
+
+	lines := strings.Split(strings.TrimRight(existing, "\n"), "\n")
+	split := len(lines)
+	for split > 0 && (strings.HasPrefix(lines[split-1], "#") || strings.TrimSpace(lines[split-1]) == "") {
+		split--
+	}
+	var b strings.Builder
+	if text := normalizeCommitMessage(strings.Join(lines[:split], "\n")); text != "" {
+		b.WriteString(text + "\n")
+	}
+	b.WriteString(message)
+	if comments := strings.TrimLeft(strings.Join(lines[split:], "\n"), "\n"); comments != "" {
+		b.WriteString("\n" + comments + "\n")
+	}
+	return b.String()
+}
+
+// commitChanges commits the staged changes with message. A non-empty author
+// overrides the commit author while the committer stays the configured user.
+func commitChanges(repo *git.Repository, message, author string) (plumbing.Hash, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("repo.Worktree: %w", err)
+	}
+
+	opts := &git.CommitOptions{}
+	if author != "" {
+		opts.Author, err = parseAuthor(author)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		opts.Committer, err = configSignature(repo)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	debugLog("Committing staged changes")
+	hash, err := w.Commit(normalizeCommitMessage(message), opts)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("worktree.Commit: %w", err)
+	}
+	return hash, nil
+}
+
+// changeIDTrailer matches a Gerrit Change-Id trailer line
+var changeIDTrailer = regexp.MustCompile(`(?m)^Change-Id: I[0-9a-f]{40}\s*$`)
+
+// addChangeID appends a Gerrit "Change-Id: I<sha1>" trailer to message
+// unless it already has one. Like Gerrit's commit-msg hook, the id hashes
+// the staged tree, the parent, the committer, the time and the message, so
+// it is unique to this commit but stays with it through amends and rebases.
+func addChangeID(repo *git.Repository, message string, now time.Time) (string, error) {
+	if changeIDTrailer.MatchString(message) {
+		return message, nil
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return "", fmt.Errorf("failed to read index: %w", err)
+	}
+	var b strings.Builder
+	b.WriteString("tree")
+	for _, e := range idx.Entries {
+		fmt.Fprintf(&b, " %s %s", e.Hash, e.Name)
+	}
+	if head, err := repo.Head(); err == nil {
+		fmt.Fprintf(&b, "\nparent %s", head.Hash())
+	}
+	if sig, err := configSignature(repo); err == nil {
+		fmt.Fprintf(&b, "\ncommitter %s <%s>", sig.Name, sig.Email)
+	}
+	fmt.Fprintf(&b, " %d\n\n%s", now.Unix(), message)
+	id := "I" + plumbing.ComputeHash(plumbing.CommitObject, []byte(b.String())).String()
+	return appendTrailers(message, []trailer{{"Change-Id", id}}), nil
+}
+
+// runPostCommit runs command through the shell in the repository root,
+// passing its output through to stderr
+func runPostCommit(ctx context.Context, repo *git.Repository, command string) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("repo.Worktree: %w", err)
+	}
+	debugLog("Running post-commit command: %s", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = w.Filesystem.Root()
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// rollbackCommit undoes the commit made as hash like "git reset --soft":
+// HEAD moves back to its parent and the index, still holding the committed
+// changes, is left alone. The first commit of a repository is undone by
+// removing the branch it created.
+func rollbackCommit(repo *git.Repository, hash plumbing.Hash) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("repo.Head: %w", err)
+	}
+	if head.Hash() != hash {
+		return fmt.Errorf("HEAD moved to %s, not rolling back %s", head.Hash().String()[:7], hash.String()[:7])
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("repo.CommitObject: %w", err)
+	}
+	if commit.NumParents() == 0 {
+		return repo.Storer.RemoveReference(head.Name())
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), commit.ParentHashes[0]))
+}
+
+// commonDirPrefix returns the deepest directory containing all paths, or
+// an empty string when they only share the repository root
+func commonDirPrefix(paths []string) string {
+	var common []string
+	for i, p := range paths {
+		parts := strings.Split(filepath.ToSlash(p), "/")
+		parts = parts[:len(parts)-1] // drop the file name
+		if i == 0 {
+			common = parts
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return strings.Join(common, "/")
+}
+
+// focusArea names the part of the repository the changes center on: the
+// directory shared by all files, or else the top-level directory holding
+// more than half of the changed lines. It is empty when no area dominates.
+func focusArea(files []stagedFile) string {
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	if dir := commonDirPrefix(paths); dir != "" {
+		return dir
+	}
+
+	weights := make(map[string]int)
+	total := 0
+	for _, f := range files {
+		weight := max(f.added+f.removed, 1)
+		total += weight
+		if top, _, isDir := strings.Cut(filepath.ToSlash(f.path), "/"); isDir {
+			weights[top] += weight
+		}
+	}
+	for dir, weight := range weights {
+		if weight*2 > total {
+			return dir
+		}
+	}
+	return ""
+}
+
+// codeownersFiles are the places GitHub and GitLab look for CODEOWNERS,
+// in order
+var codeownersFiles = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS", ".gitlab/CODEOWNERS"}
+
+// codeownersRule is one "pattern owner..." line of a CODEOWNERS file
+type codeownersRule struct {
+	pattern gitignore.Pattern
+	owners  []string
+}
+
+// readCodeowners parses the first CODEOWNERS file found in fs, returning
+// no rules when there is none
+func readCodeowners(fs billy.Filesystem) ([]codeownersRule, error) {
+	for _, name := range codeownersFiles {
+		data, err := util.ReadFile(fs, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		debugLog("Reading code owners from %s", name)
+		return parseCodeowners(string(data)), nil
+	}
+	return nil, nil
+}
+
+// parseCodeowners parses CODEOWNERS text. Patterns follow .gitignore
+// rules; GitLab section headers such as "[Docs]" are skipped.
+func parseCodeowners(text string) []codeownersRule {
+	var rules []codeownersRule
+	for _, line := range strings.Split(text, "\n") {
+		line, _, _ = strings.Cut(line, " #")
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "[") {
+			continue
+		}
+		rules = append(rules, codeownersRule{pattern: gitignore.ParsePattern(fields[0], nil), owners: fields[1:]})
+	}
+	return rules
+}
+
+// fileOwners returns the owners of path: those of the last matching rule,
+// which may list none to leave the path unowned
+func fileOwners(rules []codeownersRule, path string) []string {
+	parts := strings.Split(path, "/")
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].pattern.Match(parts, false) == gitignore.Exclude {
+			return rules[i].owners
+		}
+	}
+	return nil
+}
+
+// codeOwners lists the owners of paths with the files each owns, for the
+// prompt, and returns the scope the owning team gives when all owned paths
+// share the same first owner, e.g. "payments" for "@acme/payments"
+func codeOwners(rules []codeownersRule, paths []string) (summary, scope string) {
+	var order []string
+	counts := make(map[string]int)
+	firstOwners := make(map[string]bool)
+	for _, path := range paths {
+		owners := fileOwners(rules, path)
+		if len(owners) == 0 {
+			continue
+		}
+		firstOwners[owners[0]] = true
+		for _, owner := range owners {
+			if counts[owner] == 0 {
+				order = append(order, owner)
+			}
+			counts[owner]++
+		}
+	}
+	var lines []string
+	for _, owner := range order {
+		lines = append(lines, fmt.Sprintf("%s: %d %s", owner, counts[owner], plural(counts[owner], "file", "files")))
+	}
+	if len(firstOwners) == 1 {
+		for owner := range firstOwners {
+			scope = owner
+		}
+		if at := strings.LastIndex(scope, "@"); at > 0 {
+			// An email address owner, e.g. jane@example.com
+			scope = scope[:at]
+		}
+		scope = strings.TrimPrefix(scope[strings.LastIndex(scope, "/")+1:], "@")
+	}
+	return strings.Join(lines, "\n"), scope
+}
+
+// inferScope derives a conventional commit scope from the innermost
+// directory shared by all changed paths
+func inferScope(paths []string) string {
+	dir := commonDirPrefix(paths)
+	return dir[strings.LastIndex(dir, "/")+1:]
+}
+
+// subjectPrefix resolves the configured subject prefix for the changed
+// paths. "auto" becomes the top-level directory shared by all paths in
+// brackets, or nothing when they only share the repository root.
+func subjectPrefix(prefix string, paths []string) string {
+	if prefix != "auto" {
+		return prefix
+	}
+	dir := commonDirPrefix(paths)
+	if dir == "" {
+		return ""
+	}
+	top, _, _ := strings.Cut(dir, "/")
+	return "[" + top + "]"
+}
+
+// addSubjectPrefix prepends prefix to the first line of message unless it
+// already starts with it
+func addSubjectPrefix(message, prefix string) string {
+	if prefix == "" {
+		return message
+	}
+	message = strings.TrimLeft(message, " \t\r\n")
+	if strings.HasPrefix(message, prefix) {
+		return message
+	}
+	return prefix + " " + message
+}
+
+// markdownHeading matches an ATX heading line, capturing its text
+var markdownHeading = regexp.MustCompile(`^#{1,6}\s+(.*?)(?:\s+#+)?\s*$`)
+
+// markdownBullet matches the marker of a "*", "+" or "•" list item, or of a
+// "-" item followed by more than one space
+var markdownBullet = regexp.MustCompile(`^(\s*)(?:[*+•]\s+|-\s{2,})`)
+
+// headingLabels are headings models put above the message instead of
+// making it the subject
+var headingLabels = []string{"summary", "subject", "title", "commit", "commit message", "message"}
+
+// plainText undoes markdown formatting models wrap messages in. A code
+// fence around the whole message is always removed. With clean, a leading
+// heading becomes the subject line (or is dropped when it is only a label
+// such as "# Summary"), headings in the body become plain lines and list
+// items use "- " bullets.
+func plainText(message string, clean bool) string {
+	message = strings.TrimSpace(message)
+	if lines := strings.Split(message, "\n"); len(lines) >= 2 &&
+		strings.HasPrefix(lines[0], "```") && strings.TrimSpace(lines[len(lines)-1]) == "```" {
+		message = strings.TrimSpace(strings.Join(lines[1:len(lines)-1], "\n"))
+	}
+	if !clean {
+		return message
+	}
+
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		if m := markdownHeading.FindStringSubmatch(line); m != nil {
+			text := m[1]
+			if i == 0 && slices.Contains(headingLabels, strings.ToLower(strings.TrimSuffix(text, ":"))) {
+				text = ""
+			}
+			lines[i] = text
+			continue
+		}
+		lines[i] = markdownBullet.ReplaceAllString(line, "$1- ")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// subjectStyles lists the rules subject_style accepts
+var subjectStyles = []string{"capital", "lowercase", "no-period", "imperative"}
+
+// conventionalHead matches the "type(scope)!: " start of a conventional
+// commit subject, which subject_style rules skip over
+var conventionalHead = regexp.MustCompile(`^[a-z]+(\([^)]*\))?!?: `)
+
+// imperativeVerbs maps the past-tense and third-person forms models open
+// subjects with to the imperative
+var imperativeVerbs = map[string]string{
+	"added": "add", "adds": "add", "adding": "add",
+	"fixed": "fix", "fixes": "fix", "fixing": "fix",
+	"removed": "remove", "removes": "remove", "removing": "remove",
+	"updated": "update", "updates": "update", "updating": "update",
+	"changed": "change", "changes": "change", "changing": "change",
+	"refactored": "refactor", "refactors": "refactor", "refactoring": "refactor",
+	"implemented": "implement", "implements": "implement", "implementing": "implement",
+	"improved": "improve", "improves": "improve", "improving": "improve",
+	"renamed": "rename", "renames": "rename", "renaming": "rename",
+	"moved": "move", "moves": "move", "moving": "move",
+	"deleted": "delete", "deletes": "delete", "deleting": "delete",
+	"replaced": "replace", "replaces": "replace", "replacing": "replace",
+	"introduced": "introduce", "introduces": "introduce", "introducing": "introduce",
+	"created": "create", "creates": "create", "creating": "create",
+	"cleaned": "clean", "cleans": "clean", "cleaning": "clean",
+	"simplified": "simplify", "simplifies": "simplify", "simplifying": "simplify",
+	"bumped": "bump", "bumps": "bump", "bumping": "bump",
+	"documented": "document", "documents": "document", "documenting": "document",
+	"handled": "handle", "handles": "handle", "handling": "handle",
+	"allowed": "allow", "allows": "allow", "allowing": "allow",
+	"enabled": "enable", "enables": "enable", "enabling": "enable",
+	"disabled": "disable", "disables": "disable", "disabling": "disable",
+	"reverted": "revert", "reverts": "revert", "reverting": "revert",
+	"optimized": "optimize", "optimizes": "optimize", "optimizing": "optimize",
+	"made": "make", "makes": "make", "making": "make",
+	"used": "use", "uses": "use", "using": "use",
+	"supported": "support", "supports": "support", "supporting": "support",
+	"extracted": "extract", "extracts": "extract", "extracting": "extract",
+	"dropped": "drop", "drops": "drop", "dropping": "drop",
+	"upgraded": "upgrade", "upgrades": "upgrade", "upgrading": "upgrade",
+}
+
+// applySubjectStyle rewrites the subject line of message to follow the
+// subject_style rules: the first word is put in the imperative, a trailing
+// period is dropped and the first letter is capitalized or lowercased. The
+// type and scope of a conventional commit subject are left alone, and words
+// such as "API" keep their case.
+func applySubjectStyle(message string, rules []string) string {
+	if len(rules) == 0 {
+		return message
+	}
+	message = strings.TrimLeft(message, " \t\r\n")
+	subject, rest, hasBody := strings.Cut(message, "\n")
+	subject = strings.TrimRight(subject, " \t\r")
+	head := conventionalHead.FindString(subject)
+	text := subject[len(head):]
+
+	if slices.Contains(rules, "imperative") {
+		word, _, _ := strings.Cut(text, " ")
+		if base, ok := imperativeVerbs[strings.ToLower(word)]; ok {
+			debugLog("Rewriting %q as %q", word, base)
+			text = base + text[len(word):]
+			if word[0] >= 'A' && word[0] <= 'Z' {
+				text = strings.ToUpper(base[:1]) + text[1:]
+			}
+		}
+	}
+	if slices.Contains(rules, "no-period") && !strings.HasSuffix(text, "..") {
+		text = strings.TrimSuffix(text, ".")
+	}
+	if text != "" {
+		first, size := utf8.DecodeRuneInString(text)
+		second, _ := utf8.DecodeRuneInString(text[size:])
+		switch {
+		case slices.Contains(rules, "capital"):
+			text = string(unicode.ToUpper(first)) + text[size:]
+		case slices.Contains(rules, "lowercase") && !unicode.IsUpper(second):
+			text = string(unicode.ToLower(first)) + text[size:]
+		}
+	}
+
+	subject = head + text
+	if !hasBody {
+		return subject
+	}
+	return subject + "\n" + rest
+}
+
+// gitUser returns the configured git identity as "Name <email>", or an
+// empty string if no user is configured
+func gitUser(repo *git.Repository) string {
+	cfg, err := repo.ConfigScoped(gitconfig.GlobalScope)
+	if err != nil {
+		debugLog("Failed to read git config: %v", err)
+		return ""
+	}
+	name, email := cfg.User.Name, cfg.User.Email
+	switch {
+	case name != "" && email != "":
+		return fmt.Sprintf("%s <%s>", name, email)
+	case name != "":
+		return name
+	default:
+		return email
+	}
+}
+
+// revisionAuthor returns the author of the commit being described, the
+// -add-note commit or the one an interactive rebase stopped to edit, as
+// "Name <email>", with its author date. ok is false when staged changes are
+// described; their author is the current git user.
+func revisionAuthor(repo *git.Repository, cfg config, noteTarget *plumbing.Hash) (author string, date time.Time, ok bool) {
+	var hash plumbing.Hash
+	switch {
+	case noteTarget != nil:
+		hash = *noteTarget
+	case cfg.rebase:
+		_, editing, err := rewriteState(repo)
+		if err != nil || editing.IsZero() {
+			return "", time.Time{}, false
+		}
+		head, err := repo.Head()
+		if err != nil || head.Hash() != editing {
+			return "", time.Time{}, false
+		}
+		hash = editing
+	default:
+		return "", time.Time{}, false
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		debugLog("Failed to read the author of %s: %v", hash, err)
+		return "", time.Time{}, false
+	}
+	return fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email), commit.Author.When, true
+}
+
+// currentBranch returns the short name of the checked-out branch, or "" when
+// HEAD is detached. An unborn branch is returned too.
+func currentBranch(repo *git.Repository) string {
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		return ""
+	}
+	return head.Target().Short()
+}
+
+// gitCommitTemplate returns the contents of the file named by git's
+// commit.template, or "" when it is not set. Like git, a leading ~/ refers to
+// the home directory; other relative paths are taken from the worktree root.
+// It reports whether the template was cut to maxContextFileBytes.
+func gitCommitTemplate(repo *git.Repository) (string, bool, error) {
+	cfg, err := repo.ConfigScoped(gitconfig.GlobalScope)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read git config: %w", err)
+	}
+	path := cfg.Raw.Section("commit").Option("template")
+	if path == "" {
+		return "", false, nil
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false, err
+		}
+		path = filepath.Join(home, rest)
+	} else if !filepath.IsAbs(path) {
+		w, err := repo.Worktree()
+		if err != nil {
+			return "", false, err
+		}
+		path = filepath.Join(w.Filesystem.Root(), path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	text, truncated := truncateContext(strings.TrimSpace(string(data)), 0)
+	return text, truncated, nil
+}
+
+// gitEmail returns the configured git user.email, or "" when it is not set
+func gitEmail(repo *git.Repository) string {
+	cfg, err := repo.ConfigScoped(gitconfig.GlobalScope)
+	if err != nil {
+		debugLog("Failed to read git config: %v", err)
+		return ""
+	}
+	return cfg.User.Email
+}
+
+// recentCodeAge is how long a line counts as recently written in blame context
+const recentCodeAge = 30 * 24 * time.Hour
+
+// blameBase returns the commit holding the old side of the changes being
+// described: the parent of the -add-note commit or of a commit being edited
+// in a rebase, the -against ref or HEAD.
+// It returns nil when there is no such commit, e.g. before the first commit.
+func blameBase(repo *git.Repository, cfg config, noteTarget *plumbing.Hash) (*object.Commit, error) {
+	switch {
+	case noteTarget != nil:
+		commit, err := repo.CommitObject(*noteTarget)
+		if err != nil {
+			return nil, err
+		}
+		parent, _, err := firstParent(commit)
+		return parent, err
+	case cfg.against != "":
+		hash, err := repo.ResolveRevision(plumbing.Revision(cfg.against))
+		if err != nil {
+			return nil, err
+		}
+		return repo.CommitObject(*hash)
+	default:
+		head, err := repo.Head()
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		commit, err := repo.CommitObject(head.Hash())
+		if err != nil || !cfg.rebase {
+			return commit, err
+		}
+		// A commit being edited is described against its parent
+		if _, editing, err := rewriteState(repo); err == nil && editing == head.Hash() {
+			parent, _, err := firstParent(commit)
+			return parent, err
+		}
+		return commit, nil
+	}
+}
+
+// blameContext describes, for each hunk of patch that removes or replaces
+// lines, when and by whom those lines were last changed as of base, so the
+// model can tell a fix to freshly written code from a change to long-standing
+// code. Lines last changed by email are attributed to "you". Pure additions
+// and files that cannot be blamed, such as renames, are left out.
+func blameContext(ctx context.Context, base *object.Commit, patch, email string, now time.Time) (string, error) {
+	var notes []string
+	for _, f := range parsePatch(patch) {
+		var blame *git.BlameResult
+		for _, hunk := range f.hunks {
+			lines := removedLines(hunk)
+			if len(lines) == 0 {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			if blame == nil {
+				var err error
+				if blame, err = git.Blame(base, f.path); err != nil {
+					debugLog("Not blaming %s: %v", f.path, err)
+					break
+				}
+			}
+			if note := blameNote(f.path, lines, blame, email, now); note != "" {
+				notes = append(notes, note)
+			}
+		}
+	}
+	return strings.Join(notes, "\n"), nil
+}
+
+// removedLines returns the old-side line numbers of the lines hunk removes
+func removedLines(hunk string) []int {
+	var line int
+	if _, err := fmt.Sscanf(hunk, "@@ -%d", &line); err != nil {
+		return nil
+	}
+	var removed []int
+	body := hunk[strings.Index(hunk, "\n")+1:]
+	for _, l := range strings.SplitAfter(body, "\n") {
+		switch {
+		case strings.HasPrefix(l, "-"):
+			removed = append(removed, line)
+			line++
+		case strings.HasPrefix(l, " "):
+			line++
+		}
+	}
+	return removed
+}
+
+// blameNote summarizes the blame of lines in path as a single line, e.g.
+// "main.go lines 10-14: recent code, last changed 3 days ago by you"
+func blameNote(path string, lines []int, blame *git.BlameResult, email string, now time.Time) string {
+	var oldest, newest time.Time
+	var authors []string
+	for _, n := range lines {
+		if n < 1 || n > len(blame.Lines) {
+			continue
+		}
+		l := blame.Lines[n-1]
+		if oldest.IsZero() || l.Date.Before(oldest) {
+			oldest = l.Date
+		}
+		if l.Date.After(newest) {
+			newest = l.Date
+		}
+		author := l.AuthorName
+		if email != "" && strings.EqualFold(l.Author, email) {
+			author = "you"
+		}
+		if !slices.Contains(authors, author) {
+			authors = append(authors, author)
+		}
+	}
+	if newest.IsZero() {
+		return ""
+	}
+
+	where := fmt.Sprintf("%s line %d", path, lines[0])
+	if last := lines[len(lines)-1]; last != lines[0] {
+		where = fmt.Sprintf("%s lines %d-%d", path, lines[0], last)
+	}
+	kind := "mixed recent and long-standing code"
+	switch {
+	case now.Sub(oldest) < recentCodeAge:
+		kind = "recent code"
+	case now.Sub(newest) >= recentCodeAge:
+		kind = "long-standing code"
+	}
+	when := "last changed " + ageString(now.Sub(newest))
+	if first := ageString(now.Sub(oldest)); first != ageString(now.Sub(newest)) {
+		when = fmt.Sprintf("changed between %s and %s", first, ageString(now.Sub(newest)))
+	}
+	return fmt.Sprintf("%s: %s, %s by %s", where, kind, when, strings.Join(authors, ", "))
+}
+
+// ageString renders d coarsely, e.g. "today", "3 days ago" or "2 years ago"
+func ageString(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case days < 1:
+		return "today"
+	case days < 60:
+		return plural(days, "day")
+	case days < 730:
+		return plural(days/30, "month")
+	default:
+		return plural(days/365, "year")
+	}
+}
+
+// patchFile is one file's section of a unified diff
+type patchFile struct {
+	path   string   // new path from the diff --git line
+	header string   // everything before the first hunk
+	hunks  []string // each hunk including its @@ line
+}
+
+// parsePatch splits a patch into per-file headers and hunks
+func parsePatch(patch string) []patchFile {
+	var files []patchFile
+	for _, line := range strings.SplitAfter(patch, "\n") {
+		if line == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			path := strings.TrimSpace(line[strings.LastIndex(line, " b/")+3:])
+			files = append(files, patchFile{path: path, header: line})
+		case len(files) == 0:
+			// text before the first file header is not part of any file
+		case strings.HasPrefix(line, "@@"):
+			f := &files[len(files)-1]
+			f.hunks = append(f.hunks, line)
+		default:
+			f := &files[len(files)-1]
+			if len(f.hunks) == 0 {
+				f.header += line
+			} else {
+				f.hunks[len(f.hunks)-1] += line
+			}
+		}
+	}
+	return files
+}
+
+// String reassembles the file's section of the patch
+func (f patchFile) String() string {
+	return f.header + strings.Join(f.hunks, "")
+}
+
+// dropWhitespaceHunks removes the hunks of patch whose removed and added
+// lines are the same once whitespace is ignored, and the files left
+// without hunks. The line counts of the remaining files are updated. A
+// patch without file headers is returned unchanged.
+func dropWhitespaceHunks(patch string, files []stagedFile) (string, []stagedFile) {
+	parsed := parsePatch(patch)
+	if len(parsed) == 0 {
+		return patch, files
+	}
+	var b strings.Builder
+	var kept []stagedFile
+	for _, pf := range parsed {
+		var hunks []string
+		for _, hunk := range pf.hunks {
+			if whitespaceOnly(hunk) {
+				debugLog("Dropping whitespace-only hunk in %s", pf.path)
+				continue
+			}
+			hunks = append(hunks, hunk)
+		}
+		// Files with no hunks at all, like binary notes, are kept as they are
+		if len(pf.hunks) > 0 && len(hunks) == 0 {
+			continue
+		}
+		pf.hunks = hunks
+		b.WriteString(pf.String())
+		for _, f := range files {
+			if f.path == pf.path {
+				if len(hunks) > 0 {
+					f.added, f.removed = countDiffLines(strings.Join(hunks, ""))
+				}
+				kept = append(kept, f)
+			}
+		}
+	}
+	return b.String(), kept
+}
+
+// whitespaceOnly reports whether a hunk's removed and added lines only
+// differ in whitespace, including lines that are blank
+func whitespaceOnly(hunk string) bool {
+	var removed, added strings.Builder
+	for _, line := range strings.Split(hunk, "\n")[1:] {
+		switch {
+		case strings.HasPrefix(line, "-"):
+			removed.WriteString(strings.Join(strings.Fields(line[1:]), ""))
+		case strings.HasPrefix(line, "+"):
+			added.WriteString(strings.Join(strings.Fields(line[1:]), ""))
+		}
+	}
+	return removed.String() == added.String()
+}
+
+// limitHunks keeps the n largest hunks of each file in patch, in their
+// original order, and replaces the rest with a truncation marker saying how
+// much was dropped. A patch without file headers is returned unchanged. It
+// reports whether any hunk was dropped.
+func limitHunks(patch string, n int) (string, bool) {
+	files := parsePatch(patch)
+	if len(files) == 0 {
+		return patch, false
+	}
+	var b strings.Builder
+	dropped := false
+	for _, f := range files {
+		if len(f.hunks) <= n {
+			b.WriteString(f.String())
+			continue
+		}
+		order := make([]int, len(f.hunks))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return strings.Count(f.hunks[order[i]], "\n") > strings.Count(f.hunks[order[j]], "\n")
+		})
+		keep := make(map[int]bool, n)
+		for _, i := range order[:n] {
+			keep[i] = true
+		}
+		b.WriteString(f.header)
+		removed := 0
+		for i, hunk := range f.hunks {
+			if keep[i] {
+				b.WriteString(hunk)
+			} else {
+				removed += strings.Count(hunk, "\n")
+			}
+		}
+		hunks := "1 smaller hunk"
+		if len(f.hunks)-n > 1 {
+			hunks = fmt.Sprintf("%d smaller hunks", len(f.hunks)-n)
+		}
+		b.WriteString(truncationMarker(removed, hunks) + "\n")
+		dropped = true
+	}
+	return b.String(), dropped
+}
+
+// selectFiles lists the files of patch on w and reads the numbers of those
+// to leave out, e.g. "2 4-6", returning the reduced patch and file list
+func selectFiles(patch string, files []stagedFile, r io.Reader, w io.Writer) (string, []stagedFile, error) {
+	parsed := parsePatch(patch)
+	if len(parsed) == 0 {
+		return "", nil, fmt.Errorf("no files to select (summary mode does not include diffs)")
+	}
+
+	fmt.Fprintln(w, "Staged files:")
+	for i, pf := range parsed {
+		status := ""
+		for _, f := range files {
+			if f.path == pf.path {
+				status = fmt.Sprintf("%-8s ", stagingStatusString(f.status))
+			}
+		}
+		fmt.Fprintf(w, "%3d. %s%s\n", i+1, status, pf.path)
+	}
+
+	scanner := bufio.NewScanner(r)
+	var excluded map[int]bool
+	for excluded == nil {
+		fmt.Fprint(w, "Exclude files (numbers or ranges like 2 4-6, empty to keep all): ")
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", nil, fmt.Errorf("failed to read input: %w", err)
+			}
+			excluded = map[int]bool{}
+			break
+		}
+		var err error
+		if excluded, err = parseSelection(scanner.Text(), len(parsed)); err != nil {
+			fmt.Fprintln(w, err)
+		}
+	}
+
+	var result strings.Builder
+	var kept []stagedFile
+	for i, pf := range parsed {
+		if excluded[i+1] {
+			debugLog("Excluding %s", pf.path)
+			continue
+		}
+		result.WriteString(pf.String())
+		for _, f := range files {
+			if f.path == pf.path {
+				kept = append(kept, f)
+			}
+		}
+	}
+	if result.Len() == 0 {
+		return "", nil, fmt.Errorf("all files were excluded")
+	}
+	return result.String(), kept, nil
+}
+
+// parseSelection parses space or comma separated numbers and ranges such
+// as "1 3-5" into the set of selected numbers between 1 and n
+func parseSelection(input string, n int) (map[int]bool, error) {
+	selected := make(map[int]bool)
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ' ' || r == ',' }) {
+		lo, hi, isRange := strings.Cut(field, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", field)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid range: %s", field)
+			}
+		}
+		if first < 1 || last > n || first > last {
+			return nil, fmt.Errorf("out of range: %s (files are numbered 1-%d)", field, n)
+		}
+		for i := first; i <= last; i++ {
+			selected[i] = true
+		}
+	}
+	return selected, nil
+}
+
+// selectHunks walks the hunks of patch, asking on w which ones to keep, and
+// returns the reduced patch together with the files that still have hunks
+func selectHunks(patch string, files []stagedFile, r io.Reader, w io.Writer) (string, []stagedFile, error) {
+	parsed := parsePatch(patch)
+	if len(parsed) == 0 {
+		return "", nil, fmt.Errorf("no hunks to select (summary mode does not include diffs)")
+	}
+
+	scanner := bufio.NewScanner(r)
+	var result strings.Builder
+	var kept []stagedFile
+	quit := false
+	for _, pf := range parsed {
+		var selected []string
+		fileDecision := ""
+		for i, hunk := range pf.hunks {
+			decision := fileDecision
+			for decision == "" && !quit {
+				fmt.Fprintf(w, "\n%s (hunk %d/%d)\n%s", pf.path, i+1, len(pf.hunks), hunk)
+				fmt.Fprint(w, "Include this hunk [y,n,a,d,q,?]? ")
+				if !scanner.Scan() {
+					if err := scanner.Err(); err != nil {
+						return "", nil, fmt.Errorf("failed to read input: %w", err)
+					}
+					quit = true
+					break
+				}
+				switch answer := strings.TrimSpace(scanner.Text()); answer {
+				case "y", "n":
+					decision = answer
+				case "a":
+					decision, fileDecision = "y", "y"
+				case "d":
+					decision, fileDecision = "n", "n"
+				case "q":
+					quit = true
+				default:
+					fmt.Fprintln(w, "y - include this hunk\nn - skip this hunk\na - include this and the remaining hunks in the file\nd - skip this and the remaining hunks in the file\nq - skip all remaining hunks")
+				}
+			}
+			if decision == "y" {
+				selected = append(selected, hunk)
+			}
+		}
+		if len(selected) == 0 {
+			continue
+		}
+		pf.hunks = selected
+		result.WriteString(pf.String())
+		added, removed := countDiffLines(strings.Join(selected, ""))
+		for _, f := range files {
+			if f.path == pf.path {
+				f.added, f.removed = added, removed
+				kept = append(kept, f)
+			}
+		}
+	}
+	return result.String(), kept, nil
+}
+
+func stagingStatusString(status git.StatusCode) string {
+	switch status {
+	case git.Added:
+		return "Added"
+	case git.Modified:
+		return "Modified"
+	case git.Deleted:
+		return "Deleted"
+	case git.Renamed:
+		return "Renamed"
+	case git.Copied:
+		return "Copied"
+	default:
+		return "Unknown"
+	}
+}
+
+// countDiffLines counts the added and removed lines in unified diff content
+func countDiffLines(diff string) (added, removed int) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			// file headers, not content
+		case strings.HasPrefix(line, "+"):
+			added++
+		case strings.HasPrefix(line, "-"):
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// formatDiffStat renders a git-style stat summary of files
+func formatDiffStat(files []stagedFile) string {
+	var b strings.Builder
+	width := 0
+	totalAdded, totalRemoved := 0, 0
+	for _, f := range files {
+		width = max(width, len(f.path))
+		totalAdded += f.added
+		totalRemoved += f.removed
+	}
+	for _, f := range files {
+		fmt.Fprintf(&b, " %-*s | +%d -%d\n", width, f.path, f.added, f.removed)
+	}
+	fmt.Fprintf(&b, " %d %s changed, %d %s(+), %d %s(-)\n",
+		len(files), plural(len(files), "file", "files"),
+		totalAdded, plural(totalAdded, "insertion", "insertions"),
+		totalRemoved, plural(totalRemoved, "deletion", "deletions"))
+	return b.String()
+}
+
+// plural returns singular when n is 1 and pluralForm otherwise
+func plural(n int, singular, pluralForm string) string {
+	if n == 1 {
+		return singular
+	}
+	return pluralForm
+}
+
+// splitLines splits content into lines, dropping the empty element left
+// behind by a trailing newline
+func splitLines(content string) []string {
+	if content == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// diffContextLines is the number of unchanged lines shown around a change
+const diffContextLines = 3
+
+// diffAnalysis records how a change between two line slices was located:
+// the common prefix and suffix are trimmed, and a Myers diff of the lines
+// in between gives the hunks
+type diffAnalysis struct {
+	oldLines     int
+	newLines     int
+	commonPrefix int
+	commonSuffix int
+	removed      int // lines in old between prefix and suffix
+	added        int // lines in new between prefix and suffix
+	hunks        []diffHunk
+}
+
+// diffHunk is one @@ block of a unified diff. Starts are 0-based line
+// indexes and the ranges include context; lines keep their " ", "-" or "+".
+type diffHunk struct {
+	oldStart int
+	oldCount int
+	newStart int
+	newCount int
+	lines    []string
+}
+
+// analyzeDiff finds the common prefix and suffix of oldLines and newLines,
+// diffs the lines in between and groups the changes into hunks with
+// diffContextLines of context, merging hunks whose context would touch or
+// overlap, as git does
+func analyzeDiff(oldLines, newLines []string) diffAnalysis {
+	a := diffAnalysis{oldLines: len(oldLines), newLines: len(newLines)}
+
+	// Find common prefix and suffix
+	minLen := min(len(oldLines), len(newLines))
+	for a.commonPrefix < minLen && oldLines[a.commonPrefix] == newLines[a.commonPrefix] {
+		a.commonPrefix++
+	}
+	for a.commonSuffix < (minLen-a.commonPrefix) &&
+		oldLines[len(oldLines)-1-a.commonSuffix] == newLines[len(newLines)-1-a.commonSuffix] {
+		a.commonSuffix++
+	}
+	a.removed = len(oldLines) - a.commonPrefix - a.commonSuffix
+	a.added = len(newLines) - a.commonPrefix - a.commonSuffix
+	if a.removed == 0 && a.added == 0 {
+		return a
+	}
+
+	// Compare lines as small integers rather than strings
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	oldIDs, newIDs := intern(oldLines), intern(newLines)
+	removed := make([]bool, len(oldLines))
+	added := make([]bool, len(newLines))
+	oldEnd := len(oldLines) - a.commonSuffix
+	newEnd := len(newLines) - a.commonSuffix
+	myersDiff(oldIDs[a.commonPrefix:oldEnd], newIDs[a.commonPrefix:newEnd],
+		removed[a.commonPrefix:oldEnd], added[a.commonPrefix:newEnd])
+	compactChanges(oldIDs, removed, added)
+	compactChanges(newIDs, added, removed)
+
+	// Lay out the edit script, removals before additions in each change
+	type edit struct {
+		op       byte
+		old, new int // line positions before the edit
+	}
+	var edits []edit
+	var changed []int // indexes into edits
+	for i, j := 0, 0; i < len(oldLines) || j < len(newLines); {
+		switch {
+		case i < len(oldLines) && removed[i]:
+			changed = append(changed, len(edits))
+			edits = append(edits, edit{'-', i, j})
+			i++
+		case j < len(newLines) && added[j]:
+			changed = append(changed, len(edits))
+			edits = append(edits, edit{'+', i, j})
+			j++
+		default:
+			edits = append(edits, edit{' ', i, j})
+			i++
+			j++
+		}
+	}
+
+	for first := 0; first < len(changed); {
+		last := first
+		for last+1 < len(changed) && changed[last+1]-changed[last]-1 <= 2*diffContextLines {
+			last++
+		}
+		from := max(changed[first]-diffContextLines, 0)
+		to := min(changed[last]+1+diffContextLines, len(edits))
+		h := diffHunk{oldStart: edits[from].old, newStart: edits[from].new}
+		for _, e := range edits[from:to] {
+			switch e.op {
+			case '-':
+				h.oldCount++
+				h.lines = append(h.lines, "-"+oldLines[e.old])
+			case '+':
+				h.newCount++
+				h.lines = append(h.lines, "+"+newLines[e.new])
+			default:
+				h.oldCount++
+				h.newCount++
+				h.lines = append(h.lines, " "+oldLines[e.old])
+			}
+		}
+		a.hunks = append(a.hunks, h)
+		first = last + 1
+	}
+	return a
+}
+
+// myersDiff marks the elements of a to remove and of b to add for a
+// shortest edit script turning a into b. It uses the linear-space variant
+// of Myers' algorithm: find where the forward and backward searches meet,
+// then diff the two halves on either side of that point.
+func myersDiff(a, b []int, removed, added []bool) {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b, removed, added = a[1:], b[1:], removed[1:], added[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b, removed, added = a[:len(a)-1], b[:len(b)-1], removed[:len(removed)-1], added[:len(added)-1]
+	}
+	if len(a) == 0 || len(b) == 0 {
+		for i := range removed {
+			removed[i] = true
+		}
+		for i := range added {
+			added[i] = true
+		}
+		return
+	}
+	x, y := myersSplit(a, b)
+	if (x == 0 && y == 0) || (x == len(a) && y == len(b)) {
+		// No common line to split on
+		for i := range removed {
+			removed[i] = true
+		}
+		for i := range added {
+			added[i] = true
+		}
+		return
+	}
+	myersDiff(a[:x], b[:y], removed[:x], added[:y])
+	myersDiff(a[x:], b[y:], removed[x:], added[y:])
+}
+
+// myersSplit searches from both ends of a and b at once and returns the
+// point where a shortest edit path crosses from the forward search into the
+// backward one, or (0, 0) when they have nothing in common. Diagonals that
+// run off the edit graph are dropped from the search as it goes.
+func myersSplit(a, b []int) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+	delta := n - m
+	// With an odd delta the paths meet on a forward step, otherwise on a
+	// backward one
+	odd := delta%2 != 0
+	var fStart, fEnd, bStart, bEnd int
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				i := offset + delta - k
+				if i >= 0 && i < len(backward) && backward[i] != -1 && x >= n-backward[i] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				i := offset + delta - k
+				if i >= 0 && i < len(forward) && forward[i] != -1 {
+					fx := forward[i]
+					if fx >= n-x {
+						return fx, offset + fx - i
+					}
+				}
+			}
+		}
+	}
+	return 0, 0
+}
+
+// compactChanges slides each run of changed lines in one file as far down
+// as it can go without changing the diff, merging runs that meet, and then
+// back up to line up with a change in the other file if it passed one. This
+// is git's change compaction without the indent heuristic, so that an
+// ambiguous change, such as a duplicated line removed, is placed where git
+// would place it. Runs are delimited by unchanged lines, which pair up
+// between the two files, so the nth run of each file correspond.
+func compactChanges(lines []int, changed, other []bool) {
+	isChanged := func(flags []bool, i int) bool { return i >= 0 && i < len(flags) && flags[i] }
+	// A group is the run [start, end) before an unchanged line, maybe empty
+	next := func(flags []bool, start, end int) (int, int, bool) {
+		if end >= len(flags) {
+			return start, end, false
+		}
+		start = end + 1
+		end = start
+		for isChanged(flags, end) {
+			end++
+		}
+		return start, end, true
+	}
+	previous := func(flags []bool, start, end int) (int, int) {
+		end = start - 1
+		start = end
+		for isChanged(flags, start-1) {
+			start--
+		}
+		return start, end
+	}
+	slideDown := func(start, end int) (int, int, bool) {
+		if end >= len(lines) || lines[start] != lines[end] {
+			return start, end, false
+		}
+		changed[start], changed[end] = false, true
+		start, end = start+1, end+1
+		for isChanged(changed, end) {
+			end++
+		}
+		return start, end, true
+	}
+	slideUp := func(start, end int) (int, int, bool) {
+		if start == 0 || lines[start-1] != lines[end-1] {
+			return start, end, false
+		}
+		start, end = start-1, end-1
+		changed[start], changed[end] = true, false
+		for isChanged(changed, start-1) {
+			start--
+		}
+		return start, end, true
+	}
+
+	start, end := 0, 0
+	for isChanged(changed, end) {
+		end++
+	}
+	oStart, oEnd := 0, 0
+	for isChanged(other, oEnd) {
+		oEnd++
+	}
+	for {
+		if end > start {
+			var earliestEnd int
+			endMatchingOther := -1
+			for size := -1; size != end-start; {
+				size = end - start
+				for ok := true; ok; {
+					if start, end, ok = slideUp(start, end); ok {
+						oStart, oEnd = previous(other, oStart, oEnd)
+					}
+				}
+				earliestEnd = end
+				if oEnd > oStart {
+					endMatchingOther = end
+				}
+				for ok := true; ok; {
+					if start, end, ok = slideDown(start, end); ok {
+						oStart, oEnd, _ = next(other, oStart, oEnd)
+						if oEnd > oStart {
+							endMatchingOther = end
+						}
+					}
+				}
+			}
+			if end != earliestEnd && endMatchingOther != -1 {
+				for oEnd == oStart {
+					start, end, _ = slideUp(start, end)
+					oStart, oEnd = previous(other, oStart, oEnd)
+				}
+			}
+		}
+		var ok bool
+		if start, end, ok = next(changed, start, end); !ok {
+			return
+		}
+		oStart, oEnd, _ = next(other, oStart, oEnd)
+	}
+}
+
+// String renders the analysis as structured text for -debug-diff
+func (a diffAnalysis) String() string {
+	if a.removed == 0 && a.added == 0 {
+		return fmt.Sprintf("old lines: %d, new lines: %d, no changes\n", a.oldLines, a.newLines)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "old lines: %d, new lines: %d\n"+
+		"common prefix: %d, common suffix: %d\n"+
+		"removed: old %d-%d (%d lines)\n"+
+		"added: new %d-%d (%d lines)\n",
+		a.oldLines, a.newLines,
+		a.commonPrefix, a.commonSuffix,
+		a.commonPrefix+1, a.commonPrefix+a.removed, a.removed,
+		a.commonPrefix+1, a.commonPrefix+a.added, a.added)
+	for _, h := range a.hunks {
+		fmt.Fprintf(&b, "hunk: %s\n", h.header())
+	}
+	return b.String()
+}
+
+// header returns the hunk's "@@ -start,count +start,count @@" line as git
+// writes it: a count of 1 is left out, and an empty range starts at the
+// line before it
+func (h diffHunk) header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.oldStart, h.oldCount), hunkRange(h.newStart, h.newCount))
+}
+
+// hunkRange formats one side of a hunk header from its 0-based start
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// funcContextPatterns match lines that open a function or type in Go,
+// Python, JavaScript/TypeScript, Rust and Ruby
+var funcContextPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^func\b`),
+	regexp.MustCompile(`^type\s+\w+`),
+	regexp.MustCompile(`^\s*(async\s+)?def\s+\w+`),
+	regexp.MustCompile(`^\s*class\s+\w+`),
+	regexp.MustCompile(`^\s*(export\s+)?(default\s+)?(async\s+)?function\b`),
+	regexp.MustCompile(`^\s*(export\s+)?(default\s+)?(abstract\s+)?class\s+\w+`),
+	regexp.MustCompile(`^\s*(pub(\([^)]*\))?\s+)?(async\s+)?(unsafe\s+)?fn\s+\w+`),
+	regexp.MustCompile(`^\s*(pub(\([^)]*\))?\s+)?(struct|enum|trait|impl)\b`),
+	regexp.MustCompile(`^\s*(module|def)\s+\S+`),
+}
+
+// maxFuncContext caps the function context length, as git does
+const maxFuncContext = 80
+
+// funcContext returns the nearest line in lines, searching backwards from
+// the end, that looks like a function or type declaration
+func funcContext(lines []string) string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		for _, pattern := range funcContextPatterns {
+			if pattern.MatchString(lines[i]) {
+				line := strings.TrimSpace(lines[i])
+				if len(line) > maxFuncContext {
+					line = line[:maxFuncContext]
+				}
+				return line
+			}
+		}
+	}
+	return ""
+}
+
+// generateUnifiedDiffContent creates a unified diff from two strings, with
+// a hunk for each group of changes like git diff
+func generateUnifiedDiffContent(oldContent, newContent string) string {
+	oldLines := splitLines(oldContent)
+	newLines := splitLines(newContent)
+
+	var result strings.Builder
+	for _, h := range analyzeDiff(oldLines, newLines).hunks {
+		// Write hunk header, followed like git by the enclosing function
+		result.WriteString(h.header())
+		if fn := funcContext(oldLines[:h.oldStart]); fn != "" {
+			result.WriteString(" " + fn)
+		}
+		result.WriteString("\n")
+		for _, line := range h.lines {
+			result.WriteString(line + "\n")
+		}
+	}
+	return result.String()
+}
+
+// diffFormats lists the ways diff_format can render a file's changes
+var diffFormats = []string{"unified", "side-by-side", "before-after"}
+
+// renderDiff rewrites the hunks of a unified diff in the given diff_format.
+// Unified diffs are returned unchanged.
+func renderDiff(diff, format string) string {
+	if format == "" || format == "unified" || diff == "" {
+		return diff
+	}
+	var hunks []string
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(line, "@@") || len(hunks) == 0 {
+			hunks = append(hunks, line)
+		} else {
+			hunks[len(hunks)-1] += line
+		}
+	}
+	var b strings.Builder
+	if format == "side-by-side" {
+		b.WriteString("(old on the left, new on the right; | changed, < removed, > added)\n")
+	}
+	for _, hunk := range hunks {
+		if !strings.HasPrefix(hunk, "@@") {
+			// File headers before the first hunk are kept as they are
+			b.WriteString(hunk)
+			continue
+		}
+		if format == "side-by-side" {
+			b.WriteString(sideBySide(hunk))
+		} else {
+			b.WriteString(beforeAfter(hunk))
+		}
+	}
+	return b.String()
+}
+
+// renderPatch applies diff_format to each file of a patch, keeping the
+// file headers. A patch without diff --git headers, like the diff of two
+// files, is rendered as one file.
+func renderPatch(patch, format string) string {
+	parsed := parsePatch(patch)
+	if len(parsed) == 0 {
+		return renderDiff(patch, format)
+	}
+	var b strings.Builder
+	for _, f := range parsed {
+		b.WriteString(f.header)
+		b.WriteString(renderDiff(strings.Join(f.hunks, ""), format))
+	}
+	return b.String()
+}
+
+// hunkStarts returns the old and new start lines of a hunk header. The
+// line counts are optional, as in "@@ -3 +3 @@" for a one-line hunk.
+func hunkStarts(header string) (oldStart, newStart int, ok bool) {
+	fields := strings.Fields(header)
+	if len(fields) < 4 || fields[0] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return 0, 0, false
+	}
+	oldField, _, _ := strings.Cut(fields[1][1:], ",")
+	newField, _, _ := strings.Cut(fields[2][1:], ",")
+	oldStart, oldErr := strconv.Atoi(oldField)
+	newStart, newErr := strconv.Atoi(newField)
+	return oldStart, newStart, oldErr == nil && newErr == nil
+}
+
+// hunkLines splits a unified diff hunk into its header and body lines,
+// dropping "\ No newline at end of file" markers
+func hunkLines(hunk string) (header string, lines []string) {
+	all := strings.Split(strings.TrimSuffix(hunk, "\n"), "\n")
+	for _, line := range all[1:] {
+		if !strings.HasPrefix(line, "\\") {
+			lines = append(lines, line)
+		}
+	}
+	return all[0], lines
+}
+
+// beforeAfter renders a hunk as the lines it covers before and after the
+// change, leaving out a side that is empty, as for a new file
+func beforeAfter(hunk string) string {
+	header, lines := hunkLines(hunk)
+	oldStart, newStart, ok := hunkStarts(header)
+	if !ok {
+		return hunk
+	}
+	var before, after []string
+	for _, line := range lines {
+		if line == "" {
+			line = " "
+		}
+		switch line[0] {
+		case '-':
+			before = append(before, line[1:])
+		case '+':
+			after = append(after, line[1:])
+		default:
+			before = append(before, line[1:])
+			after = append(after, line[1:])
+		}
+	}
+	var b strings.Builder
+	if len(before) > 0 {
+		fmt.Fprintf(&b, "Before (lines %d-%d):\n%s\n", oldStart, oldStart+len(before)-1, strings.Join(before, "\n"))
+	}
+	if len(after) > 0 {
+		fmt.Fprintf(&b, "After (lines %d-%d):\n%s\n", newStart, newStart+len(after)-1, strings.Join(after, "\n"))
+	}
+	return b.String()
+}
+
+// sideBySide renders a hunk in two columns like diff -y: unchanged lines
+// on both sides, removed lines paired with the added lines that replace
+// them, and the rest marked as only removed or only added
+func sideBySide(hunk string) string {
+	header, lines := hunkLines(hunk)
+	type row struct {
+		left, gutter, right string
+	}
+	var rows []row
+	var removed, added []string
+	flush := func() {
+		for i := range max(len(removed), len(added)) {
+			switch {
+			case i < len(removed) && i < len(added):
+				rows = append(rows, row{removed[i], "|", added[i]})
+			case i < len(removed):
+				rows = append(rows, row{removed[i], "<", ""})
+			default:
+				rows = append(rows, row{"", ">", added[i]})
+			}
+		}
+		removed, added = nil, nil
+	}
+	for _, line := range lines {
+		if line == "" {
+			line = " "
+		}
+		switch line[0] {
+		case '-':
+			if len(added) > 0 {
+				flush()
+			}
+			removed = append(removed, line[1:])
+		case '+':
+			added = append(added, line[1:])
+		default:
+			flush()
+			rows = append(rows, row{line[1:], " ", line[1:]})
+		}
+	}
+	flush()
+
+	width := 0
+	for _, r := range rows {
+		width = max(width, utf8.RuneCountInString(r.left))
+	}
+	var b strings.Builder
+	b.WriteString(header + "\n")
+	for _, r := range rows {
+		pad := strings.Repeat(" ", width-utf8.RuneCountInString(r.left))
+		b.WriteString(strings.TrimRight(r.left+pad+" "+r.gutter+" "+r.right, " ") + "\n")
+	}
+	return b.String()
+}
+
+// diffFiles produces a unified diff between two files on disk
+func diffFiles(oldPath, newPath string) (string, error) {
+	var contents [2]string
+	for i, path := range []string{oldPath, newPath} {
+		binary, err := isBinary(path)
+		if err != nil {
+			return "", err
+		}
+		if binary {
+			return "", fmt.Errorf("%s appears to be a binary file", path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		contents[i] = string(data)
+	}
+
+	diffContent := generateUnifiedDiffContent(contents[0], contents[1])
+	if diffContent == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("--- %s\n+++ %s\n%s", oldPath, newPath, diffContent), nil
+}
+
+const commitInstructions = `You are a helpful assistant that writes git commit messages.
+Based on the following staged changes, generate a properly formatted git commit message.
+
+Format requirements:
+- First line: Short summary (50-72 chars) describing WHAT changed and WHY
+- Second line: Blank line
+- Following lines: More detailed explanation of the changes, their purpose and impact
+- Output ONLY the commit message in plain text, without markdown code blocks or formatting
+
+`
+
+const conventionalInstructions = `You are a helpful assistant that writes git commit messages.
+Based on the following staged changes, generate a commit message following the Conventional Commits specification.
+
+Format requirements:
+- First line: "type(scope): summary" (50-72 chars), e.g. "fix(auth): reject expired tokens"; omit "(scope)" if no scope fits
+- Pick the type from the diff: feat for new behavior, fix for bug fixes, docs for documentation only, refactor for restructuring without behavior changes, test for tests only, chore for build, dependency and other maintenance
+- Second line: Blank line
+- Following lines: More detailed explanation of the changes, their purpose and impact
+- If the changes break existing users (removed or renamed options, changed defaults or formats), add "!" after the type or scope and end with a "BREAKING CHANGE: <what breaks and how to migrate>" footer; otherwise add no footer
+- Output ONLY the commit message in plain text, without markdown code blocks or formatting
+
+`
+
+// bodyFormats are the -body-format rules added to the commit prompt; they
+// take precedence over the body guidance in the format requirements
+var bodyFormats = map[string]string{
+	"prose": `Body format (overrides the above): write the explanation as one or two short paragraphs of plain English prose, without bullet points or headings.
+
+`,
+	"bullets": `Body format (overrides the above): write the explanation as a bulleted list, one "- " item per notable change, without introductory paragraphs.
+
+`,
+	"none": `Body format (overrides the above): output only the first line, with no blank line and no explanation after it.
+
+`,
+}
+
+// promptPresets are built-in prompt templates selected with -preset. They
+// receive the same data as model_prompts templates.
+var promptPresets = map[string]string{
+	"concise": `Write a git commit message for the staged changes below.
+Output a single summary line of at most 50 characters in the imperative mood
+("Add", "Fix", "Remove"), optionally followed by a blank line and at most two
+short sentences explaining why. Output only the commit message, without
+markdown.
+{{if .Languages}}
+Languages: {{.Languages}}
+{{end}}{{if .Focus}}
+These changes primarily affect: {{.Focus}}
+{{end}}
+Staged changes:
+{{.Changes}}
+
+Generate the commit message:`,
+
+	"detailed": `You are a helpful assistant that writes thorough git commit messages.
+Format requirements:
+- First line: summary of at most 72 characters in the imperative mood
+- Second line: blank
+- Then a paragraph explaining the motivation for the change
+- Then a bulleted list of the notable changes, one per logical change
+- Mention any behavior changes, migrations or follow-up work
+- Output only the commit message in plain text, without markdown code blocks
+{{if .Author}}
+Author: {{.Author}}{{if .AuthorDate}}
+Date: {{.AuthorDate}}{{end}}
+{{end}}{{if .Languages}}
+Languages: {{.Languages}}
+{{end}}{{if .Focus}}
+These changes primarily affect: {{.Focus}}
+{{end}}{{if .Blame}}
+Blame of the changed lines ("you" is the author of these changes):
+<<<
+{{.Blame}}
+>>>
+{{end}}{{if .Background}}
+Background (use this to understand the intent, do not describe it):
+<<<
+{{.Background}}
+>>>
+{{end}}{{if .CommandOutput}}
+Command output (build or test results to ground the description, do not describe it):
+<<<
+{{.CommandOutput}}
+>>>
+{{end}}
+Staged changes:
+{{.Changes}}
+
+Generate the commit message:`,
+
+	"conventional": `Write a commit message for the staged changes below following the
+Conventional Commits specification.
+Format requirements:
+- First line: "type(scope): summary" of at most 72 characters, where type is one of
+  feat, fix, docs, style, refactor, perf, test, build, ci or chore; omit "(scope)" if no scope fits
+- Second line: blank
+- Then a short explanation of what changed and why
+- For breaking changes, end with a "BREAKING CHANGE: <description>" footer
+- Output only the commit message in plain text, without markdown
+{{if .Scope}}
+Suggested scope: {{.Scope}}
+{{end}}
+Staged changes:
+{{.Changes}}
+
+Generate the commit message:`,
+
+	"angular": `Write a commit message for the staged changes below following the Angular
+commit message convention.
+Format requirements:
+- Header: "<type>(<scope>): <short summary>", at most 100 characters
+- type is one of build, ci, docs, feat, fix, perf, refactor or test
+- The summary uses the imperative, present tense, is not capitalized and has no period at the end
+- Blank line, then a body in the imperative explaining the motivation and contrasting with the previous behavior
+- Footer for "BREAKING CHANGE: ..." or "Closes #..." when applicable
+- Output only the commit message in plain text, without markdown
+{{if .Scope}}
+Suggested scope: {{.Scope}}
+{{end}}
+Staged changes:
+{{.Changes}}
+
+Generate the commit message:`,
+}
+
+// presetNames returns the available preset names in sorted order
+func presetNames() []string {
+	names := make([]string, 0, len(promptPresets))
+	for name := range promptPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const explainInstructions = `You are a helpful assistant that reviews code changes.
+The following diff compares two versions of a file. Explain what changed between them.
+
+Format requirements:
+- Start with a one-sentence summary of the change
+- Follow with a short explanation of the notable differences and their likely impact
+- Output plain text, without markdown code blocks or formatting
+
+`
+
+const prInstructions = `You are a helpful assistant that writes pull request descriptions.
+Based on the following changes, write a description for a pull request.
+
+Format requirements:
+- Start with a one-line title
+- Follow with a short summary of what changed and why
+- Then list notable details reviewers should pay attention to as bullet points
+- Do not include a file list or line counts, these are added separately
+- Output only the description, without code blocks
+
+`
+
+// reviewSeparator divides the message from the observations in -review mode
+const reviewSeparator = "--- Observations ---"
+
+const reviewInstructions = `After the message, add a line containing exactly "` + reviewSeparator + `"
+followed by a short bulleted list of potential issues, mistakes or leftover TODOs you noticed
+in the changes. Write "- None" if there are none.
+
+`
+
+// splitObservations separates a -review response into the message and the
+// observations that follow reviewSeparator
+func splitObservations(response string) (message, observations string) {
+	message, observations, _ = strings.Cut(response, reviewSeparator)
+	return strings.TrimSpace(message), strings.TrimSpace(observations)
+}
+
+// analysisSeparator divides the response from the classification used for
+// -trailers-from-analysis
+const analysisSeparator = "--- Analysis ---"
+
+const analysisInstructions = `At the very end of your response, add a line containing exactly "` + analysisSeparator + `"
+followed by these two lines:
+Change-Type: one of feature, fix, refactor, perf, docs, test, build or chore
+Affected-Components: comma-separated lowercase names of the components or modules changed
+
+`
+
+// changeTypes are the Change-Type trailer values the model may choose from
+var changeTypes = []string{"feature", "fix", "refactor", "perf", "docs", "test", "build", "chore"}
+
+// trailer is one "Key: value" line at the end of a commit message
+type trailer struct {
+	key   string
+	value string
+}
+
+// splitAnalysis separates the response from the analysis that follows
+// analysisSeparator and turns it into trailers. Values outside the expected
+// form are dropped rather than passed on to tools that parse them.
+func splitAnalysis(response string) (string, []trailer) {
+	message, analysis, found := strings.Cut(response, analysisSeparator)
+	if !found {
+		debugLog("Response has no analysis section")
+		return strings.TrimSpace(response), nil
+	}
+	var trailers []trailer
+	for _, line := range strings.Split(analysis, "\n") {
+		key, value, ok := strings.Cut(strings.Trim(strings.TrimSpace(line), "-*` "), ":")
+		if !ok {
+			continue
+		}
+		value = strings.ToLower(strings.Trim(strings.TrimSpace(value), "`*"))
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "change-type":
+			if slices.Contains(changeTypes, value) {
+				trailers = append(trailers, trailer{"Change-Type", value})
+			}
+		case "affected-components":
+			var components []string
+			for _, c := range strings.Split(value, ",") {
+				if c = strings.TrimSpace(c); c != "" && !slices.Contains(components, c) {
+					components = append(components, c)
+				}
+			}
+			if len(components) > 0 {
+				trailers = append(trailers, trailer{"Affected-Components", strings.Join(components, ",")})
+			}
+		}
+	}
+	return strings.TrimSpace(message), trailers
+}
+
+// trailerLine matches a git trailer such as "Signed-off-by: Name <email>"
+var trailerLine = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*: \S`)
+
+// appendTrailers adds trailers to the end of message, joining an existing
+// trailer block or starting a new paragraph as git interpret-trailers does
+func appendTrailers(message string, trailers []trailer) string {
+	if len(trailers) == 0 {
+		return message
+	}
+	var lines []string
+	for _, t := range trailers {
+		lines = append(lines, t.key+": "+t.value)
+	}
+	message = strings.TrimRight(message, "\n")
+	paragraphs := strings.Split(message, "\n\n")
+	last := paragraphs[len(paragraphs)-1]
+	inTrailers := len(paragraphs) > 1
+	for _, line := range strings.Split(last, "\n") {
+		if !trailerLine.MatchString(line) {
+			inTrailers = false
+		}
+	}
+	if inTrailers {
+		return message + "\n" + strings.Join(lines, "\n")
+	}
+	return message + "\n\n" + strings.Join(lines, "\n")
+}
+
+// trailerMap returns trailers keyed by name for -json output
+func trailerMap(trailers []trailer) map[string]string {
+	if len(trailers) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(trailers))
+	for _, t := range trailers {
+		m[t.key] = t.value
+	}
+	return m
+}
+
+const noteInstructions = `You are a helpful assistant that explains code changes.
+Based on the following changes, write a note that will be attached to the commit for later reference.
+
+Format requirements:
+- Explain what changed, why it was likely done, and anything a future reader should know
+- Do not write a commit subject line; use short paragraphs or bullet points
+- Output only the note in plain text, without markdown code blocks
+
+`
+
+// reviewMarkdownInstructions asks for the summary that heads -output review-md
+const reviewMarkdownInstructions = `You are a helpful assistant that summarizes code changes for reviewers.
+Based on the following changes, write a summary to post with a code review.
+
+Format requirements:
+- Start with a one-line title
+- Follow with a short summary of what changed and why
+- Then list what reviewers should look at closely as bullet points
+- Do not include the diff or a file list, these are added separately
+- Markdown is fine, but do not use headings or code blocks
+
+`
+
+// reviewMarkdown renders the -output review-md document: the summary with
+// its first line as a heading, then the diff of each file in a collapsible
+// section so reviewers can expand only what they need
+func reviewMarkdown(summary, changes string, files []stagedFile) string {
+	title, body := splitMessage(summary)
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s\n\n", strings.TrimLeft(title, "# "))
+	if body != "" {
+		b.WriteString(body + "\n\n")
+	}
+	b.WriteString("### Changes\n")
+	sections := parsePatch(changes)
+	if len(sections) == 0 {
+		// A summary without per-file diffs goes in as one block
+		fmt.Fprintf(&b, "\n%s\n", fencedBlock("", changes))
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+	for _, f := range sections {
+		diff := f.String()
+		added, removed := countDiffLines(diff)
+		if i := slices.IndexFunc(files, func(s stagedFile) bool { return s.path == f.path }); i >= 0 {
+			added, removed = files[i].added, files[i].removed
+		}
+		fmt.Fprintf(&b, "\n<details>\n<summary>%s (+%d -%d)</summary>\n\n%s\n\n</details>\n", html.EscapeString(f.path), added, removed, fencedBlock("diff", diff))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// fencedBlock wraps text in a markdown code fence longer than any run of
+// backticks inside it
+func fencedBlock(lang, text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + lang + "\n" + strings.TrimRight(text, "\n") + "\n" + fence
+}
+
+// contextBudget returns how many of maxLines are left for extra prompt
+// context once the texts already in the prompt are counted, 0 meaning no
+// limit as for maxLines. ok is false when maxLines is set and nothing is
+// left, so the context has to be left out.
+func contextBudget(maxLines int, used ...string) (budget int, ok bool) {
+	if maxLines <= 0 {
+		return 0, true
+	}
+	budget = maxLines
+	for _, text := range used {
+		budget -= strings.Count(text, "\n")
+	}
+	return max(budget, 0), budget > 0
+}
+
+// maxContextFileBytes caps how much of a -context-from file is sent
+const maxContextFileBytes = 16 * 1024
+
+// readContextFile reads background text for the prompt, truncated to
+// maxContextFileBytes and, when maxLines is positive, to maxLines lines so
+// it shares the line budget with the diff. It reports whether the text was
+// cut.
+func readContextFile(path string, maxLines int) (string, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	text, truncated := truncateContext(string(data), maxLines)
+	if truncated {
+		debugLog("Context file %s truncated", path)
+	}
+	return text, truncated, nil
+}
+
+// truncateContext trims text to maxContextFileBytes and, when maxLines is
+// positive, to maxLines lines, marking where it was cut
+func truncateContext(text string, maxLines int) (string, bool) {
+	text = strings.TrimSpace(text)
+	total := len(splitLines(text))
+	truncated := false
+	if len(text) > maxContextFileBytes {
+		text = text[:maxContextFileBytes]
+		truncated = true
+	}
+	if maxLines > 0 {
+		lines := strings.SplitAfter(text, "\n")
+		if len(lines) > maxLines {
+			text = strings.Join(lines[:maxLines], "")
+			truncated = true
+		}
+	}
+	if truncated {
+		text = strings.TrimSpace(text) + "\n" + truncationMarker(total-len(splitLines(text)), "")
+	}
+	return text, truncated
+}
+
+// truncationMarker stands in for lines left out of the prompt, so the model
+// knows it is not seeing everything. detail, when set, says what was cut.
+func truncationMarker(lines int, detail string) string {
+	count := fmt.Sprintf("%d lines", lines)
+	if lines == 1 {
+		count = "1 line"
+	}
+	if detail != "" {
+		return fmt.Sprintf("[... %s truncated (%s) ...]", count, detail)
+	}
+	return fmt.Sprintf("[... %s truncated ...]", count)
+}
+
+// truncationNote is added to the prompt when any part of it was truncated
+const truncationNote = "Some content was left out of this prompt to fit the size limits, either marked with \"[... N lines truncated ...]\" or listed without its diff. Only describe what you can see, and don't guess at what was omitted."
+
+// runContextCommand runs command through the shell in dir and returns its
+// standard output for the prompt, truncated like a context file. A
+// non-zero exit status is expected for failing builds and tests, so it is
+// noted in the output rather than treated as an error. It reports whether
+// the output was cut.
+func runContextCommand(ctx context.Context, command, dir string, timeout time.Duration, maxLines int) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	debugLog("Running context command: %s", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	// Children of the shell can keep stdout open after it is killed
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", false, fmt.Errorf("timed out after %s", timeout)
+	}
+	var exitErr *exec.ExitError
+	status := ""
+	if errors.As(err, &exitErr) {
+		status = fmt.Sprintf("\n[exit status %d]", exitErr.ExitCode())
+	} else if err != nil {
+		return "", false, err
+	}
+	text, truncated := truncateContext(string(out), maxLines)
+	return text + status, truncated, nil
+}
+
+// promptData holds the values that are substituted into the prompt. Its
+// fields are what prompt templates can use, as listed in the README.
+type promptData struct {
+	Changes    string
+	Files      []string // paths of the changed files
+	FileCount  int
+	Added      int    // lines added across all files
+	Removed    int    // lines removed across all files
+	DiffStat   string // git diff --stat style summary
+	Branch     string // checked-out branch, empty when detached or outside git
+	Author     string // "Name <email>", empty when author context is disabled
+	AuthorDate string // RFC 3339 author date of an existing commit, empty for staged changes
+	Languages  string // comma-separated languages of the changed files
+	Focus      string // directory most of the changes are in, when focus_hint is set
+	Owners     string // CODEOWNERS owners of the changed files, when codeowners is set
+	Template   string // git's commit.template, when use_git_template is set
+	Blame      string // age and authors of the lines each hunk changes, when blame_context is set
+	Stash      string // where staged and -with-stash changes overlap
+	Shallow    string // note that the described commit's parent is missing from a shallow clone
+	Background string // free-form context supplied with -context-from
+	// Output of context_command, e.g. build or test results
+	CommandOutput string
+	Scope         string // conventional commit scope, forced or inferred
+	// Some of the above was cut or summarized to fit the size limits
+	Truncated bool
+}
+
+// buildPrompt assembles the prompt sent to the model
+func buildPrompt(cfg config, data promptData) (string, error) {
+	var b strings.Builder
+	// A one-off prompt file is sent as written, plus what the enabled
+	// options need
+	if cfg.promptFile != "" {
+		if err := cfg.promptTemplate.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("failed to render prompt file: %w", err)
+		}
+		writeTemplateExtras(&b, cfg, data)
+		return b.String(), nil
+	}
+	if cfg.promptPrefix != "" {
+		b.WriteString(strings.TrimSpace(cfg.promptPrefix) + "\n\n")
+	}
+	if cfg.promptTemplate != nil && cfg.output == "commit" && len(cfg.compareFiles) == 0 {
+		if err := cfg.promptTemplate.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("failed to render prompt template: %w", err)
+		}
+		writeTemplateExtras(&b, cfg, data)
+	} else {
+		writeDefaultPrompt(&b, cfg, data)
+	}
+
+	var suffix []string
+	if cfg.promptSuffix != "" {
+		suffix = append(suffix, strings.TrimSpace(cfg.promptSuffix))
+	}
+	suffix = append(suffix, cfg.instructions...)
+	if len(suffix) > 0 {
+		b.WriteString("\n\n" + strings.Join(suffix, "\n"))
+	}
+
+	if data.Truncated {
+		b.WriteString("\n\n" + truncationNote)
+	}
+
+	// Models drift from the subject length rule stated at the top of a long
+	// prompt, so repeat it where they will read it last
+	if cfg.output == "commit" && len(cfg.compareFiles) == 0 && cfg.subjectReminderLines > 0 &&
+		strings.Count(data.Changes, "\n") >= cfg.subjectReminderLines {
+		b.WriteString("\n\n" + subjectReminder)
+	}
+	return b.String(), nil
+}
+
+// defaultSubjectReminderLines is the diff size from which subjectReminder is
+// added to the prompt
+const defaultSubjectReminderLines = 400
+
+// subjectReminder restates the subject length rule after a long diff
+const subjectReminder = "IMPORTANT: however large the diff, the first line must be a single summary of at most 72 characters. Put the details in the body."
+
+// stashSection and blameSection present the -with-stash overlaps and the
+// blame context in the prompt
+const (
+	stashSection = "The changes combine staged work with a stash. Where both edit the same lines, applying them together may conflict; mention it if it matters:\n<<<\n%s\n>>>\n\n"
+	blameSection = "Blame of the changed lines (\"you\" is the author of these changes; tell fixes to recently written code apart from changes to long-standing code, do not list this):\n<<<\n%s\n>>>\n\n"
+)
+
+// writeTemplateExtras follows a rendered template or prompt file with what
+// the built-in prompt would include for the enabled options: the stash and
+// blame context when the template left them out, and the response format
+// that -review and -trailers-from-analysis read back
+func writeTemplateExtras(b *strings.Builder, cfg config, data promptData) {
+	rendered := b.String()
+	var extra strings.Builder
+	if data.Stash != "" && !strings.Contains(rendered, data.Stash) {
+		fmt.Fprintf(&extra, stashSection, data.Stash)
+	}
+	if data.Blame != "" && !strings.Contains(rendered, data.Blame) {
+		fmt.Fprintf(&extra, blameSection, data.Blame)
+	}
+	if cfg.review {
+		extra.WriteString(reviewInstructions)
+	}
+	if cfg.trailersFromAnalysis {
+		extra.WriteString(analysisInstructions)
+	}
+	if extra.Len() > 0 {
+		b.WriteString("\n\n" + strings.TrimSpace(extra.String()))
+	}
+}
+
+// writeDefaultPrompt writes the built-in prompt for the current mode
+func writeDefaultPrompt(b *strings.Builder, cfg config, data promptData) {
+	switch {
+	case len(cfg.compareFiles) == 2:
+		b.WriteString(explainInstructions)
+	case cfg.output == "pr":
+		b.WriteString(prInstructions)
+	case cfg.output == "note":
+		b.WriteString(noteInstructions)
+	case cfg.output == "review-md":
+		b.WriteString(reviewMarkdownInstructions)
+	case cfg.conventional:
+		b.WriteString(conventionalInstructions)
+		b.WriteString(bodyFormats[cfg.bodyFormat])
+	default:
+		b.WriteString(commitInstructions)
+		b.WriteString(bodyFormats[cfg.bodyFormat])
+	}
+	if cfg.review {
+		b.WriteString(reviewInstructions)
+	}
+	if cfg.trailersFromAnalysis {
+		b.WriteString(analysisInstructions)
+	}
+	if data.Author != "" {
+		fmt.Fprintf(b, "Author: %s\n", data.Author)
+		if data.AuthorDate != "" {
+			fmt.Fprintf(b, "Date: %s\n", data.AuthorDate)
+		}
+		b.WriteString("\n")
+	}
+	if data.Languages != "" {
+		fmt.Fprintf(b, "Languages: %s\n\n", data.Languages)
+	}
+	if data.Focus != "" {
+		fmt.Fprintf(b, "These changes primarily affect: %s\n\n", data.Focus)
+	}
+	if data.Owners != "" {
+		fmt.Fprintf(b, "Owners of the changed files (from CODEOWNERS):\n%s\n\n", data.Owners)
+	}
+	if cfg.conventional && data.Scope != "" {
+		if cfg.scope != "" {
+			fmt.Fprintf(b, "Scope: use %q as the commit scope.\n\n", data.Scope)
+		} else {
+			fmt.Fprintf(b, "Suggested scope (from the changed paths): %s\n\n", data.Scope)
+		}
+	}
+	if data.Template != "" {
+		fmt.Fprintf(b, "Commit message template (fill in its sections instead of inventing your own structure; lines starting with # are guidance, leave them out):\n<<<\n%s\n>>>\n\n", data.Template)
+	}
+	if data.Stash != "" {
+		fmt.Fprintf(b, stashSection, data.Stash)
+	}
+	if data.Shallow != "" {
+		fmt.Fprintf(b, "Note: %s\n\n", data.Shallow)
+	}
+	if data.Blame != "" {
+		fmt.Fprintf(b, blameSection, data.Blame)
+	}
+	if data.Background != "" {
+		fmt.Fprintf(b, "Background (use this to understand the intent, do not describe it):\n<<<\n%s\n>>>\n\n", data.Background)
+	}
+	if data.CommandOutput != "" {
+		fmt.Fprintf(b, "Output of `%s` (build or test results to ground the description, do not describe it):\n<<<\n%s\n>>>\n\n", cfg.contextCommand, data.CommandOutput)
+	}
+	switch {
+	case len(cfg.compareFiles) == 2:
+		fmt.Fprintf(b, "Changes:\n%s\n\nExplain the change:", data.Changes)
+	case cfg.output == "pr":
+		fmt.Fprintf(b, "Changes:\n%s\n\nGenerate the pull request description:", data.Changes)
+	case cfg.output == "note":
+		fmt.Fprintf(b, "Changes:\n%s\n\nWrite the note:", data.Changes)
+	case cfg.output == "review-md":
+		fmt.Fprintf(b, "Changes:\n%s\n\nWrite the review summary:", data.Changes)
+	default:
+		fmt.Fprintf(b, "Staged changes:\n%s\n\nGenerate the commit message:", data.Changes)
+	}
+}
+
+// loadPromptFile parses the template in path for -prompt-file. A file that
+// never mentions {{.Changes}} gets the diff appended, so plain instructions
+// like "Write release notes for these changes" work as they are.
+func loadPromptFile(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt file: %w", err)
+	}
+	text := string(data)
+	if !strings.Contains(text, ".Changes") {
+		text = strings.TrimRight(text, "\n") + "\n\nChanges:\n{{.Changes}}\n"
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prompt file %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// resolveModelPrompt picks the template for model from modelPrompts. An
+// exact model id wins; otherwise the longest matching prefix is used.
+func resolveModelPrompt(modelPrompts map[string]string, model string) (string, bool) {
+	if tmpl, ok := modelPrompts[model]; ok {
+		return tmpl, true
+	}
+	best := ""
+	for key := range modelPrompts {
+		if strings.HasPrefix(model, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return modelPrompts[best], true
+}
+
+// defaultReasoningModelPrefixes lists model families that only accept the
+// reduced reasoning-model parameter set
+var defaultReasoningModelPrefixes = []string{"o1", "o3", "o4", "gpt-5"}
 
-		// Get HEAD content
-		var headContent string
-		var headHash plumbing.Hash
-		if fileStatus.Staging != git.Added && headTree != nil {
-			headFile, err := headTree.File(path)
-			if err == nil {
-				headContent, _ = headFile.Contents()
-				headHash = headFile.Hash
-			}
+// isReasoningModel reports whether model matches one of the reasoning model
+// prefixes. A vendor namespace such as "openai/" is ignored when matching.
+func isReasoningModel(model string, prefixes []string) bool {
+	name := model[strings.LastIndex(model, "/")+1:]
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(model, prefix) || strings.HasPrefix(name, prefix) {
+			return true
 		}
+	}
+	return false
+}
 
-		// Get staged content from index
-		var stagedContent string
-		var stagedHash plumbing.Hash
-		if fileStatus.Staging != git.Deleted {
-			if hash, ok := indexMap[path]; ok {
-				stagedHash = hash
-				// Fetch the blob object
-				blob, err := repo.BlobObject(hash)
-				if err == nil {
-					reader, _ := blob.Reader()
-					content, _ := io.ReadAll(reader)
-					reader.Close()
-					stagedContent = string(content)
-				}
-			}
-		}
+// chatMessage is a single turn in the conversation sent to the model
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
 
-		// Generate diff header
-		if fileStatus.Staging == git.Added {
-			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
-			patchBuf.WriteString("new file mode 100644\n")
-			patchBuf.WriteString(fmt.Sprintf("index 0000000..%s\n", stagedHash.String()[:7]))
-			patchBuf.WriteString("--- /dev/null\n")
-			patchBuf.WriteString(fmt.Sprintf("+++ b/%s\n", path))
-		} else if fileStatus.Staging == git.Deleted {
-			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
-			patchBuf.WriteString("deleted file mode 100644\n")
-			patchBuf.WriteString(fmt.Sprintf("index %s..0000000\n", headHash.String()[:7]))
-			patchBuf.WriteString(fmt.Sprintf("--- a/%s\n", path))
-			patchBuf.WriteString("+++ /dev/null\n")
-		} else {
-			patchBuf.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n", path, path))
-			patchBuf.WriteString(fmt.Sprintf("index %s..%s 100644\n", headHash.String()[:7], stagedHash.String()[:7]))
-			patchBuf.WriteString(fmt.Sprintf("--- a/%s\n", path))
-			patchBuf.WriteString(fmt.Sprintf("+++ b/%s\n", path))
-		}
+const polishInstructions = `Fix grammar and spelling in the text below and tighten the wording.
+Preserve its meaning, line structure and formatting: keep the first line as the subject,
+keep blank lines and bullet points where they are, and do not add new information.
+Output only the corrected text.
 
-		// Generate unified diff content
-		diffContent := generateUnifiedDiffContent(headContent, stagedContent)
-		patchBuf.WriteString(diffContent)
+Text:
+`
+
+// polishMessage sends message through a second pass that fixes grammar and
+// tightens it, using the polish model when one is configured
+func polishMessage(ctx context.Context, cfg config, message string) (string, responseMetadata, error) {
+	if cfg.polishModel != "" {
+		cfg.model = cfg.polishModel
 	}
+	debugLog("Polishing message with %s", cfg.model)
+	return describeChanges(ctx, cfg, []chatMessage{{Role: "user", Content: polishInstructions + message}})
+}
 
-	patchStr := patchBuf.String()
-	lineCount := strings.Count(patchStr, "\n")
+// httpTransport carries API requests, nil for http.DefaultTransport; tests
+// replace it to replay recorded interactions
+var httpTransport http.RoundTripper
 
-	// Check if we've exceeded the limit
-	if cfg.maxLines > 0 && lineCount > cfg.maxLines {
-		return "", fmt.Errorf("staged changes exceed maximum line limit of %d (currently at %d lines). Consider staging fewer files or using -max-lines flag to increase the limit", cfg.maxLines, lineCount)
+// newHTTPClient returns the client used for API requests. With force_http1
+// the transport never negotiates HTTP/2, which some proxies break.
+func newHTTPClient(cfg config) *http.Client {
+	transport := httpTransport
+	if transport == nil && cfg.forceHTTP1 {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ForceAttemptHTTP2 = false
+		// A non-nil, empty map turns off the transport's HTTP/2 support
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		transport = t
 	}
-
-	debugLog("Processed %d staged files (%d total lines)", stagedFileCount, lineCount)
-	return patchStr, nil
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
 }
 
-func stagingStatusString(status git.StatusCode) string {
-	switch status {
-	case git.Added:
-		return "Added"
-	case git.Modified:
-		return "Modified"
-	case git.Deleted:
-		return "Deleted"
-	case git.Renamed:
-		return "Renamed"
-	case git.Copied:
-		return "Copied"
-	default:
-		return "Unknown"
+// checkRedirect logs each redirect and refuses to follow one that dropped
+// the Authorization header, which net/http does when the host changes. The
+// API would otherwise answer with a confusing 401. net/http keeps other
+// headers, so a request carrying Anthropic's x-api-key is not sent on to a
+// different host at all.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	debugLog("Redirected: %s -> %s", via[len(via)-1].URL, req.URL)
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if via[0].Header.Get("Authorization") != "" && req.Header.Get("Authorization") == "" {
+		return fmt.Errorf("endpoint redirected from %s to %s, which drops the API key; update your config to the final URL", via[0].URL, req.URL)
 	}
+	if via[0].Header.Get("x-api-key") != "" && req.URL.Host != via[0].URL.Host {
+		return fmt.Errorf("endpoint redirected from %s to %s, another host, which would be sent the API key; update your config to the final URL", via[0].URL, req.URL)
+	}
+	return nil
 }
 
-// generateUnifiedDiffContent creates a unified diff from two strings
-func generateUnifiedDiffContent(oldContent, newContent string) string {
-	oldLines := strings.Split(oldContent, "\n")
-	newLines := strings.Split(newContent, "\n")
-
-	// Handle empty content
-	if oldContent == "" {
-		oldLines = []string{}
+// finishStream ends the streamed text. The model's message, untrailed, is
+// compared with what was streamed; when a retry or the clean-up changed it
+// the final message is printed in full, otherwise only the trailers added
+// after it are.
+func finishStream(output io.Writer, streamed, untrailed, final string, trailers []trailer) {
+	_, _ = fmt.Fprintln(output)
+	if strings.TrimSpace(streamed) != strings.TrimSpace(untrailed) {
+		fmt.Fprintln(os.Stderr, "The streamed response was retried or cleaned up; final message:")
+		_, _ = fmt.Fprintf(output, "\n%s\n", final)
+		return
 	}
-	if newContent == "" {
-		newLines = []string{}
+	if len(trailers) > 0 {
+		_, _ = fmt.Fprintln(output)
+		for _, t := range trailers {
+			_, _ = fmt.Fprintf(output, "%s: %s\n", t.key, t.value)
+		}
 	}
+}
 
-	// Simple line-by-line diff (not optimal but works for our purpose)
-	var result strings.Builder
+// streamRecorder passes streamed fragments on to w and keeps a copy, so run
+// can tell whether the message it ends up with is the one that was shown
+type streamRecorder struct {
+	w    io.Writer
+	text strings.Builder
+}
 
-	// For simplicity, we'll use a basic diff strategy
-	// Find common prefix and suffix
-	commonPrefix := 0
-	minLen := len(oldLines)
-	if len(newLines) < minLen {
-		minLen = len(newLines)
-	}
+func (r *streamRecorder) Write(p []byte) (int, error) {
+	r.text.Write(p)
+	return r.w.Write(p)
+}
+
+// errEmptyResponse is returned when the model replies with no content
+var errEmptyResponse = errors.New("no response from API")
+
+// errContextLength is returned when the API rejects the prompt as too long
+// for the model
+var errContextLength = errors.New("prompt exceeds the model's context length")
+
+// contextLengthMarkers are phrases providers use when a prompt is too long
+var contextLengthMarkers = []string{
+	"context_length_exceeded",
+	"context length",
+	"context window",
+	"maximum context",
+	"prompt is too long",
+}
 
-	for commonPrefix < minLen && oldLines[commonPrefix] == newLines[commonPrefix] {
-		commonPrefix++
+// apiError builds the error for a failed API request, wrapping
+// errContextLength when the body says the prompt did not fit
+func apiError(status int, body []byte) error {
+	lower := strings.ToLower(string(body))
+	for _, marker := range contextLengthMarkers {
+		if strings.Contains(lower, marker) {
+			return fmt.Errorf("%w: API request failed with status %d: %s", errContextLength, status, string(body))
+		}
 	}
+	return fmt.Errorf("API request failed with status %d: %s", status, string(body))
+}
 
-	commonSuffix := 0
-	oldEnd := len(oldLines)
-	newEnd := len(newLines)
-	for commonSuffix < (minLen-commonPrefix) &&
-		oldLines[oldEnd-1-commonSuffix] == newLines[newEnd-1-commonSuffix] {
-		commonSuffix++
+// estimateTokens roughly estimates the prompt size at four characters per token
+func estimateTokens(messages []chatMessage) int {
+	chars := 0
+	for _, m := range messages {
+		chars += len(m.Content)
 	}
+	return chars / 4
+}
 
-	// Calculate hunk ranges
-	oldStart := commonPrefix
-	oldCount := len(oldLines) - commonPrefix - commonSuffix
-	newStart := commonPrefix
-	newCount := len(newLines) - commonPrefix - commonSuffix
+// tokensPerMessage is the chat format's overhead for each message, and
+// tokensPerReply primes the assistant's reply
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
 
-	// If there are no changes, return empty
-	if oldCount == 0 && newCount == 0 {
-		return ""
+// countTokens counts the prompt's tokens with the model's tokenizer when it
+// is a known OpenAI model (a vendor prefix like "openai/" is ignored), and
+// falls back to estimateTokens for everything else. The boolean reports
+// whether the count is exact.
+func countTokens(model string, messages []chatMessage) (int, bool) {
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		model = model[i+1:]
+	}
+	codec, err := tokenizer.ForModel(tokenizer.Model(model))
+	if err != nil {
+		return estimateTokens(messages), false
 	}
+	tokens := tokensPerReply
+	for _, m := range messages {
+		n, err := codec.Count(m.Content)
+		if err != nil {
+			debugLog("Tokenizer failed for %s, estimating: %v", model, err)
+			return estimateTokens(messages), false
+		}
+		tokens += n + tokensPerMessage
+	}
+	return tokens, true
+}
 
-	// Add context lines (3 before and after)
-	contextLines := 3
-	oldStart = oldStart - contextLines
-	if oldStart < 0 {
-		oldStart = 0
+// describeChanges sends messages to the configured model, switching to the
+// large context model when the prompt is estimated or reported not to fit
+func describeChanges(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	if cfg.largeContextModel != "" && cfg.contextWindow > 0 {
+		tokens, exact := countTokens(cfg.model, messages)
+		debugLog("Prompt is %d tokens (exact: %v)", tokens, exact)
+		if tokens > cfg.contextWindow {
+			approx := "~"
+			if exact {
+				approx = ""
+			}
+			fmt.Fprintf(os.Stderr, "Prompt (%s%d tokens) exceeds the context of %s, using %s\n", approx, tokens, cfg.model, cfg.largeContextModel)
+			cfg.model = cfg.largeContextModel
+		}
 	}
-	newStart = newStart - contextLines
-	if newStart < 0 {
-		newStart = 0
+	description, meta, err := requestDescription(ctx, cfg, messages)
+	if errors.Is(err, errContextLength) && cfg.largeContextModel != "" && cfg.model != cfg.largeContextModel {
+		fmt.Fprintf(os.Stderr, "Prompt is too large for %s, retrying with %s\n", cfg.model, cfg.largeContextModel)
+		cfg.model = cfg.largeContextModel
+		return requestDescription(ctx, cfg, messages)
 	}
+	return description, meta, err
+}
 
-	oldEnd = commonPrefix + oldCount + contextLines
-	if oldEnd > len(oldLines) {
-		oldEnd = len(oldLines)
+// requestDescription calls the provider, retrying up to cfg.retryEmpty times
+// when the model returns an empty message or an attempt runs longer than
+// cfg.timeout. Retries stop once cfg.deadline has passed since the first
+// attempt started.
+func requestDescription(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	if cfg.debug {
+		printPrompt(os.Stderr, messages)
+	}
+	if cfg.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.deadline)
+		defer cancel()
+	}
+	for attempt := 0; ; attempt++ {
+		description, meta, err := describeAttempt(ctx, cfg, messages)
+		if errors.Is(err, errAttemptTimeout) && attempt < cfg.retryEmpty {
+			debugLog("Attempt timed out after %s, retrying (%d/%d)", cfg.timeout, attempt+1, cfg.retryEmpty)
+			if cfg.streamTo != nil {
+				// Start the next attempt on a line of its own
+				fmt.Fprintln(cfg.streamTo)
+			}
+			continue
+		}
+		if err != nil && cfg.deadline > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", meta, fmt.Errorf("no response within the %s deadline: %w", cfg.deadline, err)
+		}
+		if err == nil && len(cfg.responseStrip) > 0 {
+			description = stripResponse(description, cfg.responseStrip)
+			if description == "" {
+				err = errEmptyResponse
+			}
+		}
+		if errors.Is(err, errEmptyResponse) && attempt < cfg.retryEmpty {
+			debugLog("Empty response from model, retrying (%d/%d)", attempt+1, cfg.retryEmpty)
+			continue
+		}
+		return description, meta, err
 	}
-	newEnd = commonPrefix + newCount + contextLines
-	if newEnd > len(newLines) {
-		newEnd = len(newLines)
+}
+
+// printPrompt writes the messages sent to the model for -debug. It is done
+// once per request, whichever provider is used and however often it retries.
+func printPrompt(w io.Writer, messages []chatMessage) {
+	fmt.Fprintln(w, "[DEBUG] === Full prompt being sent to LLM ===")
+	for _, m := range messages {
+		fmt.Fprintf(w, "[%s]\n%s\n", m.Role, m.Content)
 	}
+	fmt.Fprintln(w, "[DEBUG] === End of prompt ===")
+}
 
-	oldCount = oldEnd - oldStart
-	newCount = newEnd - newStart
+// defaultTimeout limits each API attempt when the config file sets no timeout
+const defaultTimeout = 120 * time.Second
 
-	// Write hunk header
-	result.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
-		oldStart+1, oldCount, newStart+1, newCount))
+// errAttemptTimeout is returned when a single API attempt exceeds cfg.timeout
+var errAttemptTimeout = errors.New("API attempt timed out")
 
-	// Write context before changes
-	for i := oldStart; i < commonPrefix && i < oldEnd; i++ {
-		result.WriteString(" " + oldLines[i] + "\n")
+// describeAttempt makes one provider call, limited to cfg.timeout within
+// whatever deadline ctx already carries. A streamed attempt only runs out
+// when no text arrives for cfg.timeout, so a long message that keeps
+// coming is not cut off.
+func describeAttempt(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	if cfg.timeout <= 0 {
+		return providers[cfg.provider].Describe(ctx, cfg, messages)
 	}
-
-	// Write removed lines
-	for i := commonPrefix; i < commonPrefix+oldCount-contextLines && i < len(oldLines)-commonSuffix; i++ {
-		if i < len(oldLines) {
-			result.WriteString("-" + oldLines[i] + "\n")
+	if cfg.streamTo != nil {
+		attemptCtx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		idle := time.AfterFunc(cfg.timeout, func() { cancel(errAttemptTimeout) })
+		defer idle.Stop()
+		cfg.streamTo = idleResetter{w: cfg.streamTo, timer: idle, timeout: cfg.timeout}
+		description, meta, err := providers[cfg.provider].Describe(attemptCtx, cfg, messages)
+		if err != nil && ctx.Err() == nil && errors.Is(context.Cause(attemptCtx), errAttemptTimeout) {
+			return "", meta, fmt.Errorf("%w: nothing streamed for %s", errAttemptTimeout, cfg.timeout)
 		}
+		return description, meta, err
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+	description, meta, err := providers[cfg.provider].Describe(attemptCtx, cfg, messages)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return "", meta, fmt.Errorf("%w after %s", errAttemptTimeout, cfg.timeout)
 	}
+	return description, meta, err
+}
+
+// idleResetter restarts timer on every streamed fragment written through it
+type idleResetter struct {
+	w       io.Writer
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r idleResetter) Write(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	return r.w.Write(p)
+}
 
-	// Write added lines
-	for i := commonPrefix; i < commonPrefix+newCount-contextLines && i < len(newLines)-commonSuffix; i++ {
-		if i < len(newLines) {
-			result.WriteString("+" + newLines[i] + "\n")
+// checkQuality applies the configured quality checks to a response and
+// describes the first problem found, or returns "" when it passes. changes
+// is the diff that was described.
+func checkQuality(cfg config, description, changes string) string {
+	if cfg.trailersFromAnalysis {
+		description, _ = splitAnalysis(description)
+	}
+	if cfg.review {
+		description, _ = splitObservations(description)
+	}
+	subject, body := splitMessage(description)
+	if cfg.minSubjectLength > 0 && len(subject) < cfg.minSubjectLength {
+		return fmt.Sprintf("subject shorter than %d characters", cfg.minSubjectLength)
+	}
+	if cfg.requireBody && body == "" {
+		return "no body"
+	}
+	if cfg.rejectEcho {
+		trimmed := strings.TrimSpace(description)
+		if trimmed == strings.TrimSpace(changes) {
+			return "response repeats the diff"
+		}
+		for _, line := range strings.Split(trimmed, "\n") {
+			if strings.HasPrefix(line, "diff --git ") || strings.HasPrefix(line, "@@ -") {
+				return "response contains diff output"
+			}
 		}
 	}
+	return ""
+}
 
-	// Write context after changes
-	startSuffix := len(oldLines) - commonSuffix
-	for i := startSuffix; i < oldEnd && i < len(oldLines); i++ {
-		result.WriteString(" " + oldLines[i] + "\n")
+// stripResponse removes every match of patterns from description
+func stripResponse(description string, patterns []*regexp.Regexp) string {
+	for _, re := range patterns {
+		if stripped := re.ReplaceAllString(description, ""); stripped != description {
+			debugLog("Stripped %q from the response", re.String())
+			description = stripped
+		}
 	}
+	return strings.TrimSpace(description)
+}
 
-	return result.String()
+// Provider sends a conversation to a model API and returns the reply
+type Provider interface {
+	Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error)
+}
+
+// providers maps the provider config value to its implementation
+var providers = map[string]Provider{
+	"anthropic":  anthropicProvider{},
+	"ollama":     ollamaProvider{},
+	"openai":     openAIProvider{},
+	"openrouter": openRouterProvider{},
 }
 
-func describeChanges(ctx context.Context, cfg config, changes string) (string, responseMetadata, error) {
-	if cfg.provider == "ollama" {
-		return describeChangesOllama(ctx, cfg, changes)
+// providerNames lists the registered providers in a stable order
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
 	}
-	return describeChangesOpenRouter(ctx, cfg, changes)
+	sort.Strings(names)
+	return names
 }
 
-func describeChangesOllama(ctx context.Context, cfg config, changes string) (string, responseMetadata, error) {
-	type message struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
+// readChatStream reads an OpenAI-style server-sent event stream, writing
+// each content fragment to w as it arrives and returning the whole message
+func readChatStream(ctx context.Context, body io.Reader, w io.Writer) (string, responseMetadata, error) {
+	var content strings.Builder
+	var meta responseMetadata
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Blank lines separate events and lines starting with ":" are
+		// keep-alive comments
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			ID      string `json:"id"`
+			Model   string `json:"model"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *struct {
+				PromptTokens     int `json:"prompt_tokens"`
+				CompletionTokens int `json:"completion_tokens"`
+				TotalTokens      int `json:"total_tokens"`
+			} `json:"usage"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", meta, fmt.Errorf("failed to decode stream event: %w", err)
+		}
+		if chunk.Error != nil {
+			return "", meta, fmt.Errorf("API stream failed: %s", chunk.Error.Message)
+		}
+		if chunk.ID != "" {
+			meta.requestID = chunk.ID
+		}
+		if chunk.Model != "" {
+			meta.model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			meta.promptTokens = chunk.Usage.PromptTokens
+			meta.completionTokens = chunk.Usage.CompletionTokens
+			meta.totalTokens = chunk.Usage.TotalTokens
+		}
+		for _, choice := range chunk.Choices {
+			// Hold back leading whitespace so the printed message starts
+			// where the returned one does
+			fragment := choice.Delta.Content
+			if content.Len() == 0 {
+				fragment = strings.TrimLeft(fragment, " \t\r\n")
+			}
+			if fragment == "" {
+				continue
+			}
+			content.WriteString(fragment)
+			if _, err := io.WriteString(w, fragment); err != nil {
+				return "", meta, fmt.Errorf("failed to write streamed response: %w", err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return "", meta, ctx.Err()
+		}
+		return "", meta, fmt.Errorf("failed to read stream: %w", err)
 	}
 
-	type request struct {
-		Model    string    `json:"model"`
-		Messages []message `json:"messages"`
-		Stream   bool      `json:"stream"`
+	text := strings.TrimSpace(content.String())
+	if text == "" {
+		debugLog("API stream contained no message content")
+		return "", meta, errEmptyResponse
 	}
+	return text, meta, nil
+}
 
-	prompt := fmt.Sprintf(`You are a helpful assistant that writes git commit messages.
-Based on the following staged changes, generate a properly formatted git commit message.
+// readOllamaStream reads Ollama's streamed chat response, one JSON object
+// per line, writing each content fragment to w as it arrives and returning
+// the whole message. It stops at the object marked done, and as soon as
+// ctx is cancelled.
+func readOllamaStream(ctx context.Context, body io.Reader, w io.Writer) (string, responseMetadata, error) {
+	var content strings.Builder
+	var meta responseMetadata
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return "", meta, err
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
-Format requirements:
-- First line: Short summary (50-72 chars) describing WHAT changed and WHY
-- Second line: Blank line
-- Following lines: More detailed explanation of the changes, their purpose and impact
-- Output ONLY the commit message in plain text, without markdown code blocks or formatting
+		var chunk struct {
+			Model   string `json:"model"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Done            bool   `json:"done"`
+			PromptEvalCount int    `json:"prompt_eval_count"`
+			EvalCount       int    `json:"eval_count"`
+			Error           string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return "", meta, fmt.Errorf("failed to decode stream object: %w", err)
+		}
+		if chunk.Error != "" {
+			return "", meta, fmt.Errorf("API stream failed: %s", chunk.Error)
+		}
+		if chunk.Model != "" {
+			meta.model = chunk.Model
+		}
+		// Hold back leading whitespace so the printed message starts where
+		// the returned one does
+		fragment := chunk.Message.Content
+		if content.Len() == 0 {
+			fragment = strings.TrimLeft(fragment, " \t\r\n")
+		}
+		if fragment != "" {
+			content.WriteString(fragment)
+			if _, err := io.WriteString(w, fragment); err != nil {
+				return "", meta, fmt.Errorf("failed to write streamed response: %w", err)
+			}
+		}
+		if chunk.Done {
+			meta.promptTokens = chunk.PromptEvalCount
+			meta.completionTokens = chunk.EvalCount
+			meta.totalTokens = chunk.PromptEvalCount + chunk.EvalCount
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return "", meta, ctx.Err()
+		}
+		return "", meta, fmt.Errorf("failed to read stream: %w", err)
+	}
 
-Staged changes:
-%s
+	text := strings.TrimSpace(content.String())
+	if text == "" {
+		debugLog("API stream contained no message content")
+		return "", meta, errEmptyResponse
+	}
+	return text, meta, nil
+}
 
-Generate the commit message:`, changes)
+// ollamaProvider talks to Ollama's native chat API
+type ollamaProvider struct{}
+
+func (ollamaProvider) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	type request struct {
+		Model    string         `json:"model"`
+		Messages []chatMessage  `json:"messages"`
+		Stream   bool           `json:"stream"`
+		Options  map[string]any `json:"options,omitempty"`
+	}
 
 	reqBody := request{
-		Model: cfg.model,
-		Messages: []message{
-			{Role: "user", Content: prompt},
-		},
-		Stream: false,
+		Model:    cfg.model,
+		Messages: messages,
+		Stream:   cfg.streamTo != nil,
+	}
+	if cfg.temperature != nil || cfg.maxTokens > 0 {
+		reqBody.Options = map[string]any{}
+		if cfg.temperature != nil {
+			reqBody.Options["temperature"] = *cfg.temperature
+		}
+		if cfg.maxTokens > 0 {
+			reqBody.Options["num_predict"] = cfg.maxTokens
+		}
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
@@ -683,11 +6695,6 @@ Generate the commit message:`, changes)
 	}
 
 	debugLog("Sending request to Ollama API (payload size: %d bytes)", len(jsonBody))
-	if cfg.debug {
-		fmt.Fprintln(os.Stderr, "[DEBUG] === Full prompt being sent to LLM ===")
-		fmt.Fprintln(os.Stderr, prompt)
-		fmt.Fprintln(os.Stderr, "[DEBUG] === End of prompt ===")
-	}
 
 	endpoint := cfg.apiEndpoint + "/api/chat"
 	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonBody))
@@ -697,7 +6704,7 @@ Generate the commit message:`, changes)
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := newHTTPClient(cfg)
 	startTime := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
@@ -709,7 +6716,13 @@ Generate the commit message:`, changes)
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		debugLog("API error response: %s", string(body))
-		return "", responseMetadata{}, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return "", responseMetadata{}, apiError(resp.StatusCode, body)
+	}
+
+	if reqBody.Stream {
+		content, meta, err := readOllamaStream(ctx, resp.Body, cfg.streamTo)
+		meta.duration = time.Since(startTime).Seconds()
+		return content, meta, err
 	}
 
 	var result struct {
@@ -727,9 +6740,9 @@ Generate the commit message:`, changes)
 	}
 	duration := time.Since(startTime).Seconds()
 
-	if result.Message.Content == "" {
+	if strings.TrimSpace(result.Message.Content) == "" {
 		debugLog("API returned empty message content")
-		return "", responseMetadata{}, fmt.Errorf("no response from API")
+		return "", responseMetadata{}, errEmptyResponse
 	}
 
 	meta := responseMetadata{
@@ -744,36 +6757,159 @@ Generate the commit message:`, changes)
 	return strings.TrimSpace(result.Message.Content), meta, nil
 }
 
-func describeChangesOpenRouter(ctx context.Context, cfg config, changes string) (string, responseMetadata, error) {
-	type message struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	}
+// openAIProvider talks to OpenAI's chat completions API directly
+type openAIProvider struct{}
+
+func (openAIProvider) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	return describeChangesOpenAI(ctx, cfg, messages)
+}
+
+// describeChangesOpenAI posts to OpenAI's /chat/completions, which takes
+// the same request as OpenRouter's
+func describeChangesOpenAI(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	debugLog("Using OpenAI at %s", cfg.apiEndpoint)
+	return openRouterProvider{}.Describe(ctx, cfg, messages)
+}
+
+// anthropicProvider talks to Anthropic's Messages API directly
+type anthropicProvider struct{}
+
+func (anthropicProvider) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	return describeChangesAnthropic(ctx, cfg, messages)
+}
 
+// anthropicVersion is the Messages API version sent with each request
+const anthropicVersion = "2023-06-01"
+
+// defaultAnthropicMaxTokens is the response limit when max_tokens is unset,
+// since the Messages API requires one
+const defaultAnthropicMaxTokens = 1024
+
+// describeChangesAnthropic posts to Anthropic's /messages and joins the
+// text blocks of the reply
+func describeChangesAnthropic(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
 	type request struct {
-		Model    string    `json:"model"`
-		Messages []message `json:"messages"`
+		Model       string        `json:"model"`
+		Messages    []chatMessage `json:"messages"`
+		MaxTokens   int           `json:"max_tokens"`
+		Temperature *float64      `json:"temperature,omitempty"`
 	}
 
-	prompt := fmt.Sprintf(`You are a helpful assistant that writes git commit messages.
-Based on the following staged changes, generate a properly formatted git commit message.
+	reqBody := request{
+		Model:       cfg.model,
+		Messages:    messages,
+		MaxTokens:   cfg.maxTokens,
+		Temperature: cfg.temperature,
+	}
+	if reqBody.MaxTokens <= 0 {
+		reqBody.MaxTokens = defaultAnthropicMaxTokens
+	}
 
-Format requirements:
-- First line: Short summary (50-72 chars) describing WHAT changed and WHY
-- Second line: Blank line
-- Following lines: More detailed explanation of the changes, their purpose and impact
-- Output ONLY the commit message in plain text, without markdown code blocks or formatting
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", responseMetadata{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
 
-Staged changes:
-%s
+	debugLog("Sending request to Anthropic API (payload size: %d bytes)", len(jsonBody))
+
+	endpoint := cfg.apiEndpoint + "/messages"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		return "", responseMetadata{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", cfg.apiKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+
+	client := newHTTPClient(cfg)
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", responseMetadata{}, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	debugLog("Received response with status: %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		debugLog("API error response: %s", string(body))
+		return "", responseMetadata{}, apiError(resp.StatusCode, body)
+	}
+
+	var result struct {
+		ID      string `json:"id"`
+		Model   string `json:"model"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", responseMetadata{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+	duration := time.Since(startTime).Seconds()
+
+	// Thinking and tool use blocks are not part of the answer
+	var text strings.Builder
+	for _, block := range result.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	content := strings.TrimSpace(text.String())
+	if content == "" {
+		debugLog("API returned no text content")
+		return "", responseMetadata{}, errEmptyResponse
+	}
+
+	meta := responseMetadata{
+		model:            result.Model,
+		promptTokens:     result.Usage.InputTokens,
+		completionTokens: result.Usage.OutputTokens,
+		totalTokens:      result.Usage.InputTokens + result.Usage.OutputTokens,
+		duration:         duration,
+		requestID:        result.ID,
+	}
+
+	debugLog("Successfully decoded API response")
+	return content, meta, nil
+}
+
+// openRouterProvider talks to OpenRouter and other OpenAI-compatible
+// chat completion APIs such as vLLM
+type openRouterProvider struct{}
 
-Generate the commit message:`, changes)
+func (openRouterProvider) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	type request struct {
+		Model               string        `json:"model"`
+		Messages            []chatMessage `json:"messages"`
+		Temperature         *float64      `json:"temperature,omitempty"`
+		MaxTokens           int           `json:"max_tokens,omitempty"`
+		MaxCompletionTokens int           `json:"max_completion_tokens,omitempty"`
+		Stream              bool          `json:"stream,omitempty"`
+	}
 
 	reqBody := request{
-		Model: cfg.model,
-		Messages: []message{
-			{Role: "user", Content: prompt},
-		},
+		Model:       cfg.model,
+		Messages:    messages,
+		Temperature: cfg.temperature,
+		MaxTokens:   cfg.maxTokens,
+		Stream:      cfg.streamTo != nil,
+	}
+
+	// Reasoning models reject temperature and expect max_completion_tokens
+	// in place of max_tokens
+	if isReasoningModel(cfg.model, cfg.reasoningModelPrefixes) {
+		debugLog("Model %s is a reasoning model, adjusting request parameters", cfg.model)
+		reqBody.Temperature = nil
+		reqBody.MaxCompletionTokens = reqBody.MaxTokens
+		reqBody.MaxTokens = 0
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
@@ -782,11 +6918,6 @@ Generate the commit message:`, changes)
 	}
 
 	debugLog("Sending request to OpenRouter API (payload size: %d bytes)", len(jsonBody))
-	if cfg.debug {
-		fmt.Fprintln(os.Stderr, "[DEBUG] === Full prompt being sent to LLM ===")
-		fmt.Fprintln(os.Stderr, prompt)
-		fmt.Fprintln(os.Stderr, "[DEBUG] === End of prompt ===")
-	}
 
 	endpoint := cfg.apiEndpoint + "/chat/completions"
 	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonBody))
@@ -797,7 +6928,7 @@ Generate the commit message:`, changes)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+cfg.apiKey)
 
-	client := &http.Client{}
+	client := newHTTPClient(cfg)
 	startTime := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
@@ -809,7 +6940,13 @@ Generate the commit message:`, changes)
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		debugLog("API error response: %s", string(body))
-		return "", responseMetadata{}, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return "", responseMetadata{}, apiError(resp.StatusCode, body)
+	}
+
+	if reqBody.Stream {
+		content, meta, err := readChatStream(ctx, resp.Body, cfg.streamTo)
+		meta.duration = time.Since(startTime).Seconds()
+		return content, meta, err
 	}
 
 	var result struct {
@@ -817,7 +6954,9 @@ Generate the commit message:`, changes)
 		Model   string `json:"model"`
 		Choices []struct {
 			Message struct {
-				Content string `json:"content"`
+				Content          string `json:"content"`
+				ReasoningContent string `json:"reasoning_content"`
+				Reasoning        string `json:"reasoning"`
 			} `json:"message"`
 		} `json:"choices"`
 		Usage struct {
@@ -834,7 +6973,27 @@ Generate the commit message:`, changes)
 
 	if len(result.Choices) == 0 {
 		debugLog("API returned empty choices array")
-		return "", responseMetadata{}, fmt.Errorf("no response from API")
+		return "", responseMetadata{}, errEmptyResponse
+	}
+	// Some reasoning models leave content empty and put the answer in one
+	// of the reasoning fields instead
+	message := result.Choices[0].Message
+	content := strings.TrimSpace(message.Content)
+	if content == "" {
+		for _, alt := range []struct{ name, value string }{
+			{"reasoning_content", message.ReasoningContent},
+			{"reasoning", message.Reasoning},
+		} {
+			if v := strings.TrimSpace(alt.value); v != "" {
+				debugLog("API returned empty message content, using %s field", alt.name)
+				content = v
+				break
+			}
+		}
+	}
+	if content == "" {
+		debugLog("API returned empty message content")
+		return "", responseMetadata{}, errEmptyResponse
 	}
 
 	meta := responseMetadata{
@@ -847,5 +7006,5 @@ Generate the commit message:`, changes)
 	}
 
 	debugLog("Successfully decoded API response")
-	return strings.TrimSpace(result.Choices[0].Message.Content), meta, nil
+	return content, meta, nil
 }
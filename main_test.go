@@ -1,10 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"text/template"
+	"time"
 
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
 func TestShouldIgnorePath(t *testing.T) {
@@ -36,7 +59,7 @@ func TestShouldIgnorePath(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := shouldIgnorePath(tt.path)
+			result := shouldIgnorePath(tt.path, ignoredDirs)
 			if result != tt.expected {
 				t.Errorf("shouldIgnorePath(%q) = %v, expected %v", tt.path, result, tt.expected)
 			}
@@ -44,6 +67,29 @@ func TestShouldIgnorePath(t *testing.T) {
 	}
 }
 
+func TestSkippedDirs(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config
+		path     string
+		expected bool
+	}{
+		{"built-in", config{}, "vendor/lib.go", true},
+		{"extra", config{ignoreDirs: []string{"gen", ".terraform"}}, "api/gen/types.go", true},
+		{"extra keeps built-in", config{ignoreDirs: []string{"gen"}}, "node_modules/x.js", true},
+		{"replace drops built-in", config{ignoreDirs: []string{"gen"}, replaceIgnoreDirs: true}, "vendor/lib.go", false},
+		{"replace keeps extra", config{ignoreDirs: []string{"gen"}, replaceIgnoreDirs: true}, "gen/x.go", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := shouldIgnorePath(tt.path, tt.cfg.skippedDirs()); result != tt.expected {
+				t.Errorf("shouldIgnorePath(%q) = %v, expected %v", tt.path, result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestIsBinary(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -71,6 +117,35 @@ func TestIsBinary(t *testing.T) {
 	}
 }
 
+func TestReadSampleShortReads(t *testing.T) {
+	// Text up front with a NUL byte later on: a single short read would
+	// only see the text and misclassify the file
+	content := append(bytes.Repeat([]byte("text\n"), 100), 0x00)
+	sample, err := readSample(iotest.OneByteReader(bytes.NewReader(content)))
+	if err != nil {
+		t.Fatalf("readSample() error = %v", err)
+	}
+	if !bytes.Equal(sample, content) {
+		t.Errorf("readSample() read %d bytes, expected %d", len(sample), len(content))
+	}
+	if !isBinaryContent(sample) {
+		t.Errorf("isBinaryContent() = false, expected true for a sample with a NUL byte")
+	}
+
+	large := bytes.Repeat([]byte("a"), 10000)
+	sample, err = readSample(iotest.OneByteReader(bytes.NewReader(large)))
+	if err != nil {
+		t.Fatalf("readSample() error = %v", err)
+	}
+	if len(sample) != 8192 {
+		t.Errorf("readSample() read %d bytes, expected 8192", len(sample))
+	}
+
+	if _, err := readSample(iotest.ErrReader(errors.New("boom"))); err == nil {
+		t.Errorf("readSample() expected error from failing reader")
+	}
+}
+
 func TestStagingStatusString(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -157,6 +232,24 @@ func TestGetConfig(t *testing.T) {
 			expectError: false,
 			expectHelp:  true,
 		},
+		{
+			name:             "two files to compare",
+			args:             []string{"old.txt", "new.txt"},
+			envKey:           "",
+			expectError:      false,
+			expectHelp:       false,
+			expectedModel:    "llama3.2",
+			expectedProvider: "ollama",
+			expectedDebug:    false,
+			expectedMaxLines: 10000,
+		},
+		{
+			name:        "single positional argument",
+			args:        []string{"old.txt"},
+			envKey:      "",
+			expectError: true,
+			expectHelp:  false,
+		},
 		{
 			name:        "missing API key for openrouter",
 			args:        []string{"-provider", "openrouter"},
@@ -218,3 +311,4629 @@ func TestGetConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestGetConfigOpenAI(t *testing.T) {
+	t.Setenv("OPENROUTER_API_KEY", "openrouter-key")
+
+	t.Setenv("OPENAI_API_KEY", "")
+	if _, _, err := getConfig([]string{"-provider", "openai"}); err == nil || !strings.Contains(err.Error(), "OPENAI_API_KEY") {
+		t.Errorf("getConfig() without a key error = %v, expected an OPENAI_API_KEY error", err)
+	}
+
+	t.Setenv("OPENAI_API_KEY", "openai-key")
+	cfg, _, err := getConfig([]string{"-provider", "openai"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.model != "gpt-4o-mini" || cfg.apiEndpoint != "https://api.openai.com/v1" || cfg.apiKey != "openai-key" {
+		t.Errorf("getConfig() model, endpoint, key = %q, %q, %q, expected gpt-4o-mini, https://api.openai.com/v1, openai-key", cfg.model, cfg.apiEndpoint, cfg.apiKey)
+	}
+
+	cfg, _, err = getConfig([]string{"-provider", "openai", "-model", "gpt-4.1"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.model != "gpt-4.1" {
+		t.Errorf("getConfig() model = %q, expected gpt-4.1", cfg.model)
+	}
+}
+
+func TestLoadConfigFileOpenAIDefaults(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DESCRIBE_CONFIG", "")
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(filepath.Join(xdg, "describe"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(xdg, "describe", "config.yaml"), []byte("provider: openai\napi_key: file-key\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfigFile()
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if cfg.Model != "gpt-4o-mini" || cfg.APIEndpoint != "https://api.openai.com/v1" {
+		t.Errorf("loadConfigFile() model, endpoint = %q, %q, expected gpt-4o-mini, https://api.openai.com/v1", cfg.Model, cfg.APIEndpoint)
+	}
+
+	// The config file key is used when OPENAI_API_KEY is unset
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("OPENROUTER_API_KEY", "openrouter-key")
+	config, _, err := getConfig(nil)
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if config.provider != "openai" || config.apiKey != "file-key" {
+		t.Errorf("getConfig() provider, key = %q, %q, expected openai, file-key", config.provider, config.apiKey)
+	}
+}
+
+// newTestRepo creates an in-memory repository with a memfs worktree
+func newTestRepo(t *testing.T) (*git.Repository, billy.Filesystem) {
+	t.Helper()
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatalf("git.Init: %v", err)
+	}
+	return repo, fs
+}
+
+// writeTestFile writes content to path in the worktree filesystem
+func writeTestFile(t *testing.T, fs billy.Filesystem, path, content string) {
+	t.Helper()
+	f, err := fs.Create(path)
+	if err != nil {
+		t.Fatalf("create %s: %v", path, err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %s: %v", path, err)
+	}
+}
+
+// stageTestFile writes content to path and adds it to the index
+func stageTestFile(t *testing.T, repo *git.Repository, fs billy.Filesystem, path, content string) {
+	t.Helper()
+	writeTestFile(t, fs, path, content)
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree: %v", err)
+	}
+	if _, err := w.Add(path); err != nil {
+		t.Fatalf("add %s: %v", path, err)
+	}
+}
+
+// commitTestRepo commits everything currently staged
+func commitTestRepo(t *testing.T, repo *git.Repository) {
+	t.Helper()
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree: %v", err)
+	}
+	_, err = w.Commit("initial", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Unix(0, 0)},
+	})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+// blobHash returns the abbreviated blob hash git would assign to content
+func blobHash(content string) string {
+	return plumbing.ComputeHash(plumbing.BlobObject, []byte(content)).String()[:7]
+}
+
+func TestGetStagedChanges(t *testing.T) {
+	const base = "one\ntwo\nthree\nfour\nfive\nsix\nseven\n"
+	const edited = "one\ntwo\nthree\nFOUR\nfive\nsix\nseven\n"
+
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, repo *git.Repository, fs billy.Filesystem)
+		expected string
+	}{
+		{
+			name: "nothing staged",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "notes.txt", base)
+				commitTestRepo(t, repo)
+			},
+			expected: "",
+		},
+		{
+			name: "addition in new repository",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "notes.txt", "hello\nworld\n")
+			},
+			expected: "diff --git a/notes.txt b/notes.txt\n" +
+				"new file mode 100644\n" +
+				"index 0000000.." + blobHash("hello\nworld\n") + "\n" +
+				"--- /dev/null\n" +
+				"+++ b/notes.txt\n" +
+				"@@ -0,0 +1,2 @@\n" +
+				"+hello\n" +
+				"+world\n",
+		},
+		{
+			name: "modification",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "notes.txt", base)
+				commitTestRepo(t, repo)
+				stageTestFile(t, repo, fs, "notes.txt", edited)
+			},
+			expected: "diff --git a/notes.txt b/notes.txt\n" +
+				"index " + blobHash(base) + ".." + blobHash(edited) + " 100644\n" +
+				"--- a/notes.txt\n" +
+				"+++ b/notes.txt\n" +
+				"@@ -1,7 +1,7 @@\n" +
+				" one\n two\n three\n-four\n+FOUR\n five\n six\n seven\n",
+		},
+		{
+			name: "deletion",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "notes.txt", "bye\n")
+				commitTestRepo(t, repo)
+				w, _ := repo.Worktree()
+				if _, err := w.Remove("notes.txt"); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+			},
+			expected: "diff --git a/notes.txt b/notes.txt\n" +
+				"deleted file mode 100644\n" +
+				"index " + blobHash("bye\n") + "..0000000\n" +
+				"--- a/notes.txt\n" +
+				"+++ /dev/null\n" +
+				"@@ -1 +0,0 @@\n" +
+				"-bye\n",
+		},
+		{
+			// go-git status does not detect renames, so a move is
+			// reported as a deletion plus an addition
+			name: "rename",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "a.txt", "same\n")
+				commitTestRepo(t, repo)
+				w, _ := repo.Worktree()
+				if _, err := w.Move("a.txt", "b.txt"); err != nil {
+					t.Fatalf("Move: %v", err)
+				}
+			},
+			expected: "diff --git a/a.txt b/a.txt\n" +
+				"deleted file mode 100644\n" +
+				"index " + blobHash("same\n") + "..0000000\n" +
+				"--- a/a.txt\n" +
+				"+++ /dev/null\n" +
+				"@@ -1 +0,0 @@\n" +
+				"-same\n" +
+				"diff --git a/b.txt b/b.txt\n" +
+				"new file mode 100644\n" +
+				"index 0000000.." + blobHash("same\n") + "\n" +
+				"--- /dev/null\n" +
+				"+++ b/b.txt\n" +
+				"@@ -0,0 +1 @@\n" +
+				"+same\n",
+		},
+		{
+			// a mode-only change is staged as Modified but has no content diff
+			name: "staged but unchanged content",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "run.sh", "echo hi\n")
+				commitTestRepo(t, repo)
+				idx, err := repo.Storer.Index()
+				if err != nil {
+					t.Fatalf("Index: %v", err)
+				}
+				idx.Entries[0].Mode = filemode.Executable
+				if err := repo.Storer.SetIndex(idx); err != nil {
+					t.Fatalf("SetIndex: %v", err)
+				}
+			},
+			expected: "",
+		},
+		{
+			name: "ignored directory",
+			setup: func(t *testing.T, repo *git.Repository, fs billy.Filesystem) {
+				stageTestFile(t, repo, fs, "vendor/lib.go", "package lib\n")
+			},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, fs := newTestRepo(t)
+			tt.setup(t, repo, fs)
+
+			result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000})
+			if err != nil {
+				t.Fatalf("getStagedChanges() error = %v", err)
+			}
+			if result.patch != tt.expected {
+				t.Errorf("getStagedChanges() =\n%s\nexpected\n%s", result.patch, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetStagedChangesNewRepository(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	// Restaging after an edit must still be described as a new file
+	stageTestFile(t, repo, fs, "a.txt", "one\ntwo\n")
+
+	result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	expected := "diff --git a/a.txt b/a.txt\n" +
+		"new file mode 100644\n" +
+		"index 0000000.." + blobHash("one\ntwo\n") + "\n" +
+		"--- /dev/null\n" +
+		"+++ b/a.txt\n" +
+		"@@ -0,0 +1,2 @@\n" +
+		"+one\n" +
+		"+two\n"
+	if result.patch != expected {
+		t.Errorf("getStagedChanges() =\n%s\nexpected\n%s", result.patch, expected)
+	}
+	if len(result.files) != 1 || result.files[0].status != git.Added {
+		t.Errorf("getStagedChanges() files = %+v, expected one added file", result.files)
+	}
+}
+
+func TestGetStagedChangesUnstaged(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "partial.txt", "one\n")
+	stageTestFile(t, repo, fs, "untouched.txt", "one\n")
+	stageTestFile(t, repo, fs, "vendor/lib.txt", "one\n")
+	commitTestRepo(t, repo)
+	// Staged, then edited again without staging
+	stageTestFile(t, repo, fs, "partial.txt", "one\ntwo\n")
+	writeTestFile(t, fs, "partial.txt", "one\ntwo\nthree\n")
+	// Only edited, and edited inside a skipped directory
+	writeTestFile(t, fs, "untouched.txt", "changed\n")
+	writeTestFile(t, fs, "vendor/lib.txt", "changed\n")
+	// Untracked files are not unstaged changes
+	writeTestFile(t, fs, "new.txt", "new\n")
+
+	result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	expected := []string{"partial.txt", "untouched.txt"}
+	if !reflect.DeepEqual(result.unstaged, expected) {
+		t.Errorf("getStagedChanges() unstaged = %v, expected %v", result.unstaged, expected)
+	}
+}
+
+func TestGetStagedChangesMaxLines(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "big.txt", strings.Repeat("line\n", 50))
+
+	_, err := getStagedChanges(context.Background(), repo, config{maxLines: 10})
+	if err == nil {
+		t.Fatal("getStagedChanges() expected error for exceeding max lines")
+	}
+	if !strings.Contains(err.Error(), "maximum line limit of 10") {
+		t.Errorf("getStagedChanges() error = %v, expected max line limit error", err)
+	}
+}
+
+func TestGenerateUnifiedDiffContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      string
+		new      string
+		expected string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"new content", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed content", "a\nb\n", "", "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"appended line", "a\nb\n", "a\nb\nc\n", "@@ -1,2 +1,3 @@\n a\n b\n+c\n"},
+		{
+			"changed middle line",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\n2\n3\n4\nX\n6\n7\n8\n9\n",
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+X\n 6\n 7\n 8\n",
+		},
+		{
+			"go function context",
+			"package main\n\nfunc foo() {\n\ta := 1\n\tb := 2\n\tc := 3\n\treturn\n}\n",
+			"package main\n\nfunc foo() {\n\ta := 1\n\tb := 2\n\tc := 3\n\td := 4\n\treturn\n}\n",
+			"@@ -4,5 +4,6 @@ func foo() {\n \ta := 1\n \tb := 2\n \tc := 3\n+\td := 4\n \treturn\n }\n",
+		},
+		{
+			"python method context",
+			"class A:\n    def run(self):\n        x = 1\n        y = 2\n        z = 3\n        return x\n",
+			"class A:\n    def run(self):\n        x = 1\n        y = 2\n        z = 3\n        return y\n",
+			"@@ -3,4 +3,4 @@ def run(self):\n         x = 1\n         y = 2\n         z = 3\n-        return x\n+        return y\n",
+		},
+		// The expected output below is git diff's, byte for byte
+		{
+			"changes at top and bottom",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"X\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\nY\n",
+			"@@ -1,4 +1,4 @@\n-1\n+X\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+Y\n",
+		},
+		{
+			"changes six lines apart share a hunk",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			"1\nA\n3\n4\n5\n6\n7\n8\nB\n10\n",
+			"@@ -1,10 +1,10 @@\n 1\n-2\n+A\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+B\n 10\n",
+		},
+		{
+			"changes seven lines apart get two hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n",
+			"1\nA\n3\n4\n5\n6\n7\n8\n9\nB\n11\n",
+			"@@ -1,5 +1,5 @@\n 1\n-2\n+A\n 3\n 4\n 5\n@@ -7,5 +7,5 @@\n 7\n 8\n 9\n-10\n+B\n 11\n",
+		},
+		{
+			"removed duplicate placed last",
+			"a\nb\nb\nb\nc\n",
+			"a\nb\nb\nc\n",
+			"@@ -1,5 +1,4 @@\n a\n b\n b\n-b\n c\n",
+		},
+		{
+			"moved line",
+			"a\nb\nc\nd\n",
+			"b\nc\nd\na\n",
+			"@@ -1,4 +1,4 @@\n-a\n b\n c\n d\n+a\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := generateUnifiedDiffContent(tt.old, tt.new)
+			if result != tt.expected {
+				t.Errorf("generateUnifiedDiffContent() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuildPromptAuthor(t *testing.T) {
+	withAuthor, err := buildPrompt(config{}, promptData{Changes: "diff", Author: "Jane Doe <jane@example.com>"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if !strings.Contains(withAuthor, "Author: Jane Doe <jane@example.com>\n") {
+		t.Errorf("buildPrompt() missing author line:\n%s", withAuthor)
+	}
+	if strings.Contains(withAuthor, "Date:") {
+		t.Errorf("buildPrompt() unexpected date line for staged changes:\n%s", withAuthor)
+	}
+
+	withoutAuthor, err := buildPrompt(config{}, promptData{Changes: "diff"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if strings.Contains(withoutAuthor, "Author:") {
+		t.Errorf("buildPrompt() unexpected author line:\n%s", withoutAuthor)
+	}
+}
+
+func TestGetStagedChangesMaxFiles(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	stageTestFile(t, repo, fs, "b.txt", "one\ntwo\n")
+	stageTestFile(t, repo, fs, "c.txt", "one\ntwo\nthree\n")
+
+	result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000, maxFiles: 2})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	expected := "3 files changed (summary only, full diffs omitted):\n" +
+		"Added a.txt (+1 -0)\n" +
+		"Added b.txt (+2 -0)\n" +
+		"Added c.txt (+3 -0)\n"
+	if result.patch != expected {
+		t.Errorf("getStagedChanges() = %q, expected %q", result.patch, expected)
+	}
+	if !result.truncated {
+		t.Error("getStagedChanges() truncated = false, expected a summary to count as truncated")
+	}
+}
+
+func TestGetStagedChangesSummaryHeadLines(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, fs, "a.txt", "one\ntwo\n")
+	stageTestFile(t, repo, fs, "b.go", "package b\n\nimport \"fmt\"\n")
+	stageTestFile(t, repo, fs, "c.go", "package c\n")
+
+	result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000, maxFiles: 2, summaryHeadLines: 2})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	expected := "3 files changed (summary only, full diffs omitted):\n" +
+		"Modified a.txt (+1 -0)\n" +
+		"Added b.go (+3 -0)\n" +
+		"    package b\n" +
+		"\n" +
+		"    ... (1 more line)\n" +
+		"Added c.go (+1 -0)\n" +
+		"    package c\n"
+	if result.patch != expected {
+		t.Errorf("getStagedChanges() = %q, expected %q", result.patch, expected)
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.txt")
+	newPath := filepath.Join(dir, "new.txt")
+	if err := os.WriteFile(oldPath, []byte("a\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, []byte("a\nc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := diffFiles(oldPath, newPath)
+	if err != nil {
+		t.Fatalf("diffFiles() error = %v", err)
+	}
+	expected := "--- " + oldPath + "\n+++ " + newPath + "\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"
+	if result != expected {
+		t.Errorf("diffFiles() = %q, expected %q", result, expected)
+	}
+
+	identical, err := diffFiles(oldPath, oldPath)
+	if err != nil {
+		t.Fatalf("diffFiles() error = %v", err)
+	}
+	if identical != "" {
+		t.Errorf("diffFiles() on identical files = %q, expected empty", identical)
+	}
+
+	if _, err := diffFiles(oldPath, "testdata/binary.bin"); err == nil {
+		t.Error("diffFiles() expected error for binary file")
+	}
+}
+
+func TestBuildPromptPrefixSuffix(t *testing.T) {
+	cfg := config{
+		promptPrefix: "Mention the ticket in brackets.",
+		promptSuffix: "Avoid the word refactor.",
+		instructions: []string{"Keep it short.", "Use British spelling."},
+	}
+	prompt, err := buildPrompt(cfg, promptData{Changes: "diff"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+
+	if !strings.HasPrefix(prompt, "Mention the ticket in brackets.\n\n") {
+		t.Errorf("buildPrompt() missing prefix:\n%s", prompt)
+	}
+	expectedSuffix := "Generate the commit message:\n\nAvoid the word refactor.\nKeep it short.\nUse British spelling."
+	if !strings.HasSuffix(prompt, expectedSuffix) {
+		t.Errorf("buildPrompt() missing suffix:\n%s", prompt)
+	}
+}
+
+func TestIsReasoningModel(t *testing.T) {
+	tests := []struct {
+		model    string
+		expected bool
+	}{
+		{"o1-mini", true},
+		{"o3", true},
+		{"openai/o4-mini", true},
+		{"gpt-5", true},
+		{"gpt-4o", false},
+		{"anthropic/claude-4.5-sonnet", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			result := isReasoningModel(tt.model, defaultReasoningModelPrefixes)
+			if result != tt.expected {
+				t.Errorf("isReasoningModel(%q) = %v, expected %v", tt.model, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenRouterReasoningModelRequest(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"Add feature"}}]}`)
+	}))
+	defer server.Close()
+
+	temperature := 0.2
+	cfg := config{
+		apiEndpoint:            server.URL,
+		model:                  "openai/o3-mini",
+		temperature:            &temperature,
+		maxTokens:              500,
+		reasoningModelPrefixes: defaultReasoningModelPrefixes,
+	}
+	if _, _, err := (openRouterProvider{}).Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}}); err != nil {
+		t.Fatalf("openRouterProvider.Describe() error = %v", err)
+	}
+
+	if _, ok := body["temperature"]; ok {
+		t.Errorf("request contains temperature for reasoning model: %v", body)
+	}
+	if _, ok := body["max_tokens"]; ok {
+		t.Errorf("request contains max_tokens for reasoning model: %v", body)
+	}
+	if body["max_completion_tokens"] != float64(500) {
+		t.Errorf("request max_completion_tokens = %v, expected 500", body["max_completion_tokens"])
+	}
+}
+
+func TestAnthropicProvider(t *testing.T) {
+	var body map[string]any
+	var header http.Header
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, path = r.Header, r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		fmt.Fprint(w, `{"id":"msg_1","model":"claude-3-5-sonnet-20241022","content":[{"type":"thinking","thinking":"hmm"},{"type":"text","text":"Fix parser"},{"type":"text","text":"\n\nHandle empty input."}],"usage":{"input_tokens":10,"output_tokens":5}}`)
+	}))
+	defer server.Close()
+
+	cfg := config{apiEndpoint: server.URL, apiKey: "secret", model: "claude-3-5-sonnet-latest"}
+	got, meta, err := (anthropicProvider{}).Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+	if err != nil {
+		t.Fatalf("anthropicProvider.Describe() error = %v", err)
+	}
+	if got != "Fix parser\n\nHandle empty input." {
+		t.Errorf("anthropicProvider.Describe() = %q, expected the joined text blocks", got)
+	}
+	if meta.totalTokens != 15 || meta.requestID != "msg_1" {
+		t.Errorf("anthropicProvider.Describe() metadata = %+v, expected 15 tokens and id msg_1", meta)
+	}
+	if path != "/messages" || header.Get("x-api-key") != "secret" || header.Get("anthropic-version") != anthropicVersion {
+		t.Errorf("request path %q, x-api-key %q, anthropic-version %q", path, header.Get("x-api-key"), header.Get("anthropic-version"))
+	}
+	if body["max_tokens"] != float64(defaultAnthropicMaxTokens) {
+		t.Errorf("request max_tokens = %v, expected %d", body["max_tokens"], defaultAnthropicMaxTokens)
+	}
+}
+
+func TestGetConfigAnthropic(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	if _, _, err := getConfig([]string{"-provider", "anthropic"}); err == nil || !strings.Contains(err.Error(), "ANTHROPIC_API_KEY") {
+		t.Errorf("getConfig() without a key error = %v, expected an ANTHROPIC_API_KEY error", err)
+	}
+
+	t.Setenv("ANTHROPIC_API_KEY", "anthropic-key")
+	cfg, _, err := getConfig([]string{"-provider", "anthropic"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.model != "claude-3-5-sonnet-latest" || cfg.apiEndpoint != "https://api.anthropic.com/v1" || cfg.apiKey != "anthropic-key" {
+		t.Errorf("getConfig() model, endpoint, key = %q, %q, %q", cfg.model, cfg.apiEndpoint, cfg.apiKey)
+	}
+}
+
+func TestOpenRouterReasoningFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expected string
+		wantErr  bool
+	}{
+		{"content", `{"choices":[{"message":{"content":"Add feature","reasoning":"thinking"}}]}`, "Add feature", false},
+		{"reasoning_content fallback", `{"choices":[{"message":{"content":"","reasoning_content":"Fix bug"}}]}`, "Fix bug", false},
+		{"reasoning fallback", `{"choices":[{"message":{"content":" ","reasoning":"Update docs"}}]}`, "Update docs", false},
+		{"all empty", `{"choices":[{"message":{"content":""}}]}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.response)
+			}))
+			defer server.Close()
+
+			cfg := config{apiEndpoint: server.URL, model: "deepseek/deepseek-r1"}
+			got, _, err := (openRouterProvider{}).Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openRouterProvider.Describe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("openRouterProvider.Describe() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProvidersForwardConversation(t *testing.T) {
+	messages := []chatMessage{
+		{Role: "system", Content: "You write commit messages."},
+		{Role: "user", Content: "prompt"},
+		{Role: "assistant", Content: "Long message"},
+		{Role: "user", Content: "make it shorter"},
+	}
+	tests := []struct {
+		provider string
+		response string
+	}{
+		{"ollama", `{"message":{"content":"Short"}}`},
+		{"openrouter", `{"choices":[{"message":{"content":"Short"}}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			var got []chatMessage
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Messages []chatMessage `json:"messages"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				got = req.Messages
+				fmt.Fprint(w, tt.response)
+			}))
+			defer server.Close()
+
+			cfg := config{provider: tt.provider, apiEndpoint: server.URL, model: "test"}
+			if _, _, err := describeChanges(context.Background(), cfg, messages); err != nil {
+				t.Fatalf("describeChanges() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, messages) {
+				t.Errorf("request messages = %+v, expected %+v", got, messages)
+			}
+		})
+	}
+}
+
+func TestRefineInteractively(t *testing.T) {
+	var lastMessages []chatMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []chatMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		lastMessages = req.Messages
+		fmt.Fprint(w, `{"message":{"content":"Shorter message"},"prompt_eval_count":10,"eval_count":5}`)
+	}))
+	defer server.Close()
+
+	originalStdin := stdin
+	defer func() { stdin = originalStdin }()
+
+	cfg := config{provider: "ollama", apiEndpoint: server.URL, model: "llama3.2"}
+	messages := []chatMessage{{Role: "user", Content: "prompt"}}
+
+	t.Run("refine then accept", func(t *testing.T) {
+		stdin = strings.NewReader("make it shorter\n\n")
+		var out bytes.Buffer
+		trailers := []trailer{{"Change-Type", "fix"}}
+		description, meta, err := refineInteractively(context.Background(), cfg, &out, messages, "Long message", trailers, responseMetadata{promptTokens: 100, completionTokens: 20})
+		if err != nil {
+			t.Fatalf("refineInteractively() error = %v", err)
+		}
+		if description != "Shorter message" {
+			t.Errorf("refineInteractively() = %q, expected %q", description, "Shorter message")
+		}
+		if !strings.Contains(out.String(), "Shorter message\n\nChange-Type: fix\n") {
+			t.Errorf("refineInteractively() printed %q, expected the trailers after the revised message", out.String())
+		}
+		if meta.promptTokens != 110 || meta.completionTokens != 25 {
+			t.Errorf("refineInteractively() meta = %d + %d tokens, expected both rounds added up to 110 + 25", meta.promptTokens, meta.completionTokens)
+		}
+		if len(lastMessages) != 3 {
+			t.Fatalf("request had %d messages, expected 3", len(lastMessages))
+		}
+		if lastMessages[1].Role != "assistant" || lastMessages[1].Content != "Long message" {
+			t.Errorf("request message[1] = %+v, expected prior assistant message", lastMessages[1])
+		}
+		if !strings.HasPrefix(lastMessages[2].Content, "make it shorter") {
+			t.Errorf("request message[2] = %+v, expected feedback", lastMessages[2])
+		}
+	})
+
+	t.Run("quit", func(t *testing.T) {
+		stdin = strings.NewReader("q\n")
+		_, _, err := refineInteractively(context.Background(), cfg, io.Discard, messages, "Long message", nil, responseMetadata{})
+		if !errors.Is(err, errAborted) {
+			t.Errorf("refineInteractively() error = %v, expected errAborted", err)
+		}
+	})
+}
+
+func TestDetectLanguages(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		expected []string
+	}{
+		{"none", nil, nil},
+		{"single", []string{"main.go"}, []string{"Go"}},
+		{"deduplicated and sorted", []string{"main.go", "config.yaml", "lib/util.go", "ci.yml"}, []string{"Go", "YAML"}},
+		{"by filename", []string{"Dockerfile", "go.mod"}, []string{"Dockerfile", "Go modules"}},
+		{"unknown extension", []string{"data.xyz"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := detectLanguages(tt.paths)
+			if strings.Join(result, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("detectLanguages(%v) = %v, expected %v", tt.paths, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDescribeChangesRetryEmpty(t *testing.T) {
+	tests := []struct {
+		name          string
+		retryEmpty    int
+		expectError   bool
+		expectedCalls int
+	}{
+		{"retry succeeds", 1, false, 2},
+		{"retries disabled", 0, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					fmt.Fprint(w, `{"message":{"content":"  "}}`)
+					return
+				}
+				fmt.Fprint(w, `{"message":{"content":"Add feature"}}`)
+			}))
+			defer server.Close()
+
+			cfg := config{provider: "ollama", apiEndpoint: server.URL, retryEmpty: tt.retryEmpty}
+			description, _, err := describeChanges(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+			if (err != nil) != tt.expectError {
+				t.Fatalf("describeChanges() error = %v, expectError %v", err, tt.expectError)
+			}
+			if tt.expectError && !errors.Is(err, errEmptyResponse) {
+				t.Errorf("describeChanges() error = %v, expected errEmptyResponse", err)
+			}
+			if !tt.expectError && description != "Add feature" {
+				t.Errorf("describeChanges() = %q, expected %q", description, "Add feature")
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("server called %d times, expected %d", calls, tt.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestDescribeChangesLargeContextModel(t *testing.T) {
+	tests := []struct {
+		name           string
+		contextWindow  int
+		largeModel     string
+		expectError    bool
+		expectedModels []string
+	}{
+		{"fallback after context error", 0, "big", false, []string{"small", "big"}},
+		{"fallback from estimate", 1, "big", false, []string{"big"}},
+		{"no fallback configured", 0, "", true, []string{"small"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var models []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Model string `json:"model"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				models = append(models, req.Model)
+				if req.Model == "small" {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"error":{"code":"context_length_exceeded"}}`)
+					return
+				}
+				fmt.Fprint(w, `{"message":{"content":"Add feature"}}`)
+			}))
+			defer server.Close()
+
+			cfg := config{provider: "ollama", apiEndpoint: server.URL, model: "small", largeContextModel: tt.largeModel, contextWindow: tt.contextWindow}
+			_, _, err := describeChanges(context.Background(), cfg, []chatMessage{{Role: "user", Content: "a prompt longer than one token"}})
+			if (err != nil) != tt.expectError {
+				t.Fatalf("describeChanges() error = %v, expectError %v", err, tt.expectError)
+			}
+			if tt.expectError && !errors.Is(err, errContextLength) {
+				t.Errorf("describeChanges() error = %v, expected errContextLength", err)
+			}
+			if strings.Join(models, ",") != strings.Join(tt.expectedModels, ",") {
+				t.Errorf("requested models = %v, expected %v", models, tt.expectedModels)
+			}
+		})
+	}
+}
+
+func TestCompareModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if req.Model == "broken" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `model not found`)
+			return
+		}
+		fmt.Fprintf(w, `{"model":%q,"message":{"content":"Message from %s"},"prompt_eval_count":10,"eval_count":5}`, req.Model, req.Model)
+	}))
+	defer server.Close()
+
+	cfg := config{provider: "ollama", apiEndpoint: server.URL, compareModels: []string{"llama3.2", "broken", "qwen3"}}
+	var out bytes.Buffer
+	compareModels(context.Background(), cfg, &out, []chatMessage{{Role: "user", Content: "prompt"}})
+
+	got := out.String()
+	for _, expected := range []string{
+		"=== llama3.2 (",
+		"10 prompt + 5 completion tokens) ===\nMessage from llama3.2\n",
+		"=== broken (failed after ",
+		"API request failed with status 404",
+		"Message from qwen3\n",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("compareModels() output missing %q:\n%s", expected, got)
+		}
+	}
+}
+
+func TestFormatDiffStat(t *testing.T) {
+	files := []stagedFile{
+		{path: "main.go", added: 15, removed: 3},
+		{path: "README.md", added: 1, removed: 0},
+	}
+	expected := " main.go   | +15 -3\n" +
+		" README.md | +1 -0\n" +
+		" 2 files changed, 16 insertions(+), 3 deletions(-)\n"
+	if result := formatDiffStat(files); result != expected {
+		t.Errorf("formatDiffStat() = %q, expected %q", result, expected)
+	}
+
+	single := formatDiffStat([]stagedFile{{path: "a", added: 1, removed: 1}})
+	if !strings.HasSuffix(single, " 1 file changed, 1 insertion(+), 1 deletion(-)\n") {
+		t.Errorf("formatDiffStat() = %q, expected singular summary", single)
+	}
+}
+
+func TestContextBudget(t *testing.T) {
+	tests := []struct {
+		maxLines       int
+		used           []string
+		expectedBudget int
+		expectedOK     bool
+	}{
+		{0, []string{"a\nb\n"}, 0, true},
+		{5, []string{"a\nb\n"}, 3, true},
+		{5, []string{"a\nb\n", "c\n"}, 2, true},
+		{2, []string{"a\nb\n"}, 0, false},
+		{2, []string{"a\nb\nc\n"}, 0, false},
+	}
+	for _, tt := range tests {
+		budget, ok := contextBudget(tt.maxLines, tt.used...)
+		if budget != tt.expectedBudget || ok != tt.expectedOK {
+			t.Errorf("contextBudget(%d, %q) = %d, %v, expected %d, %v", tt.maxLines, tt.used, budget, ok, tt.expectedBudget, tt.expectedOK)
+		}
+	}
+}
+
+func TestReadContextFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "DESIGN.md")
+	if err := os.WriteFile(path, []byte("line 1\nline 2\nline 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	full, truncated, err := readContextFile(path, 0)
+	if err != nil {
+		t.Fatalf("readContextFile() error = %v", err)
+	}
+	if full != "line 1\nline 2\nline 3" || truncated {
+		t.Errorf("readContextFile() = %q, %v, expected full content", full, truncated)
+	}
+
+	limited, truncated, err := readContextFile(path, 2)
+	if err != nil {
+		t.Fatalf("readContextFile() error = %v", err)
+	}
+	if limited != "line 1\nline 2\n[... 1 line truncated ...]" || !truncated {
+		t.Errorf("readContextFile() = %q, %v, expected truncation to 2 lines", limited, truncated)
+	}
+
+	if _, _, err := readContextFile(filepath.Join(t.TempDir(), "missing.md"), 0); err == nil {
+		t.Error("readContextFile() expected error for missing file")
+	}
+}
+
+func TestParseAuthor(t *testing.T) {
+	tests := []struct {
+		author        string
+		expectError   bool
+		expectedName  string
+		expectedEmail string
+	}{
+		{"Jane Doe <jane@example.com>", false, "Jane Doe", "jane@example.com"},
+		{"  Jane <jane@example.com>  ", false, "Jane", "jane@example.com"},
+		{"jane@example.com", true, "", ""},
+		{"<jane@example.com>", true, "", ""},
+		{"Jane Doe <>", true, "", ""},
+		{"Jane <jane@example.com", true, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.author, func(t *testing.T) {
+			sig, err := parseAuthor(tt.author)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("parseAuthor(%q) error = %v, expectError %v", tt.author, err, tt.expectError)
+			}
+			if !tt.expectError && (sig.Name != tt.expectedName || sig.Email != tt.expectedEmail) {
+				t.Errorf("parseAuthor(%q) = %s <%s>, expected %s <%s>", tt.author, sig.Name, sig.Email, tt.expectedName, tt.expectedEmail)
+			}
+		})
+	}
+}
+
+func TestCommitChangesAuthorOverride(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.User.Name = "Me"
+	cfg.User.Email = "me@example.com"
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	stageTestFile(t, repo, fs, "notes.txt", "hello\n")
+
+	hash, err := commitChanges(repo, "Add notes", "Pair Partner <pair@example.com>")
+	if err != nil {
+		t.Fatalf("commitChanges() error = %v", err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Author.Name != "Pair Partner" || commit.Author.Email != "pair@example.com" {
+		t.Errorf("author = %s <%s>, expected override", commit.Author.Name, commit.Author.Email)
+	}
+	if commit.Committer.Name != "Me" || commit.Committer.Email != "me@example.com" {
+		t.Errorf("committer = %s <%s>, expected configured user", commit.Committer.Name, commit.Committer.Email)
+	}
+	if commit.Message != "Add notes\n" {
+		t.Errorf("message = %q, expected %q", commit.Message, "Add notes\n")
+	}
+}
+
+func TestResolveModelPrompt(t *testing.T) {
+	modelPrompts := map[string]string{
+		"llama":                       "small model prompt",
+		"llama3.2":                    "exact prompt",
+		"anthropic/":                  "claude prompt",
+		"anthropic/claude-4.5-sonnet": "sonnet prompt",
+	}
+	tests := []struct {
+		model    string
+		expected string
+		found    bool
+	}{
+		{"llama3.2", "exact prompt", true},
+		{"llama3.1", "small model prompt", true},
+		{"anthropic/claude-4.5-sonnet", "sonnet prompt", true},
+		{"anthropic/claude-3-haiku", "claude prompt", true},
+		{"mistral", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			result, found := resolveModelPrompt(modelPrompts, tt.model)
+			if result != tt.expected || found != tt.found {
+				t.Errorf("resolveModelPrompt(%q) = %q, %v, expected %q, %v", tt.model, result, found, tt.expected, tt.found)
+			}
+		})
+	}
+}
+
+func TestBuildPromptModelTemplate(t *testing.T) {
+	cfg := config{
+		output:         "commit",
+		promptTemplate: template.Must(template.New("prompt").Parse("Describe in {{.Languages}}:\n{{.Changes}}")),
+	}
+	prompt, err := buildPrompt(cfg, promptData{Changes: "diff", Languages: "Go"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if prompt != "Describe in Go:\ndiff" {
+		t.Errorf("buildPrompt() = %q, expected rendered template", prompt)
+	}
+}
+
+func TestBuildPromptTemplateExtras(t *testing.T) {
+	data := promptData{Changes: "diff", Blame: "@@ -1 +1 @@ by you, 2 days ago", Stash: "a.go: overlap"}
+	tests := []struct {
+		name       string
+		cfg        config
+		expected   []string
+		unexpected []string
+	}{
+		{
+			"preset",
+			config{output: "commit", review: true, trailersFromAnalysis: true, promptTemplate: template.Must(template.New("concise").Parse(promptPresets["concise"]))},
+			[]string{reviewSeparator, analysisSeparator, "applying them together may conflict", "Blame of the changed lines"},
+			nil,
+		},
+		{
+			"template using the blame",
+			config{output: "commit", promptTemplate: template.Must(template.New("detailed").Parse(promptPresets["detailed"]))},
+			[]string{"applying them together may conflict"},
+			[]string{reviewSeparator, analysisSeparator, "tell fixes to recently written code"},
+		},
+		{
+			"prompt file",
+			config{output: "commit", trailersFromAnalysis: true, promptFile: "prompt.txt", promptTemplate: template.Must(template.New("file").Parse("{{.Changes}}"))},
+			[]string{analysisSeparator},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := buildPrompt(tt.cfg, data)
+			if err != nil {
+				t.Fatalf("buildPrompt() error = %v", err)
+			}
+			for _, want := range tt.expected {
+				if !strings.Contains(prompt, want) {
+					t.Errorf("buildPrompt() missing %q:\n%s", want, prompt)
+				}
+			}
+			for _, unwanted := range tt.unexpected {
+				if strings.Contains(prompt, unwanted) {
+					t.Errorf("buildPrompt() unexpectedly has %q:\n%s", unwanted, prompt)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPromptTemplateFields(t *testing.T) {
+	cfg := config{
+		output:         "commit",
+		promptTemplate: template.Must(template.New("prompt").Parse("{{.FileCount}} files changed in {{.Languages}} on {{.Branch}} (+{{.Added}} -{{.Removed}}): {{range .Files}}{{.}} {{end}}")),
+	}
+	files := []stagedFile{{path: "a.go", added: 3, removed: 1}, {path: "b.go", added: 2}}
+	data := promptData{Changes: "diff", Languages: "Go", Branch: "main", FileCount: 2, Files: []string{"a.go", "b.go"}, Added: 5, Removed: 1, DiffStat: formatDiffStat(files)}
+	prompt, err := buildPrompt(cfg, data)
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if expected := "2 files changed in Go on main (+5 -1): a.go b.go "; prompt != expected {
+		t.Errorf("buildPrompt() = %q, expected %q", prompt, expected)
+	}
+}
+
+func TestRevisionAuthor(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "main.go", "package main\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	hash := head.Hash()
+
+	if author, date, ok := revisionAuthor(repo, config{}, &hash); !ok || author != "Test <test@example.com>" || !date.Equal(time.Unix(0, 0)) {
+		t.Errorf("revisionAuthor() = %q, %v, %v, expected the commit author and date", author, date, ok)
+	}
+	if author, _, ok := revisionAuthor(repo, config{}, nil); ok {
+		t.Errorf("revisionAuthor() for staged changes = %q, expected none", author)
+	}
+}
+
+// promptCapture records the last prompt it was sent and answers reply
+type promptCapture struct {
+	prompt *string
+	reply  string
+}
+
+func (p promptCapture) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	*p.prompt = messages[len(messages)-1].Content
+	return p.reply, responseMetadata{}, nil
+}
+
+func TestRunAuthorContextForRevisions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	var prompt string
+	providers["capture"] = promptCapture{prompt: &prompt, reply: "Add main"}
+	defer delete(providers, "capture")
+
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitCfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The note is written by the configured user, not the commit's author
+	gitCfg.User.Name = "Me"
+	gitCfg.User.Email = "me@example.com"
+	if err := repo.SetConfig(gitCfg); err != nil {
+		t.Fatal(err)
+	}
+	stageTestFile(t, repo, w.Filesystem, "main.go", "package main\n")
+	commitTestRepo(t, repo)
+	// -rebase needs the edited commit's parent to compare with
+	stageTestFile(t, repo, w.Filesystem, "main.go", "package main\n\nfunc main() {}\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(root)
+
+	const expected = "Author: Test <test@example.com>\nDate: 1970-01-01T00:00:00Z\n"
+	var out strings.Builder
+	if err := run(context.Background(), &out, []string{"-provider", "capture", "-author-context", "-output", "note", "-add-note", "HEAD"}); err != nil {
+		t.Fatalf("run(-add-note) error = %v", err)
+	}
+	if !strings.Contains(prompt, expected) {
+		t.Errorf("run(-add-note) prompt = %q, expected %q", prompt, expected)
+	}
+
+	gitDir := filepath.Join(root, ".git")
+	if err := os.MkdirAll(filepath.Join(gitDir, "rebase-merge"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "rebase-merge", "amend"), []byte(head.Hash().String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prompt = ""
+	if err := run(context.Background(), &out, []string{"-provider", "capture", "-author-context", "-rebase"}); err != nil {
+		t.Fatalf("run(-rebase) error = %v", err)
+	}
+	if !strings.Contains(prompt, expected) {
+		t.Errorf("run(-rebase) prompt = %q, expected %q", prompt, expected)
+	}
+}
+
+func TestCurrentBranch(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	if branch := currentBranch(repo); branch != "master" {
+		t.Errorf("currentBranch() = %q, expected master for an unborn branch", branch)
+	}
+	stageTestFile(t, repo, fs, "a.txt", "a\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, head.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	if branch := currentBranch(repo); branch != "" {
+		t.Errorf("currentBranch() = %q, expected none for a detached HEAD", branch)
+	}
+}
+
+func TestNormalizeCommitMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{"already normalized", "Subject\n\nBody\n", "Subject\n\nBody\n"},
+		{"missing trailing newline", "Subject", "Subject\n"},
+		{"leading blank lines", "\n  \nSubject\n\nBody", "Subject\n\nBody\n"},
+		{"multiple trailing newlines", "Subject\n\nBody\n\n\n", "Subject\n\nBody\n"},
+		{"body structure preserved", "Subject\n\nPara one\n\nPara two\n", "Subject\n\nPara one\n\nPara two\n"},
+		{"CRLF line endings", "Subject\r\n\r\nBody\r\n", "Subject\n\nBody\n"},
+		{"empty", "\n\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := normalizeCommitMessage(tt.message)
+			if result != tt.expected {
+				t.Errorf("normalizeCommitMessage(%q) = %q, expected %q", tt.message, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSeparateSubject(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		body     bool
+		expected string
+	}{
+		{"already separated", "Subject\n\nBody", true, "Subject\n\nBody"},
+		{"missing blank line", "Subject\nBody line one\nBody line two", true, "Subject\n\nBody line one\nBody line two"},
+		{"several blank lines", "Subject\n\n\n\nBody", true, "Subject\n\nBody"},
+		{"separator line", "Subject\n---\nBody", true, "Subject\n\nBody"},
+		{"separator between blank lines", "Subject\n\n= = =\n\nBody", true, "Subject\n\nBody"},
+		{"body paragraphs kept", "Subject\nPara one\n\nPara two\n\n", true, "Subject\n\nPara one\n\nPara two"},
+		{"subject only", "  Subject  \n\n", true, "Subject"},
+		{"no body wanted", "Subject\n\nBody the model added anyway", false, "Subject"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := separateSubject(tt.message, tt.body)
+			if result != tt.expected {
+				t.Errorf("separateSubject(%q, %v) = %q, expected %q", tt.message, tt.body, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	patch := "diff --git a/a.txt b/a.txt\n" +
+		"index 1111111..2222222 100644\n" +
+		"--- a/a.txt\n" +
+		"+++ b/a.txt\n" +
+		"@@ -1 +1 @@\n-old\n+new\n" +
+		"@@ -10 +10 @@\n-x\n+y\n" +
+		"diff --git a/b.txt b/b.txt\n" +
+		"new file mode 100644\n" +
+		"--- /dev/null\n" +
+		"+++ b/b.txt\n" +
+		"@@ -0,0 +1 @@\n+hello\n"
+
+	files := parsePatch(patch)
+	if len(files) != 2 {
+		t.Fatalf("parsePatch() returned %d files, expected 2", len(files))
+	}
+	if files[0].path != "a.txt" || len(files[0].hunks) != 2 {
+		t.Errorf("files[0] = %s with %d hunks, expected a.txt with 2", files[0].path, len(files[0].hunks))
+	}
+	if files[1].path != "b.txt" || len(files[1].hunks) != 1 {
+		t.Errorf("files[1] = %s with %d hunks, expected b.txt with 1", files[1].path, len(files[1].hunks))
+	}
+	if files[0].String()+files[1].String() != patch {
+		t.Error("reassembled patch does not match the input")
+	}
+}
+
+func TestSelectHunks(t *testing.T) {
+	patch := "diff --git a/a.txt b/a.txt\n" +
+		"--- a/a.txt\n" +
+		"+++ b/a.txt\n" +
+		"@@ -1 +1 @@\n-old\n+new\n" +
+		"@@ -10 +10,2 @@\n x\n+y\n" +
+		"diff --git a/b.txt b/b.txt\n" +
+		"--- /dev/null\n" +
+		"+++ b/b.txt\n" +
+		"@@ -0,0 +1 @@\n+hello\n"
+	files := []stagedFile{
+		{path: "a.txt", status: git.Modified, added: 2, removed: 1},
+		{path: "b.txt", status: git.Added, added: 1},
+	}
+
+	// skip the first hunk, take the second, skip the whole of b.txt
+	result, kept, err := selectHunks(patch, files, strings.NewReader("n\ny\nd\n"), io.Discard)
+	if err != nil {
+		t.Fatalf("selectHunks() error = %v", err)
+	}
+	expected := "diff --git a/a.txt b/a.txt\n" +
+		"--- a/a.txt\n" +
+		"+++ b/a.txt\n" +
+		"@@ -10 +10,2 @@\n x\n+y\n"
+	if result != expected {
+		t.Errorf("selectHunks() = %q, expected %q", result, expected)
+	}
+	if len(kept) != 1 || kept[0].path != "a.txt" || kept[0].added != 1 || kept[0].removed != 0 {
+		t.Errorf("selectHunks() kept %+v, expected a.txt with +1 -0", kept)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	patch := "diff --git a/a.txt b/a.txt\n@@ -1 +1 @@\n-old\n+new\n" +
+		"diff --git a/b.txt b/b.txt\n@@ -0,0 +1 @@\n+hello\n" +
+		"diff --git a/c.txt b/c.txt\n@@ -0,0 +1 @@\n+bye\n"
+	files := []stagedFile{
+		{path: "a.txt", status: git.Modified},
+		{path: "b.txt", status: git.Added},
+		{path: "c.txt", status: git.Added},
+	}
+
+	// the first answer is out of range and asked again
+	var out bytes.Buffer
+	result, kept, err := selectFiles(patch, files, strings.NewReader("7\n1,3\n"), &out)
+	if err != nil {
+		t.Fatalf("selectFiles() error = %v", err)
+	}
+	expected := "diff --git a/b.txt b/b.txt\n@@ -0,0 +1 @@\n+hello\n"
+	if result != expected {
+		t.Errorf("selectFiles() = %q, expected %q", result, expected)
+	}
+	if len(kept) != 1 || kept[0].path != "b.txt" {
+		t.Errorf("selectFiles() kept %+v, expected b.txt", kept)
+	}
+	for _, want := range []string{"  1. Modified a.txt", "  2. Added    b.txt", "out of range: 7"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("selectFiles() output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	if result, _, err := selectFiles(patch, files, strings.NewReader("\n"), io.Discard); err != nil || result != patch {
+		t.Errorf("selectFiles() with empty answer = %q, %v, expected the whole patch", result, err)
+	}
+	if _, _, err := selectFiles(patch, files, strings.NewReader("1-3\n"), io.Discard); err == nil {
+		t.Errorf("selectFiles() excluding every file expected error")
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []int
+		wantErr  bool
+	}{
+		{"", nil, false},
+		{"2", []int{2}, false},
+		{"1 3-4", []int{1, 3, 4}, false},
+		{"1,2", []int{1, 2}, false},
+		{"0", nil, true},
+		{"4-2", nil, true},
+		{"x", nil, true},
+		{"2-y", nil, true},
+		{"5", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSelection(tt.input, 4)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSelection(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		var numbers []int
+		for i := 1; i <= 4; i++ {
+			if got[i] {
+				numbers = append(numbers, i)
+			}
+		}
+		if !reflect.DeepEqual(numbers, tt.expected) {
+			t.Errorf("parseSelection(%q) = %v, expected %v", tt.input, numbers, tt.expected)
+		}
+	}
+}
+
+func TestAnalyzeDiff(t *testing.T) {
+	a := analyzeDiff(splitLines("1\n2\n3\n4\n5\n6\n7\n8\n9\n"), splitLines("1\n2\n3\n4\nX\nY\n6\n7\n8\n9\n"))
+	expected := "old lines: 9, new lines: 10\n" +
+		"common prefix: 4, common suffix: 4\n" +
+		"removed: old 5-5 (1 lines)\n" +
+		"added: new 5-6 (2 lines)\n" +
+		"hunk: @@ -2,7 +2,8 @@\n"
+	if a.String() != expected {
+		t.Errorf("analyzeDiff().String() = %q, expected %q", a.String(), expected)
+	}
+
+	twoHunks := analyzeDiff(splitLines("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"), splitLines("1\nA\n3\n4\n5\n6\n7\n8\n9\nB\n11\n"))
+	expected = "old lines: 11, new lines: 11\n" +
+		"common prefix: 1, common suffix: 1\n" +
+		"removed: old 2-10 (9 lines)\n" +
+		"added: new 2-10 (9 lines)\n" +
+		"hunk: @@ -1,5 +1,5 @@\n" +
+		"hunk: @@ -7,5 +7,5 @@\n"
+	if twoHunks.String() != expected {
+		t.Errorf("analyzeDiff().String() = %q, expected %q", twoHunks.String(), expected)
+	}
+
+	unchanged := analyzeDiff([]string{"a"}, []string{"a"})
+	if unchanged.String() != "old lines: 1, new lines: 1, no changes\n" {
+		t.Errorf("analyzeDiff().String() = %q for unchanged input", unchanged.String())
+	}
+}
+
+func TestInferScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		paths         []string
+		expectedDir   string
+		expectedScope string
+	}{
+		{"none", nil, "", ""},
+		{"single directory", []string{"auth/login.go", "auth/session.go"}, "auth", "auth"},
+		{"nested directory", []string{"internal/auth/login.go", "internal/auth/token/jwt.go"}, "internal/auth", "auth"},
+		{"different top-level", []string{"auth/login.go", "web/index.html"}, "", ""},
+		{"root file", []string{"main.go", "auth/login.go"}, "", ""},
+		{"similar names", []string{"api/v1/a.go", "api/v10/b.go"}, "api", "api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if dir := commonDirPrefix(tt.paths); dir != tt.expectedDir {
+				t.Errorf("commonDirPrefix(%v) = %q, expected %q", tt.paths, dir, tt.expectedDir)
+			}
+			if scope := inferScope(tt.paths); scope != tt.expectedScope {
+				t.Errorf("inferScope(%v) = %q, expected %q", tt.paths, scope, tt.expectedScope)
+			}
+		})
+	}
+}
+
+func TestCodeOwners(t *testing.T) {
+	rules := parseCodeowners(`# Default owners
+*       @acme/core
+
+/docs/  @acme/docs jane@example.com
+*.go    @acme/backend  # Go code
+[Payments]
+/apps/payments/ @acme/payments
+/apps/payments/vendor/
+`)
+
+	tests := []struct {
+		name            string
+		paths           []string
+		expectedSummary string
+		expectedScope   string
+	}{
+		{"none", nil, "", ""},
+		{"single team", []string{"apps/payments/card.ts", "apps/payments/refund.ts"}, "@acme/payments: 2 files", "payments"},
+		{"last match wins", []string{"docs/api.go"}, "@acme/backend: 1 file", "backend"},
+		{"several owners", []string{"docs/index.md"}, "@acme/docs: 1 file\njane@example.com: 1 file", "docs"},
+		{"mixed teams", []string{"main.go", "README.md"}, "@acme/backend: 1 file\n@acme/core: 1 file", ""},
+		{"unowned", []string{"apps/payments/vendor/lib.js"}, "", ""},
+		{"unowned and owned", []string{"apps/payments/vendor/lib.js", "apps/payments/card.ts"}, "@acme/payments: 1 file", "payments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary, scope := codeOwners(rules, tt.paths)
+			if summary != tt.expectedSummary || scope != tt.expectedScope {
+				t.Errorf("codeOwners(%v) = %q, %q, expected %q, %q", tt.paths, summary, scope, tt.expectedSummary, tt.expectedScope)
+			}
+		})
+	}
+}
+
+func TestReadCodeowners(t *testing.T) {
+	fs := memfs.New()
+	rules, err := readCodeowners(fs)
+	if err != nil || rules != nil {
+		t.Errorf("readCodeowners() without CODEOWNERS = %v, %v, expected no rules", rules, err)
+	}
+
+	writeTestFile(t, fs, ".github/CODEOWNERS", "* @acme/core\n")
+	rules, err = readCodeowners(fs)
+	if err != nil {
+		t.Fatalf("readCodeowners() error = %v", err)
+	}
+	if owners := fileOwners(rules, "main.go"); !reflect.DeepEqual(owners, []string{"@acme/core"}) {
+		t.Errorf("fileOwners() = %v, expected [@acme/core]", owners)
+	}
+}
+
+func TestEmailOwnerScope(t *testing.T) {
+	_, scope := codeOwners(parseCodeowners("* jane@example.com\n"), []string{"main.go"})
+	if scope != "jane" {
+		t.Errorf("codeOwners() scope = %q, expected %q", scope, "jane")
+	}
+}
+
+func TestBuildPromptConventionalScope(t *testing.T) {
+	suggested, err := buildPrompt(config{output: "commit", conventional: true}, promptData{Changes: "diff", Scope: "auth"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if !strings.Contains(suggested, "Conventional Commits") || !strings.Contains(suggested, "Suggested scope (from the changed paths): auth") {
+		t.Errorf("buildPrompt() missing conventional instructions or suggested scope:\n%s", suggested)
+	}
+	for _, want := range []string{"feat for new behavior", "chore for build", "BREAKING CHANGE:"} {
+		if !strings.Contains(suggested, want) {
+			t.Errorf("buildPrompt() missing %q:\n%s", want, suggested)
+		}
+	}
+
+	forced, err := buildPrompt(config{output: "commit", conventional: true, scope: "api"}, promptData{Changes: "diff", Scope: "api"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if !strings.Contains(forced, `Scope: use "api" as the commit scope.`) {
+		t.Errorf("buildPrompt() missing forced scope:\n%s", forced)
+	}
+}
+
+func TestRunTimeRecord(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	last, err := lastRunTime()
+	if err != nil {
+		t.Fatalf("lastRunTime() error = %v", err)
+	}
+	if !last.IsZero() {
+		t.Errorf("lastRunTime() = %v, expected zero time before any run", last)
+	}
+
+	now := time.Now()
+	if err := recordRunTime(now); err != nil {
+		t.Fatalf("recordRunTime() error = %v", err)
+	}
+	last, err = lastRunTime()
+	if err != nil {
+		t.Fatalf("lastRunTime() error = %v", err)
+	}
+	if !last.Equal(now) {
+		t.Errorf("lastRunTime() = %v, expected %v", last, now)
+	}
+}
+
+func TestLastDiffRecord(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Chdir(t.TempDir())
+
+	path, err := lastDiffFile(nil)
+	if err != nil {
+		t.Fatalf("lastDiffFile() error = %v", err)
+	}
+	const diff = "diff --git a/a.go b/a.go\n@@ -1 +1 @@\n-a\n+b\n"
+	if diffUnchanged(path, diff) {
+		t.Error("diffUnchanged() = true, expected false before any run")
+	}
+	if err := os.WriteFile(path, []byte(diffHash(diff)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !diffUnchanged(path, diff) {
+		t.Error("diffUnchanged() = false, expected true for the recorded diff")
+	}
+	if diffUnchanged(path, diff+"+c\n") {
+		t.Error("diffUnchanged() = true, expected false for a different diff")
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name            string
+		message         string
+		expectedSubject string
+		expectedBody    string
+	}{
+		{"subject only", "Add feature", "Add feature", ""},
+		{"subject and body", "Add feature\n\nLonger explanation.\n\nMore.", "Add feature", "Longer explanation.\n\nMore."},
+		{"no blank separator", "Add feature\nExplanation", "Add feature", "Explanation"},
+		{"surrounding whitespace", "\n  Add feature  \n\n Body \n", "Add feature", "Body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, body := splitMessage(tt.message)
+			if subject != tt.expectedSubject || body != tt.expectedBody {
+				t.Errorf("splitMessage(%q) = %q, %q, expected %q, %q", tt.message, subject, body, tt.expectedSubject, tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestGetCommitChanges(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, fs, "a.txt", "one\ntwo\n")
+	stageTestFile(t, repo, fs, "b.txt", "new\n")
+	commitTestRepo(t, repo)
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := getCommitChanges(context.Background(), repo, config{maxLines: 10000}, head.Hash())
+	if err != nil {
+		t.Fatalf("getCommitChanges() error = %v", err)
+	}
+
+	expected := "diff --git a/a.txt b/a.txt\n" +
+		"index " + blobHash("one\n") + ".." + blobHash("one\ntwo\n") + " 100644\n" +
+		"--- a/a.txt\n" +
+		"+++ b/a.txt\n" +
+		"@@ -1 +1,2 @@\n" +
+		" one\n" +
+		"+two\n" +
+		"diff --git a/b.txt b/b.txt\n" +
+		"new file mode 100644\n" +
+		"index 0000000.." + blobHash("new\n") + "\n" +
+		"--- /dev/null\n" +
+		"+++ b/b.txt\n" +
+		"@@ -0,0 +1 @@\n" +
+		"+new\n"
+	if result.patch != expected {
+		t.Errorf("getCommitChanges() =\n%s\nexpected\n%s", result.patch, expected)
+	}
+}
+
+func TestGetCommitChangesShallow(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A commit at the edge of a shallow clone: its parent was never fetched
+	commit.ParentHashes = []plumbing.Hash{plumbing.NewHash("1111111111111111111111111111111111111111")}
+	hash, err := storeObject(repo, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := getCommitChanges(context.Background(), repo, config{maxLines: 10000}, hash)
+	if err != nil {
+		t.Fatalf("getCommitChanges() error = %v", err)
+	}
+	if !strings.Contains(result.patch, "new file mode 100644") || !strings.Contains(result.patch, "+one") {
+		t.Errorf("getCommitChanges() did not describe the commit against an empty tree:\n%s", result.patch)
+	}
+	if !strings.Contains(result.note, "shallow clone") {
+		t.Errorf("getCommitChanges() note = %q, expected a shallow clone note", result.note)
+	}
+}
+
+func TestAddNote(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.User.Name = "Me"
+	cfg.User.Email = "me@example.com"
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, note := range []string{"First note", "Second note"} {
+		if err := addNote(repo, head.Hash(), note); err != nil {
+			t.Fatalf("addNote() error = %v", err)
+		}
+	}
+
+	ref, err := repo.Reference(notesRef, true)
+	if err != nil {
+		t.Fatalf("notes ref: %v", err)
+	}
+	notesCommit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notesCommit.NumParents() != 1 {
+		t.Errorf("notes commit parents = %d, expected 1", notesCommit.NumParents())
+	}
+	tree, err := notesCommit.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Entries) != 1 {
+		t.Fatalf("notes tree entries = %d, expected 1", len(tree.Entries))
+	}
+	file, err := tree.File(head.Hash().String())
+	if err != nil {
+		t.Fatalf("note for %s: %v", head.Hash(), err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "Second note\n" {
+		t.Errorf("note = %q, expected %q", content, "Second note\n")
+	}
+}
+
+func TestAssembleChangesBinaryNote(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 2040)
+	changes := []fileChange{{path: "docs/shot.png", status: git.Added, newContent: png, binary: true}}
+
+	result, err := assembleChanges(context.Background(), config{}, changes)
+	if err != nil {
+		t.Fatalf("assembleChanges() error = %v", err)
+	}
+	expected := "diff --git a/docs/shot.png b/docs/shot.png\nbinary file added: docs/shot.png (2kB, image/png)\n"
+	if result.patch != expected {
+		t.Errorf("assembleChanges() = %q, expected %q", result.patch, expected)
+	}
+	if len(result.files) != 1 || result.files[0].path != "docs/shot.png" {
+		t.Errorf("assembleChanges() files = %+v, expected docs/shot.png", result.files)
+	}
+}
+
+func TestSubjectPrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		paths    []string
+		message  string
+		expected string
+	}{
+		{"static", "[api]", []string{"main.go"}, "Add endpoint\n\nBody", "[api] Add endpoint\n\nBody"},
+		{"auto", "auto", []string{"web/src/a.ts", "web/src/b.ts"}, "Fix layout", "[web] Fix layout"},
+		{"auto at root", "auto", []string{"web/a.ts", "api/b.go"}, "Fix layout", "Fix layout"},
+		{"already prefixed", "[api]", []string{"main.go"}, "[api] Add endpoint", "[api] Add endpoint"},
+		{"none", "", []string{"main.go"}, "Add endpoint", "Add endpoint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := addSubjectPrefix(tt.message, subjectPrefix(tt.prefix, tt.paths))
+			if result != tt.expected {
+				t.Errorf("addSubjectPrefix() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplySubjectStyle(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		rules    []string
+		expected string
+	}{
+		{"no rules", "Added parser.", nil, "Added parser."},
+		{"capital", "add parser", []string{"capital"}, "Add parser"},
+		{"lowercase", "Add parser", []string{"lowercase"}, "add parser"},
+		{"lowercase keeps acronyms", "API keys are optional", []string{"lowercase"}, "API keys are optional"},
+		{"no period", "Add parser.\n\nBody text.", []string{"no-period"}, "Add parser\n\nBody text."},
+		{"ellipsis kept", "Add parser...", []string{"no-period"}, "Add parser..."},
+		{"imperative past tense", "Added parser", []string{"imperative"}, "Add parser"},
+		{"imperative third person", "fixes crash on empty diff", []string{"imperative"}, "fix crash on empty diff"},
+		{"imperative unknown verb", "Wired up parser", []string{"imperative"}, "Wired up parser"},
+		{"conventional lowercase after type", "feat(api): Added Endpoint.", []string{"lowercase", "no-period", "imperative"}, "feat(api): add Endpoint"},
+		{"conventional breaking", "fix!: Removed flag", []string{"imperative", "lowercase"}, "fix!: remove flag"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := applySubjectStyle(tt.message, tt.rules); result != tt.expected {
+				t.Errorf("applySubjectStyle() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		clean    bool
+		expected string
+	}{
+		{"plain message", "Fix parser\n\n- Handle empty input", true, "Fix parser\n\n- Handle empty input"},
+		{"fence", "```\nFix parser\n\nBody\n```", false, "Fix parser\n\nBody"},
+		{"fence with language", "```text\nFix parser\n```", true, "Fix parser"},
+		{"heading kept without clean", "# Fix parser", false, "# Fix parser"},
+		{"heading as subject", "# Fix parser crash\n\nBody", true, "Fix parser crash\n\nBody"},
+		{"label heading dropped", "## Summary:\n\nFix parser crash\n\nBody", true, "Fix parser crash\n\nBody"},
+		{"closing hashes", "### Fix parser ###", true, "Fix parser"},
+		{"body heading", "Fix parser\n\n## Details\nBody", true, "Fix parser\n\nDetails\nBody"},
+		{"bullets", "Fix parser\n\n* one\n+ two\n  • nested\n-   three", true, "Fix parser\n\n- one\n- two\n  - nested\n- three"},
+		{"emphasis left alone", "Fix parser\n\n**Note:** slow", true, "Fix parser\n\n**Note:** slow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := plainText(tt.message, tt.clean); result != tt.expected {
+				t.Errorf("plainText() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSubjectStyleConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	cfg, _, err := getConfig([]string{"-subject-style", "lowercase, no-period"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.subjectStyle, []string{"lowercase", "no-period"}) {
+		t.Errorf("getConfig() subjectStyle = %v, expected [lowercase no-period]", cfg.subjectStyle)
+	}
+	for _, value := range []string{"shouting", "capital,lowercase"} {
+		if _, _, err := getConfig([]string{"-subject-style", value}); err == nil {
+			t.Errorf("getConfig() expected error for subject_style %q", value)
+		}
+	}
+}
+
+func TestGetCommitChangesRenameHandling(t *testing.T) {
+	const original = "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\n"
+	const edited = "one\ntwo\nthree\nfour\nfive\nsix\nseven\nEIGHT\n"
+
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "old.txt", original)
+	commitTestRepo(t, repo)
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Remove("old.txt"); err != nil {
+		t.Fatal(err)
+	}
+	stageTestFile(t, repo, fs, "new.txt", edited)
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := "diff --git a/old.txt b/new.txt\n" +
+		"rename from old.txt\n" +
+		"rename to new.txt\n"
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{"content", header +
+			"index " + blobHash(original) + ".." + blobHash(edited) + " 100644\n" +
+			"--- a/old.txt\n" +
+			"+++ b/new.txt\n" +
+			"@@ -5,4 +5,4 @@\n" +
+			" five\n" +
+			" six\n" +
+			" seven\n" +
+			"-eight\n" +
+			"+EIGHT\n"},
+		{"note", header},
+		{"ignore", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			result, err := getCommitChanges(context.Background(), repo, config{maxLines: 10000, renameHandling: tt.mode}, head.Hash())
+			if err != nil {
+				t.Fatalf("getCommitChanges() error = %v", err)
+			}
+			if result.patch != tt.expected {
+				t.Errorf("getCommitChanges() =\n%s\nexpected\n%s", result.patch, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetStagedChangesDetectMoves(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	content := "package util\n\nfunc Max(a, b int) int {\n\tif a > b {\n\t\treturn a\n\t}\n\treturn b\n}\n"
+	stageTestFile(t, repo, fs, "util/max.go", content)
+	stageTestFile(t, repo, fs, "util/empty.go", "")
+	commitTestRepo(t, repo)
+
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"util/max.go", "util/empty.go"} {
+		if _, err := w.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stageTestFile(t, repo, fs, "internal/mathx/max.go", content)
+	stageTestFile(t, repo, fs, "internal/mathx/empty.go", "")
+
+	tests := []struct {
+		name     string
+		detect   bool
+		expected []stagedFile
+	}{
+		{"off", false, []stagedFile{
+			{path: "internal/mathx/empty.go", status: git.Added},
+			{path: "internal/mathx/max.go", status: git.Added, added: 8},
+			{path: "util/empty.go", status: git.Deleted},
+			{path: "util/max.go", status: git.Deleted, removed: 8},
+		}},
+		{"on", true, []stagedFile{
+			{path: "internal/mathx/empty.go", status: git.Added},
+			{path: "internal/mathx/max.go", status: git.Renamed},
+			{path: "util/empty.go", status: git.Deleted},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{maxLines: 10000, renameHandling: "content", detectMoves: tt.detect, skipBinaryCheck: true}
+			result, err := getStagedChanges(context.Background(), repo, cfg)
+			if err != nil {
+				t.Fatalf("getStagedChanges() error = %v", err)
+			}
+			if len(result.files) != len(tt.expected) {
+				t.Fatalf("getStagedChanges() files = %+v, expected %+v", result.files, tt.expected)
+			}
+			for i, f := range result.files {
+				e := tt.expected[i]
+				if f.path != e.path || f.status != e.status || f.added != e.added || f.removed != e.removed {
+					t.Errorf("getStagedChanges() file %d = %+v, expected %+v", i, f, e)
+				}
+			}
+			rename := "diff --git a/util/max.go b/internal/mathx/max.go\nrename from util/max.go\nrename to internal/mathx/max.go\n"
+			if tt.detect && !strings.Contains(result.patch, rename) {
+				t.Errorf("getStagedChanges() patch =\n%s\nexpected it to contain\n%s", result.patch, rename)
+			}
+		})
+	}
+}
+
+func TestFindConfigFile(t *testing.T) {
+	home := t.TempDir()
+	xdg := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+
+	writeConfig := func(dir string) string {
+		path := filepath.Join(dir, "describe", "config.yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("provider: ollama\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if _, found := findConfigFile(); found {
+		t.Errorf("findConfigFile() found a config in empty directories")
+	}
+
+	dotConfig := writeConfig(filepath.Join(home, ".config"))
+	if path, found := findConfigFile(); !found || path != dotConfig {
+		t.Errorf("findConfigFile() = %q, %v, expected %q", path, found, dotConfig)
+	}
+
+	xdgConfig := writeConfig(xdg)
+	if path, found := findConfigFile(); !found || path != xdgConfig {
+		t.Errorf("findConfigFile() = %q, %v, expected %q", path, found, xdgConfig)
+	}
+}
+
+func TestDiffStats(t *testing.T) {
+	files := []stagedFile{
+		{path: "main.go", added: 15, removed: 3},
+		{path: "README.md", added: 1},
+	}
+	data, err := json.Marshal(diffStats(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"README.md":{"added":1,"removed":0},"main.go":{"added":15,"removed":3}}`
+	if string(data) != expected {
+		t.Errorf("diffStats() = %s, expected %s", data, expected)
+	}
+}
+
+func TestGetStagedChangesSkipBinaryCheck(t *testing.T) {
+	const content = "data\x00more\n"
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "blob.dat", content)
+
+	tests := []struct {
+		name       string
+		skip       bool
+		wantBinary bool
+	}{
+		{"checked", false, true},
+		{"skipped", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000, binaryFiles: "note", skipBinaryCheck: tt.skip})
+			if err != nil {
+				t.Fatalf("getStagedChanges() error = %v", err)
+			}
+			if got := strings.Contains(result.patch, "binary file added: blob.dat"); got != tt.wantBinary {
+				t.Errorf("getStagedChanges() binary note = %v, expected %v:\n%s", got, tt.wantBinary, result.patch)
+			}
+		})
+	}
+}
+
+func TestDetectProvider(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"models":[]}`)
+	}))
+	defer ollama.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	tests := []struct {
+		name         string
+		endpoint     string
+		apiKey       string
+		openAIKey    string
+		anthropicKey string
+		expected     string
+		expectedKey  string
+		wantErr      bool
+	}{
+		{"ollama reachable", ollama.URL, "key", "", "", "ollama", "", false},
+		{"openrouter key", down.URL, "key", "openai-key", "anthropic-key", "openrouter", "key", false},
+		{"openai key", down.URL, "", "openai-key", "anthropic-key", "openai", "openai-key", false},
+		{"anthropic key", down.URL, "", "", "anthropic-key", "anthropic", "anthropic-key", false},
+		{"nothing available", down.URL, "", "", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_API_KEY", tt.openAIKey)
+			t.Setenv("ANTHROPIC_API_KEY", tt.anthropicKey)
+			provider, key, err := detectProvider(tt.endpoint, tt.apiKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("detectProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if provider != tt.expected || key != tt.expectedKey {
+				t.Errorf("detectProvider() = %q, %q, expected %q, %q", provider, key, tt.expected, tt.expectedKey)
+			}
+		})
+	}
+}
+
+func TestGetConfigAutoEndpoint(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"models":[]}`)
+	}))
+	defer ollama.Close()
+
+	cfg, _, err := getConfig([]string{"-provider", "auto", "-endpoint", ollama.URL + "/"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.provider != "ollama" || cfg.apiEndpoint != ollama.URL || cfg.model != "llama3.2" {
+		t.Errorf("getConfig() = %q at %q with %q, expected ollama at %q with llama3.2", cfg.provider, cfg.apiEndpoint, cfg.model, ollama.URL)
+	}
+}
+
+func TestPolishMessage(t *testing.T) {
+	var model, content string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model    string        `json:"model"`
+			Messages []chatMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		model, content = req.Model, req.Messages[0].Content
+		fmt.Fprint(w, `{"message":{"content":"Fix the parser"}}`)
+	}))
+	defer server.Close()
+
+	cfg := config{provider: "ollama", apiEndpoint: server.URL, model: "llama3.2", polishModel: "qwen3"}
+	polished, _, err := polishMessage(context.Background(), cfg, "Fixs the parser")
+	if err != nil {
+		t.Fatalf("polishMessage() error = %v", err)
+	}
+	if polished != "Fix the parser" {
+		t.Errorf("polishMessage() = %q, expected %q", polished, "Fix the parser")
+	}
+	if model != "qwen3" {
+		t.Errorf("polish model = %q, expected %q", model, "qwen3")
+	}
+	if !strings.HasSuffix(content, "Text:\nFixs the parser") {
+		t.Errorf("polish prompt = %q, expected it to end with the message", content)
+	}
+}
+
+func TestSplitObservations(t *testing.T) {
+	tests := []struct {
+		name                 string
+		response             string
+		expectedMessage      string
+		expectedObservations string
+	}{
+		{"with observations", "Add parser\n\nDetails.\n\n--- Observations ---\n- Missing error check\n", "Add parser\n\nDetails.", "- Missing error check"},
+		{"no separator", "Add parser\n", "Add parser", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, observations := splitObservations(tt.response)
+			if message != tt.expectedMessage || observations != tt.expectedObservations {
+				t.Errorf("splitObservations() = %q, %q, expected %q, %q", message, observations, tt.expectedMessage, tt.expectedObservations)
+			}
+		})
+	}
+}
+
+func TestDetectBinaries(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	expected := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("file%d", i)
+		content := "text\n"
+		if i%3 == 0 {
+			content = "bin\x00ary"
+			expected[path] = true
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	paths = append(paths, "missing")
+
+	for _, concurrency := range []int{0, 1, 4} {
+		if got := detectBinaries(context.Background(), osfs.New(dir), paths, concurrency); !reflect.DeepEqual(got, expected) {
+			t.Errorf("detectBinaries(concurrency %d) = %v, expected %v", concurrency, got, expected)
+		}
+	}
+}
+
+func TestPromptPresets(t *testing.T) {
+	data := promptData{Changes: "diff --git a/api/x.go b/api/x.go\n", Languages: "Go", Scope: "api"}
+	for _, name := range presetNames() {
+		t.Run(name, func(t *testing.T) {
+			cfg := config{output: "commit", promptTemplate: template.Must(template.New(name).Parse(promptPresets[name]))}
+			prompt, err := buildPrompt(cfg, data)
+			if err != nil {
+				t.Fatalf("buildPrompt() error = %v", err)
+			}
+			if !strings.Contains(prompt, data.Changes) {
+				t.Errorf("preset %s prompt does not contain the changes:\n%s", name, prompt)
+			}
+		})
+	}
+	if strings.Join(presetNames(), ",") != "angular,concise,conventional,detailed" {
+		t.Errorf("presetNames() = %v", presetNames())
+	}
+}
+
+func TestRedirectDroppingAuth(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer target.Close()
+	// A different host name for the same server makes net/http drop the
+	// Authorization header on redirect
+	redirectTo := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, redirectTo+r.URL.Path, http.StatusMovedPermanently)
+	}))
+	defer origin.Close()
+
+	cfg := config{apiEndpoint: origin.URL, apiKey: "secret", model: "test"}
+	_, _, err := (openRouterProvider{}).Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+	if err == nil || !strings.Contains(err.Error(), "update your config to the final URL") {
+		t.Errorf("openRouterProvider.Describe() error = %v, expected redirect error", err)
+	}
+}
+
+func TestRedirectKeepingAPIKey(t *testing.T) {
+	var leaked bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("x-api-key") != ""
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer target.Close()
+	// net/http drops Authorization for another host but copies x-api-key
+	redirectTo := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, redirectTo+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer origin.Close()
+
+	cfg := config{apiEndpoint: origin.URL, apiKey: "secret", model: "test"}
+	_, _, err := (anthropicProvider{}).Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+	if err == nil || !strings.Contains(err.Error(), "update your config to the final URL") {
+		t.Errorf("anthropicProvider.Describe() error = %v, expected redirect error", err)
+	}
+	if leaked {
+		t.Error("anthropicProvider.Describe() sent x-api-key to the redirect target")
+	}
+}
+
+func TestReadDiffFile(t *testing.T) {
+	const patch = "diff --git a/a.go b/a.go\n" +
+		"index 1111111..2222222 100644\n" +
+		"--- a/a.go\n" +
+		"+++ b/a.go\n" +
+		"@@ -1,2 +1,2 @@\n" +
+		" package a\n" +
+		"-var x = 1\n" +
+		"+var x = 2\n" +
+		"diff --git a/b.go b/b.go\n" +
+		"new file mode 100644\n" +
+		"--- /dev/null\n" +
+		"+++ b/b.go\n" +
+		"@@ -0,0 +1 @@\n" +
+		"+package b\n"
+
+	path := filepath.Join(t.TempDir(), "changes.diff")
+	if err := os.WriteFile(path, []byte(patch), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	originalStdin := stdin
+	defer func() { stdin = originalStdin }()
+	stdin = strings.NewReader(patch)
+
+	expected := []stagedFile{
+		{path: "a.go", status: git.Modified, added: 1, removed: 1},
+		{path: "b.go", status: git.Added, added: 1},
+	}
+	for _, source := range []string{path, "-"} {
+		changes, files, err := readDiffFile(source, 10000)
+		if err != nil {
+			t.Fatalf("readDiffFile(%q) error = %v", source, err)
+		}
+		if changes != patch {
+			t.Errorf("readDiffFile(%q) changes = %q, expected the file contents", source, changes)
+		}
+		if !reflect.DeepEqual(files, expected) {
+			t.Errorf("readDiffFile(%q) files = %+v, expected %+v", source, files, expected)
+		}
+	}
+
+	if _, _, err := readDiffFile(path, 5); err == nil {
+		t.Errorf("readDiffFile() expected max line error")
+	}
+}
+
+func TestSuggestSplit(t *testing.T) {
+	files := []fileLines{
+		{"api/server.go", 600},
+		{"web/app.ts", 300},
+		{"api/routes.go", 300},
+		{"api/auth.go", 200},
+		{"README.md", 10},
+	}
+	expected := [][]fileLines{
+		{{"api/server.go", 600}, {"api/routes.go", 300}},
+		{{"api/auth.go", 200}},
+		{{"web/app.ts", 300}},
+		{{"README.md", 10}},
+	}
+	if got := suggestSplit(files, 1000); !reflect.DeepEqual(got, expected) {
+		t.Errorf("suggestSplit() = %v, expected %v", got, expected)
+	}
+}
+
+func TestLineLimitError(t *testing.T) {
+	patch := "diff --git a/small.txt b/small.txt\n@@ -0,0 +1 @@\n+a\n" +
+		"diff --git a/big.txt b/big.txt\n@@ -0,0 +1,3 @@\n+a\n+b\n+c\n"
+	err := lineLimitError(patch, 9, 4, true)
+	expected := "staged changes exceed maximum line limit of 4 (currently at 9 lines). Consider staging fewer files or using -max-lines flag to increase the limit\n\n" +
+		"Lines per file:\n" +
+		"       5  big.txt\n" +
+		"       3  small.txt\n" +
+		"\nSuggested split:\n" +
+		"  1. git add big.txt (5 lines, over the limit on its own)\n" +
+		"  2. git add small.txt (3 lines)"
+	if err.Error() != expected {
+		t.Errorf("lineLimitError() =\n%s\nexpected\n%s", err, expected)
+	}
+}
+
+func TestGetStagedChangesSinceLast(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	first, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "since-last.json")
+	if err := saveSinceLast(path, nil, first.files); err != nil {
+		t.Fatalf("saveSinceLast() error = %v", err)
+	}
+	baseline, err := loadSinceLast(path)
+	if err != nil {
+		t.Fatalf("loadSinceLast() error = %v", err)
+	}
+
+	stageTestFile(t, repo, fs, "a.txt", "one\ntwo\n")
+	result, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000, baseline: baseline})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	expected := "diff --git a/a.txt b/a.txt\n" +
+		"index " + blobHash("one\n") + ".." + blobHash("one\ntwo\n") + " 100644\n" +
+		"--- a/a.txt\n" +
+		"+++ b/a.txt\n" +
+		"@@ -1 +1,2 @@\n" +
+		" one\n" +
+		"+two\n"
+	if result.patch != expected {
+		t.Errorf("getStagedChanges() =\n%s\nexpected\n%s", result.patch, expected)
+	}
+
+	// Nothing new since the last run
+	if err := saveSinceLast(path, baseline, result.files); err != nil {
+		t.Fatalf("saveSinceLast() error = %v", err)
+	}
+	if baseline, err = loadSinceLast(path); err != nil {
+		t.Fatalf("loadSinceLast() error = %v", err)
+	}
+	result, err = getStagedChanges(context.Background(), repo, config{maxLines: 10000, baseline: baseline})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	if result.patch != "" {
+		t.Errorf("getStagedChanges() = %q, expected no changes", result.patch)
+	}
+}
+
+func TestExternalDiff(t *testing.T) {
+	out, err := externalDiff(context.Background(), `echo "changed:"`, "src/main.go", "old\n", "new\n")
+	if err != nil {
+		t.Fatalf("externalDiff() error = %v", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 || fields[0] != "changed:" ||
+		filepath.Base(fields[1]) != "main.go" || filepath.Base(fields[2]) != "main.go" {
+		t.Errorf("externalDiff() = %q, expected the command to get both versions of main.go", out)
+	}
+
+	for _, command := range []string{"false", "describe-no-such-diff-tool", ""} {
+		if _, err := externalDiff(context.Background(), command, "main.go", "old\n", "new\n"); err == nil {
+			t.Errorf("externalDiff(%q) expected an error", command)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := externalDiff(ctx, "sleep 5; echo", "main.go", "old\n", "new\n"); err == nil {
+		t.Error("externalDiff() expected an error for a cancelled context")
+	}
+}
+
+func TestLimitHunks(t *testing.T) {
+	header := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n"
+	small1 := "@@ -1 +1 @@\n-a\n+b\n"
+	large := "@@ -10,2 +10,3 @@\n-c\n-d\n+e\n+f\n+g\n"
+	small2 := "@@ -20 +21 @@\n-h\n+i\n"
+	other := "diff --git a/b.go b/b.go\n--- a/b.go\n+++ b/b.go\n" + small1
+	patch := header + small1 + large + small2 + other
+
+	tests := []struct {
+		n        int
+		expected string
+	}{
+		{1, header + large + "[... 6 lines truncated (2 smaller hunks) ...]\n" + other},
+		{2, header + small1 + large + "[... 3 lines truncated (1 smaller hunk) ...]\n" + other},
+		{3, patch},
+	}
+	for _, tt := range tests {
+		got, dropped := limitHunks(patch, tt.n)
+		if got != tt.expected {
+			t.Errorf("limitHunks(%d) =\n%s\nexpected\n%s", tt.n, got, tt.expected)
+		}
+		if dropped != (tt.expected != patch) {
+			t.Errorf("limitHunks(%d) dropped = %v, expected %v", tt.n, dropped, tt.expected != patch)
+		}
+	}
+
+	summary := "3 files changed (summary only, full diffs omitted):\nAdded a.txt (+1 -0)\n"
+	if got, dropped := limitHunks(summary, 1); got != summary || dropped {
+		t.Errorf("limitHunks(summary) = %q, %v, expected it unchanged", got, dropped)
+	}
+}
+
+func TestUsageStats(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	if err := recordUsage("/repo/a", "gemini", 100); err != nil {
+		t.Fatalf("recordUsage() error = %v", err)
+	}
+	if err := recordUsage("/repo/a", "ollama", 50); err != nil {
+		t.Fatalf("recordUsage() error = %v", err)
+	}
+	if err := recordUsage("/repo/b", "gemini", 10); err != nil {
+		t.Fatalf("recordUsage() error = %v", err)
+	}
+
+	stats, err := loadUsageStats()
+	if err != nil {
+		t.Fatalf("loadUsageStats() error = %v", err)
+	}
+	expected := repoUsage{Invocations: 2, EstimatedTokens: 150, Providers: map[string]int{"gemini": 1, "ollama": 1}}
+	if !reflect.DeepEqual(stats["/repo/a"], expected) {
+		t.Errorf("loadUsageStats()[/repo/a] = %+v, expected %+v", stats["/repo/a"], expected)
+	}
+
+	var buf bytes.Buffer
+	printUsageStats(&buf, stats)
+	for _, want := range []string{"/repo/a", "Invocations: 2", "~150", "gemini 1, ollama 1", "/repo/b"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("printUsageStats() missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRollbackCommit(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.User.Name = "Me"
+	cfg.User.Email = "me@example.com"
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	first, err := commitChanges(repo, "First", "")
+	if err != nil {
+		t.Fatalf("commitChanges() error = %v", err)
+	}
+	stageTestFile(t, repo, fs, "b.txt", "two\n")
+	second, err := commitChanges(repo, "Second", "")
+	if err != nil {
+		t.Fatalf("commitChanges() error = %v", err)
+	}
+
+	if err := rollbackCommit(repo, second); err != nil {
+		t.Fatalf("rollbackCommit() error = %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != first {
+		t.Errorf("HEAD = %s, expected %s", head.Hash(), first)
+	}
+	staged, err := getStagedChanges(context.Background(), repo, config{})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	if len(staged.files) != 1 || staged.files[0].path != "b.txt" {
+		t.Errorf("staged files = %v, expected b.txt still staged", staged.files)
+	}
+
+	if err := rollbackCommit(repo, second); err == nil {
+		t.Errorf("rollbackCommit() of a commit that is not HEAD expected error")
+	}
+	if err := rollbackCommit(repo, first); err != nil {
+		t.Fatalf("rollbackCommit() of root commit error = %v", err)
+	}
+	if _, err := repo.Head(); err == nil {
+		t.Errorf("repo.Head() after rolling back the root commit expected error")
+	}
+}
+
+func TestGetChangesAgainst(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	stageTestFile(t, repo, fs, "b.txt", "bee\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/base", head.Hash())); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.txt is committed on top of base, so only -against sees it
+	stageTestFile(t, repo, fs, "a.txt", "one\ntwo\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, fs, "c.txt", "new\n")
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Remove("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := getChangesAgainst(context.Background(), repo, config{maxLines: 10000}, "base")
+	if err != nil {
+		t.Fatalf("getChangesAgainst() error = %v", err)
+	}
+	var got []string
+	for _, f := range result.files {
+		got = append(got, fmt.Sprintf("%s %c +%d -%d", f.path, f.status, f.added, f.removed))
+	}
+	expected := []string{"a.txt M +1 -0", "b.txt D +0 -1", "c.txt A +1 -0"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("getChangesAgainst() files = %v, expected %v", got, expected)
+	}
+
+	if _, err := getChangesAgainst(context.Background(), repo, config{maxLines: 10000}, "missing"); err == nil {
+		t.Errorf("getChangesAgainst() with unknown ref expected error")
+	}
+}
+
+func TestStripResponse(t *testing.T) {
+	patterns := []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^Generated by .*$`),
+		regexp.MustCompile(`(?s)\n-- \n.*$`),
+	}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Fix parser\n\nGenerated by SomeModel v2", "Fix parser"},
+		{"Fix parser\n\nHandle empty input.\n-- \nYour assistant", "Fix parser\n\nHandle empty input."},
+		{"Fix parser", "Fix parser"},
+		{"Generated by SomeModel", ""},
+	}
+	for _, tt := range tests {
+		if got := stripResponse(tt.input, patterns); got != tt.expected {
+			t.Errorf("stripResponse(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+// fakeProvider answers every request with a fixed reply
+type fakeProvider struct{ reply string }
+
+func (p fakeProvider) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	return p.reply, responseMetadata{}, nil
+}
+
+// runDiffFile runs describe on a one-file patch with the fake provider
+// answering reply, returning what it printed
+func runDiffFile(t *testing.T, reply string, args ...string) string {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	providers["fake"] = fakeProvider{reply: reply}
+	t.Cleanup(func() { delete(providers, "fake") })
+
+	path := filepath.Join(t.TempDir(), "change.patch")
+	patch := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1,2 +1,2 @@\n package a\n-var x = 1\n+var x = 2\n"
+	if err := os.WriteFile(path, []byte(patch), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := run(context.Background(), &out, append([]string{"-provider", "fake", "-diff-file", path}, args...)); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	return out.String()
+}
+
+func TestSkipUnchangedAfterFailedRun(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	providers["fake"] = fakeProvider{reply: "Bump x"}
+	defer delete(providers, "fake")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "change.patch")
+	if err := os.WriteFile(path, []byte("diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-var x = 1\n+var x = 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-provider", "fake", "-diff-file", path, "-skip-unchanged", "-message-file"}
+	var out strings.Builder
+	if err := run(context.Background(), &out, append(args, filepath.Join(dir, "missing", "MSG"))); err == nil {
+		t.Fatal("run() expected an error writing the message file")
+	}
+	out.Reset()
+	if err := run(context.Background(), &out, append(args, filepath.Join(dir, "MSG"))); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "Bump x") {
+		t.Errorf("run() printed %q, expected the failed run not to count as described", out.String())
+	}
+}
+
+func TestRunPROutputHeader(t *testing.T) {
+	dir := t.TempDir()
+	subjectFile := filepath.Join(dir, "subject")
+	printed := runDiffFile(t, "Bump x\n\nx is now 2.", "-output", "pr", "-subject-file", subjectFile)
+	if !strings.Contains(printed, "1 file changed") || !strings.Contains(printed, "\n\nBump x\n") {
+		t.Errorf("run() printed %q, expected the diffstat header and the description", printed)
+	}
+	subject, err := os.ReadFile(subjectFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(subject) != "Bump x\n" {
+		t.Errorf("subject file = %q, expected %q", subject, "Bump x\n")
+	}
+}
+
+func TestRunStreamShowsFinalMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		expected string
+	}{
+		{"unchanged", "Bump x\n\nx is now 2.", "Bump x\n\nx is now 2.\n"},
+		{"cleaned up", "Bump x\nx is now 2.", "Bump x\nx is now 2.\n\nBump x\n\nx is now 2.\n"},
+	}
+	for _, tt := range tests {
+		for _, provider := range []string{"openrouter", "ollama"} {
+			t.Run(tt.name+" "+provider, func(t *testing.T) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					for _, fragment := range strings.SplitAfter(tt.reply, "\n") {
+						content, _ := json.Marshal(fragment)
+						if provider == "ollama" {
+							fmt.Fprintf(w, "{\"message\":{\"content\":%s},\"done\":false}\n", content)
+						} else {
+							fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\n", content)
+						}
+					}
+					if provider == "ollama" {
+						fmt.Fprint(w, "{\"done\":true}\n")
+					} else {
+						fmt.Fprint(w, "data: [DONE]\n\n")
+					}
+				}))
+				defer server.Close()
+
+				t.Setenv("OPENROUTER_API_KEY", "secret")
+				printed := runDiffFile(t, "", "-provider", provider, "-endpoint", server.URL, "-model", "m", "-stream")
+				if printed != tt.expected {
+					t.Errorf("run() printed %q, expected %q", printed, tt.expected)
+				}
+			})
+		}
+	}
+}
+
+func TestFinishStream(t *testing.T) {
+	trailers := []trailer{{"Change-Type", "fix"}}
+	tests := []struct {
+		name      string
+		streamed  string
+		untrailed string
+		final     string
+		trailers  []trailer
+		expected  string
+	}{
+		{"unchanged", "Bump x", "Bump x", "Bump x", nil, "\n"},
+		{"only trailers added", "Bump x\n", "Bump x", "Bump x\n\nChange-Type: fix", trailers, "\n\nChange-Type: fix\n"},
+		{"cleaned up", "Bump x.", "Bump x", "Bump x\n\nChange-Type: fix", trailers, "\n\nBump x\n\nChange-Type: fix\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			finishStream(&out, tt.streamed, tt.untrailed, tt.final, tt.trailers)
+			if out.String() != tt.expected {
+				t.Errorf("finishStream() printed %q, expected %q", out.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRunStreamRetryShowsFinalMessage(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		requests++
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Bump\"}}]}\n\n")
+		if requests == 1 {
+			// Stall after the first fragment until the attempt times out
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" x\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	t.Setenv("OPENROUTER_API_KEY", "secret")
+	printed := runDiffFile(t, "", "-provider", "openrouter", "-endpoint", server.URL, "-model", "m", "-stream", "-timeout", "100ms", "-retry-empty", "1")
+	if expected := "Bump\nBump x\n\nBump x\n"; printed != expected {
+		t.Errorf("run() printed %q, expected %q", printed, expected)
+	}
+}
+
+func TestProviderRegistry(t *testing.T) {
+	providers["fake"] = fakeProvider{reply: "Fix parser"}
+	defer delete(providers, "fake")
+
+	got, _, err := describeChanges(context.Background(), config{provider: "fake"}, []chatMessage{{Role: "user", Content: "prompt"}})
+	if err != nil {
+		t.Fatalf("describeChanges() error = %v", err)
+	}
+	if got != "Fix parser" {
+		t.Errorf("describeChanges() = %q, expected %q", got, "Fix parser")
+	}
+	if names := providerNames(); !reflect.DeepEqual(names, []string{"anthropic", "fake", "ollama", "openai", "openrouter"}) {
+		t.Errorf("providerNames() = %v, expected [anthropic fake ollama openai openrouter]", names)
+	}
+}
+
+func TestPlaceMessage(t *testing.T) {
+	message := "Fix parser\n\nHandle empty input.\n"
+	comments := "# Please enter the commit message for your changes.\n#\n# On branch main\n"
+	tests := []struct {
+		name      string
+		existing  string
+		placement string
+		expected  string
+	}{
+		{"empty file", "", "top", message},
+		{"top above template", "\n" + comments, "top", message + "\n" + comments},
+		{"bottom without text", "\n" + comments, "bottom", message + "\n" + comments},
+		{
+			"bottom after merge summary",
+			"Merge branch 'feature'\n\n" + comments,
+			"bottom",
+			"Merge branch 'feature'\n\n" + message + "\n" + comments,
+		},
+		{
+			"top before merge summary",
+			"Merge branch 'feature'\n\n" + comments,
+			"top",
+			message + "\nMerge branch 'feature'\n\n" + comments,
+		},
+		{"bottom without comments", "Existing text\n", "bottom", "Existing text\n\n" + message},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := placeMessage(tt.existing, message, tt.placement); got != tt.expected {
+				t.Errorf("placeMessage() =\n%q\nexpected\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckQuality(t *testing.T) {
+	diff := "diff --git a/a.txt b/a.txt\n@@ -1 +1,2 @@\n one\n+two\n"
+	strict := config{minSubjectLength: 10, requireBody: true, rejectEcho: true}
+	tests := []struct {
+		name        string
+		cfg         config
+		description string
+		expected    string
+	}{
+		{"passes", strict, "Add second line to a.txt\n\nNeeded by the parser.", ""},
+		{"single word", strict, "Fix", "subject shorter than 10 characters"},
+		{"no body", strict, "Add second line to a.txt", "no body"},
+		{"echoed diff", strict, diff, "response repeats the diff"},
+		{"diff in body", strict, "Add second line to a.txt\n\n@@ -1 +1,2 @@\n+two", "response contains diff output"},
+		{"checks disabled", config{}, "Fix", ""},
+		{"observations are not a body", config{requireBody: true, review: true}, "Fix parser\n\n" + reviewSeparator + "\n- typo", "no body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkQuality(tt.cfg, tt.description, diff); got != tt.expected {
+				t.Errorf("checkQuality() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// slowProvider blocks until the context ends for its first stalls calls
+type slowProvider struct {
+	stalls int
+	calls  *int
+}
+
+func (p slowProvider) Describe(ctx context.Context, cfg config, messages []chatMessage) (string, responseMetadata, error) {
+	*p.calls++
+	if *p.calls <= p.stalls {
+		<-ctx.Done()
+		return "", responseMetadata{}, ctx.Err()
+	}
+	return "Fix parser", responseMetadata{}, nil
+}
+
+func TestRequestDescriptionTimeouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		stalls        int
+		timeout       time.Duration
+		deadline      time.Duration
+		expected      string
+		expectedCalls int
+		errContains   string
+	}{
+		{"timed out attempt is retried", 1, 20 * time.Millisecond, 0, "Fix parser", 2, ""},
+		{"retries run out", 5, 20 * time.Millisecond, 0, "", 2, "timed out"},
+		{"deadline stops retries", 5, 20 * time.Millisecond, 30 * time.Millisecond, "", 2, "deadline"},
+		{"deadline without timeout", 5, 0, 20 * time.Millisecond, "", 1, "deadline"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			providers["slow"] = slowProvider{stalls: tt.stalls, calls: &calls}
+			defer delete(providers, "slow")
+
+			cfg := config{provider: "slow", retryEmpty: 1, timeout: tt.timeout, deadline: tt.deadline}
+			got, _, err := requestDescription(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+			if tt.errContains == "" && err != nil {
+				t.Fatalf("requestDescription() error = %v", err)
+			}
+			if tt.errContains != "" && (err == nil || !strings.Contains(err.Error(), tt.errContains)) {
+				t.Fatalf("requestDescription() error = %v, expected it to mention %q", err, tt.errContains)
+			}
+			if got != tt.expected {
+				t.Errorf("requestDescription() = %q, expected %q", got, tt.expected)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("provider called %d times, expected %d", calls, tt.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestHungServerTimesOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	for _, provider := range []string{"ollama", "openrouter"} {
+		cfg := config{provider: provider, apiEndpoint: server.URL, model: "m", apiKey: "secret", timeout: 20 * time.Millisecond}
+		start := time.Now()
+		_, _, err := requestDescription(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+		if !errors.Is(err, errAttemptTimeout) {
+			t.Errorf("%s: requestDescription() error = %v, expected errAttemptTimeout", provider, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: requestDescription() took %s, expected it to give up after the timeout", provider, elapsed)
+		}
+	}
+}
+
+func TestPostCommitFromConfigFile(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(xdg, "describe", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("post_commit: git push\nrollback_on_failure: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{nil, {"-message-file", "COMMIT_EDITMSG"}} {
+		cfg, _, err := getConfig(args)
+		if err != nil {
+			t.Fatalf("getConfig(%v) error = %v", args, err)
+		}
+		if cfg.postCommit != "" || cfg.rollbackOnFailure {
+			t.Errorf("getConfig(%v) = %q, %v, expected post_commit to be ignored without -commit", args, cfg.postCommit, cfg.rollbackOnFailure)
+		}
+	}
+	cfg, _, err := getConfig([]string{"-commit"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.postCommit != "git push" || !cfg.rollbackOnFailure {
+		t.Errorf("getConfig() = %q, %v, expected the config file values with -commit", cfg.postCommit, cfg.rollbackOnFailure)
+	}
+	for _, args := range [][]string{{"-post-commit", "make"}, {"-rollback-on-failure"}} {
+		if _, _, err := getConfig(args); err == nil {
+			t.Errorf("getConfig(%v) expected error without -commit", args)
+		}
+	}
+}
+
+func TestGetConfigDefaultTimeout(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(xdg, "describe", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file     string
+		args     []string
+		expected time.Duration
+	}{
+		{"", nil, defaultTimeout},
+		{"", []string{"-timeout", "10s"}, 10 * time.Second},
+		{"", []string{"-timeout", "0"}, 0},
+		{"timeout: 30s\n", nil, 30 * time.Second},
+		{"timeout: 0s\n", nil, 0},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := getConfig(tt.args)
+		if err != nil {
+			t.Fatalf("getConfig(%v) error = %v", tt.args, err)
+		}
+		if cfg.timeout != tt.expected {
+			t.Errorf("getConfig(%v) with %q timeout = %v, expected %v", tt.args, tt.file, cfg.timeout, tt.expected)
+		}
+	}
+}
+
+func TestStreamTimeoutIsIdle(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		requests++
+		// Four fragments 50ms apart take longer than the 100ms timeout
+		for _, fragment := range []string{"Bump", " x", " to", " 2"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", fragment)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	var streamed strings.Builder
+	cfg := config{provider: "openrouter", apiEndpoint: server.URL, apiKey: "secret", model: "m", timeout: 100 * time.Millisecond, streamTo: &streamed}
+	description, _, err := describeAttempt(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+	if err != nil {
+		t.Fatalf("describeAttempt() error = %v", err)
+	}
+	if description != "Bump x to 2" || streamed.String() != description || requests != 1 {
+		t.Errorf("describeAttempt() = %q, streamed %q in %d requests, expected one uninterrupted stream", description, streamed.String(), requests)
+	}
+}
+
+func TestMatchPathspecs(t *testing.T) {
+	tests := []struct {
+		specs    []string
+		path     string
+		expected bool
+	}{
+		{nil, "main.go", true},
+		{[]string{"src"}, "src/a/b.go", true},
+		{[]string{"src/"}, "src/b.go", true},
+		{[]string{"src"}, "srcs/b.go", false},
+		{[]string{"*.go"}, "cmd/main.go", true}, // without glob magic * matches /
+		{[]string{":(glob)*.go"}, "cmd/main.go", false},
+		{[]string{":(glob)*.go"}, "main.go", true},
+		{[]string{":(glob)**/*.go"}, "cmd/tool/main.go", true},
+		{[]string{":(glob)**/*.go"}, "main.go", true},
+		{[]string{":(glob)src/**"}, "src/a/b.txt", true},
+		{[]string{":(glob)src/?.go"}, "src/a.go", true},
+		{[]string{":(glob)src/[ab].go"}, "src/c.go", false},
+		{[]string{":(glob)src/[!ab].go"}, "src/c.go", true},
+		{[]string{":!**/testdata/**"}, "pkg/testdata/x.json", false},
+		{[]string{":(glob,exclude)**/testdata/**"}, "pkg/testdata/x.json", false},
+		{[]string{":!docs"}, "main.go", true},
+		{[]string{":^docs"}, "docs/index.md", false},
+		{[]string{":(glob)**/*.go", ":!vendor"}, "vendor/x/y.go", false},
+		{[]string{":(glob)**/*.go", ":!vendor"}, "pkg/y.go", true},
+		{[]string{":(glob)**/*.go", ":!vendor"}, "README.md", false},
+		{[]string{":(literal)a*.go"}, "a*.go", true},
+		{[]string{":(literal)a*.go"}, "ab.go", false},
+		{[]string{":(icase)README.md"}, "readme.md", true},
+		{[]string{":/main.go"}, "main.go", true},
+		{[]string{"."}, "any/path.go", true},
+	}
+	for _, tt := range tests {
+		var specs []pathspec
+		for _, s := range tt.specs {
+			spec, err := parsePathspec(s)
+			if err != nil {
+				t.Fatalf("parsePathspec(%q) error = %v", s, err)
+			}
+			specs = append(specs, spec)
+		}
+		if got := matchPathspecs(tt.path, specs); got != tt.expected {
+			t.Errorf("matchPathspecs(%q, %v) = %v, expected %v", tt.path, tt.specs, got, tt.expected)
+		}
+	}
+
+	for _, invalid := range []string{":(glob", ":(attr:foo)x"} {
+		if _, err := parsePathspec(invalid); err == nil {
+			t.Errorf("parsePathspec(%q) expected error", invalid)
+		}
+	}
+}
+
+func TestPrintConfigSources(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OPENROUTER_API_KEY", "secret")
+	path := filepath.Join(xdg, "describe", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("provider: ollama\nmax_lines: 500\ntimeout: 30s\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := getConfig([]string{"-print-config", "-model", "qwen", "-timeout", "10s"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	sources := make(map[string]string)
+	values := make(map[string]string)
+	for _, s := range cfg.settings {
+		sources[s.key] = s.source
+		values[s.key] = s.value
+	}
+	expected := map[string]string{
+		"provider":     "file",
+		"max_lines":    "file",
+		"model":        "flag",
+		"timeout":      "flag",
+		"api_key":      "env",
+		"api_endpoint": "default",
+		"output":       "default",
+	}
+	for key, source := range expected {
+		if sources[key] != source {
+			t.Errorf("source of %s = %q, expected %q", key, sources[key], source)
+		}
+	}
+	if values["timeout"] != "10s" || values["api_key"] != "(set)" {
+		t.Errorf("timeout = %q, api_key = %q, expected 10s and a redacted key", values["timeout"], values["api_key"])
+	}
+
+	var buf bytes.Buffer
+	printSettings(&buf, []setting{{"model", "qwen", "flag"}, {"prompt_prefix", "a\nb", "file"}}, true)
+	want := "model:         (flag)    qwen\nprompt_prefix: (file)    \"a\\nb\"\n"
+	if buf.String() != want {
+		t.Errorf("printSettings() =\n%q\nexpected\n%q", buf.String(), want)
+	}
+}
+
+func TestRunContextCommand(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		command  string
+		maxLines int
+		expected string
+		wantErr  bool
+	}{
+		{"stdout only", "echo ok; echo hidden >&2", 0, "ok", false},
+		{"failing command", "echo FAIL: TestX; exit 1", 0, "FAIL: TestX\n[exit status 1]", false},
+		{"truncated", "printf 'a\\nb\\nc\\n'", 2, "a\nb\n[... 1 line truncated ...]", false},
+		{"runs in dir", "pwd", 0, dir, false},
+		{"timeout", "sleep 5", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := runContextCommand(context.Background(), tt.command, dir, 500*time.Millisecond, tt.maxLines)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runContextCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("runContextCommand() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+
+	prompt, err := buildPrompt(config{output: "commit", contextCommand: "go test"}, promptData{Changes: "diff", CommandOutput: "FAIL: TestX"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if !strings.Contains(prompt, "Output of `go test`") || !strings.Contains(prompt, "FAIL: TestX") {
+		t.Errorf("buildPrompt() missing command output:\n%s", prompt)
+	}
+}
+
+func TestOpenRepositoryOutsideGit(t *testing.T) {
+	_, err := openRepository(t.TempDir())
+	if !errors.Is(err, errNotARepository) {
+		t.Fatalf("openRepository() error = %v, expected %v", err, errNotARepository)
+	}
+	if !strings.Contains(err.Error(), "-diff-file") {
+		t.Errorf("openRepository() error %q does not mention -diff-file", err)
+	}
+}
+
+func TestOpenRepositoryFromSubdirectory(t *testing.T) {
+	root := t.TempDir()
+	if _, err := git.PlainInit(root, false); err != nil {
+		t.Fatal(err)
+	}
+	nested := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := openRepository(nested)
+	if err != nil {
+		t.Fatalf("openRepository() error = %v", err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Filesystem.Root() != root {
+		t.Errorf("worktree root = %q, expected %q", w.Filesystem.Root(), root)
+	}
+
+	// Binary detection reads staged files relative to the worktree root,
+	// not the directory describe runs in
+	if err := os.WriteFile(filepath.Join(root, "a", "image.bin"), []byte("bin\x00ary"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("a/image.bin"); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(nested)
+	staged, err := getStagedChanges(context.Background(), repo, config{maxLines: 10000, binaryFiles: "note", readConcurrency: 1})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	if !strings.Contains(staged.patch, "binary file added: a/image.bin") {
+		t.Errorf("getStagedChanges() patch = %q, expected a binary note", staged.patch)
+	}
+}
+
+func TestFocusArea(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []stagedFile
+		expected string
+	}{
+		{"shared directory", []stagedFile{{path: "auth/login.go"}, {path: "auth/token/jwt.go"}}, "auth"},
+		{"nested shared directory", []stagedFile{{path: "internal/auth/a.go"}, {path: "internal/auth/b.go"}}, "internal/auth"},
+		{
+			"dominant by lines",
+			[]stagedFile{{path: "auth/login.go", added: 40}, {path: "api/routes.go", added: 5}, {path: "README.md", added: 2}},
+			"auth",
+		},
+		{"no majority", []stagedFile{{path: "auth/a.go", added: 5}, {path: "api/b.go", added: 5}}, ""},
+		{"root files only", []stagedFile{{path: "main.go"}, {path: "README.md"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := focusArea(tt.files); got != tt.expected {
+				t.Errorf("focusArea() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSubjectAndBodyFormats(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	cfg, _, err := getConfig([]string{"-subject-format", "conventional", "-body-format", "prose"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if !cfg.conventional || cfg.bodyFormat != "prose" {
+		t.Errorf("getConfig() conventional = %v, bodyFormat = %q, expected true and prose", cfg.conventional, cfg.bodyFormat)
+	}
+	prompt, err := buildPrompt(cfg, promptData{Changes: "diff"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if !strings.Contains(prompt, "type(scope): summary") || !strings.Contains(prompt, "plain English prose") {
+		t.Errorf("buildPrompt() missing subject or body format rules:\n%s", prompt)
+	}
+
+	cfg, _, err = getConfig([]string{"-conventional", "-subject-format", "plain", "-body-format", "bullets"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	prompt, err = buildPrompt(cfg, promptData{Changes: "diff"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if strings.Contains(prompt, "type(scope): summary") || !strings.Contains(prompt, "bulleted list") {
+		t.Errorf("buildPrompt() expected a plain subject and bulleted body:\n%s", prompt)
+	}
+
+	for _, args := range [][]string{{"-subject-format", "angular"}, {"-body-format", "haiku"}} {
+		if _, _, err := getConfig(args); err == nil {
+			t.Errorf("getConfig(%v) expected error", args)
+		}
+	}
+}
+
+func TestIndexModTime(t *testing.T) {
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := indexModTime(repo); ok {
+		t.Errorf("indexModTime() ok = true before anything was staged")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	staged := time.Now().Add(-96 * time.Hour)
+	if err := os.Chtimes(filepath.Join(root, ".git", "index"), staged, staged); err != nil {
+		t.Fatal(err)
+	}
+	modified, ok := indexModTime(repo)
+	if !ok || !modified.Equal(staged) {
+		t.Errorf("indexModTime() = %v, %v, expected %v, true", modified, ok, staged)
+	}
+
+	memRepo, _ := newTestRepo(t)
+	if _, ok := indexModTime(memRepo); ok {
+		t.Errorf("indexModTime() ok = true for an in-memory repository")
+	}
+}
+
+func TestDropWhitespaceHunks(t *testing.T) {
+	reindent := "@@ -1,2 +1,2 @@\n-func a() {\n-return 1\n+func a() {\n+\treturn 1\n"
+	real := "@@ -10 +10 @@\n-x := 1\n+x := 2\n"
+	patch := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n" + reindent + real +
+		"diff --git a/b.go b/b.go\n--- a/b.go\n+++ b/b.go\n" + "@@ -1 +1,3 @@\n line\n+\n+   \n" +
+		"diff --git a/logo.png b/logo.png\nbinary file added: logo.png (1kB, image/png)\n"
+	files := []stagedFile{
+		{path: "a.go", added: 3, removed: 3},
+		{path: "b.go", added: 2},
+		{path: "logo.png"},
+	}
+
+	result, kept := dropWhitespaceHunks(patch, files)
+	expected := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n" + real +
+		"diff --git a/logo.png b/logo.png\nbinary file added: logo.png (1kB, image/png)\n"
+	if result != expected {
+		t.Errorf("dropWhitespaceHunks() =\n%s\nexpected\n%s", result, expected)
+	}
+	if len(kept) != 2 || kept[0].path != "a.go" || kept[0].added != 1 || kept[0].removed != 1 || kept[1].path != "logo.png" {
+		t.Errorf("dropWhitespaceHunks() kept %+v, expected a.go (+1 -1) and logo.png", kept)
+	}
+
+	if result, _ := dropWhitespaceHunks("Modified a.go\n", nil); result != "Modified a.go\n" {
+		t.Errorf("dropWhitespaceHunks() changed a summary: %q", result)
+	}
+}
+
+// cassette is a recorded provider interaction stored under testdata/cassettes
+type cassette struct {
+	Provider    string   `json:"provider"`
+	Model       string   `json:"model"`
+	Temperature *float64 `json:"temperature"`
+	MaxTokens   int      `json:"max_tokens"`
+	Request     struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status int             `json:"status"`
+		Body   json.RawMessage `json:"body"`
+	} `json:"response"`
+	Expected    string `json:"expected"`
+	Error       string `json:"error"`
+	TotalTokens int    `json:"total_tokens"`
+}
+
+// cassetteTransport replays a cassette, failing the test when the request
+// the provider sends differs from the recorded one
+type cassetteTransport struct {
+	t        *testing.T
+	cassette cassette
+	calls    int
+}
+
+func (ct *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.calls++
+	c := ct.cassette
+	if req.Method != c.Request.Method {
+		ct.t.Errorf("request method = %q, expected %q", req.Method, c.Request.Method)
+	}
+	if req.URL.Path != c.Request.Path {
+		ct.t.Errorf("request path = %q, expected %q", req.URL.Path, c.Request.Path)
+	}
+	for name, value := range c.Request.Headers {
+		if got := req.Header.Get(name); got != value {
+			ct.t.Errorf("request header %s = %q, expected %q", name, got, value)
+		}
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	var got, expected any
+	if err := json.Unmarshal(body, &got); err != nil {
+		ct.t.Errorf("request body is not JSON: %v", err)
+	}
+	if err := json.Unmarshal(c.Request.Body, &expected); err != nil {
+		ct.t.Fatalf("cassette request body is not JSON: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		ct.t.Errorf("request body = %s, expected %s", body, c.Request.Body)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, c.Response.Body); err != nil {
+		ct.t.Fatalf("cassette response body is not JSON: %v", err)
+	}
+	return &http.Response{
+		StatusCode: c.Response.Status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(&compact),
+		Request:    req,
+	}, nil
+}
+
+func TestProviderCassettes(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "cassettes", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no cassettes found")
+	}
+
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c cassette
+			if err := json.Unmarshal(data, &c); err != nil {
+				t.Fatalf("failed to parse cassette: %v", err)
+			}
+			provider, ok := providers[c.Provider]
+			if !ok {
+				t.Fatalf("unknown provider %q", c.Provider)
+			}
+
+			transport := &cassetteTransport{t: t, cassette: c}
+			oldTransport := httpTransport
+			httpTransport = transport
+			defer func() { httpTransport = oldTransport }()
+
+			cfg := config{
+				provider:               c.Provider,
+				model:                  c.Model,
+				apiEndpoint:            "http://cassette.invalid",
+				apiKey:                 "test-key",
+				temperature:            c.Temperature,
+				maxTokens:              c.MaxTokens,
+				reasoningModelPrefixes: defaultReasoningModelPrefixes,
+			}
+			messages := []chatMessage{{Role: "user", Content: "Describe this diff"}}
+			result, meta, err := provider.Describe(context.Background(), cfg, messages)
+			if transport.calls != 1 {
+				t.Errorf("provider made %d requests, expected 1", transport.calls)
+			}
+
+			if c.Error != "" {
+				if err == nil {
+					t.Fatalf("Describe() = %q, expected error %q", result, c.Error)
+				}
+				if err.Error() != c.Error {
+					t.Errorf("Describe() error = %q, expected %q", err, c.Error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Describe() unexpected error: %v", err)
+			}
+			if result != c.Expected {
+				t.Errorf("Describe() = %q, expected %q", result, c.Expected)
+			}
+			if meta.totalTokens != c.TotalTokens {
+				t.Errorf("Describe() total tokens = %d, expected %d", meta.totalTokens, c.TotalTokens)
+			}
+		})
+	}
+}
+
+func TestProviderCassetteErrorKinds(t *testing.T) {
+	tests := []struct {
+		name     string
+		cassette string
+		expected error
+	}{
+		{"context length", "openrouter_context_length", errContextLength},
+		{"ollama empty content", "ollama_empty", errEmptyResponse},
+		{"openrouter no choices", "openrouter_no_choices", errEmptyResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "cassettes", tt.cassette+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var c cassette
+			if err := json.Unmarshal(data, &c); err != nil {
+				t.Fatal(err)
+			}
+			oldTransport := httpTransport
+			httpTransport = &cassetteTransport{t: t, cassette: c}
+			defer func() { httpTransport = oldTransport }()
+
+			cfg := config{model: c.Model, apiEndpoint: "http://cassette.invalid", apiKey: "test-key"}
+			_, _, err = providers[c.Provider].Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "Describe this diff"}})
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Describe() error = %v, expected %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGitCommitTemplate(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := "Summary\n\nWhy:\n\n# Explain the motivation\nTicket:\n"
+	if err := os.WriteFile(filepath.Join(root, ".gitmessage"), []byte(template), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".gitmessage"), []byte("Home template\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+		wantErr  bool
+	}{
+		{"unset", "", "", false},
+		{"relative to worktree", ".gitmessage", strings.TrimSpace(template), false},
+		{"absolute", filepath.Join(root, ".gitmessage"), strings.TrimSpace(template), false},
+		{"home", "~/.gitmessage", "Home template", false},
+		{"missing", "nope.txt", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := repo.Config()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Raw.Section("commit").RemoveOption("template")
+			if tt.path != "" {
+				cfg.Raw.Section("commit").SetOption("template", tt.path)
+			}
+			if err := repo.SetConfig(cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			result, _, err := gitCommitTemplate(repo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gitCommitTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("gitCommitTemplate() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBlameContext(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	commitAs := func(name, email string, when time.Time) {
+		t.Helper()
+		_, err := w.Commit("change", &git.CommitOptions{
+			Author: &object.Signature{Name: name, Email: email, When: when},
+		})
+		if err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+	stageTestFile(t, repo, fs, "main.go", "one\ntwo\nthree\nfour\nfive\nsix\n")
+	commitAs("Alice", "alice@example.com", now.AddDate(-2, 0, 0))
+	stageTestFile(t, repo, fs, "main.go", "one\ntwo\nthree\nfour\nFIVE\nSIX\n")
+	commitAs("Me", "me@example.com", now.AddDate(0, 0, -3))
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := "diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go\n"
+	tests := []struct {
+		name     string
+		patch    string
+		expected string
+	}{
+		{"old code", header + "@@ -1,3 +1,3 @@\n one\n-two\n+TWO\n three\n",
+			"main.go line 2: long-standing code, last changed 2 years ago by Alice"},
+		{"own recent code", header + "@@ -4,3 +4,3 @@\n four\n-FIVE\n-SIX\n+5\n+6\n",
+			"main.go lines 5-6: recent code, last changed 3 days ago by you"},
+		{"mixed", header + "@@ -3,3 +3,2 @@\n three\n-four\n-FIVE\n+4\n",
+			"main.go lines 4-5: mixed recent and long-standing code, changed between 2 years ago and 3 days ago by Alice, you"},
+		{"pure addition", header + "@@ -1,2 +1,3 @@\n one\n+one and a half\n two\n", ""},
+		{"new file", "diff --git a/new.go b/new.go\nnew file mode 100644\n--- /dev/null\n+++ b/new.go\n@@ -0,0 +1 @@\n+new\n", ""},
+		{"one note per hunk", header + "@@ -1,2 +1,2 @@\n-one\n+ONE\n two\n@@ -5,2 +5,2 @@\n-FIVE\n+5\n SIX\n",
+			"main.go line 1: long-standing code, last changed 2 years ago by Alice\nmain.go line 5: recent code, last changed 3 days ago by you"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := blameContext(context.Background(), base, tt.patch, "me@example.com", now)
+			if err != nil {
+				t.Fatalf("blameContext() error = %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("blameContext() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAgeString(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected string
+	}{
+		{time.Hour, "today"},
+		{36 * time.Hour, "1 day ago"},
+		{10 * 24 * time.Hour, "10 days ago"},
+		{90 * 24 * time.Hour, "3 months ago"},
+		{800 * 24 * time.Hour, "2 years ago"},
+	}
+	for _, tt := range tests {
+		if result := ageString(tt.d); result != tt.expected {
+			t.Errorf("ageString(%v) = %q, expected %q", tt.d, result, tt.expected)
+		}
+	}
+}
+
+func TestBuildPromptTemplate(t *testing.T) {
+	prompt, err := buildPrompt(config{}, promptData{Changes: "diff", Template: "Summary\n\nWhy:"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	if !strings.Contains(prompt, "fill in its sections") || !strings.Contains(prompt, "<<<\nSummary\n\nWhy:\n>>>") {
+		t.Errorf("buildPrompt() missing commit template:\n%s", prompt)
+	}
+}
+
+func TestReadChatStream(t *testing.T) {
+	stream := ": OPENROUTER PROCESSING\n\n" +
+		`data: {"id":"gen-1","model":"anthropic/claude-4.5-sonnet","choices":[{"delta":{"role":"assistant","content":"\n"}}]}` + "\n\n" +
+		`data: {"id":"gen-1","model":"anthropic/claude-4.5-sonnet","choices":[{"delta":{"content":"Fix pagination"}}]}` + "\n\n" +
+		`data: {"id":"gen-1","model":"anthropic/claude-4.5-sonnet","choices":[{"delta":{"content":"\n\nThe last page was skipped.\n"}}]}` + "\n\n" +
+		`data: {"id":"gen-1","model":"anthropic/claude-4.5-sonnet","choices":[],"usage":{"prompt_tokens":40,"completion_tokens":9,"total_tokens":49}}` + "\n\n" +
+		"data: [DONE]\n\n" +
+		`data: {"choices":[{"delta":{"content":"ignored"}}]}` + "\n"
+
+	var out bytes.Buffer
+	content, meta, err := readChatStream(context.Background(), strings.NewReader(stream), &out)
+	if err != nil {
+		t.Fatalf("readChatStream() error = %v", err)
+	}
+	expected := "Fix pagination\n\nThe last page was skipped."
+	if content != expected {
+		t.Errorf("readChatStream() = %q, expected %q", content, expected)
+	}
+	if out.String() != expected+"\n" {
+		t.Errorf("readChatStream() wrote %q, expected %q", out.String(), expected+"\n")
+	}
+	if meta.requestID != "gen-1" || meta.totalTokens != 49 {
+		t.Errorf("readChatStream() meta = %+v, expected request gen-1 and 49 tokens", meta)
+	}
+
+	tests := []struct {
+		name     string
+		stream   string
+		expected string
+	}{
+		{"empty", "data: [DONE]\n", errEmptyResponse.Error()},
+		{"error event", `data: {"error":{"message":"Provider returned error","code":502}}` + "\n", "API stream failed: Provider returned error"},
+		{"malformed", "data: {\n", "failed to decode stream event: unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readChatStream(context.Background(), strings.NewReader(tt.stream), io.Discard)
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("readChatStream() error = %v, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadOllamaStream(t *testing.T) {
+	stream := `{"model":"llama3.2","message":{"role":"assistant","content":"\n"},"done":false}` + "\n" +
+		`{"model":"llama3.2","message":{"role":"assistant","content":"Fix pagination"},"done":false}` + "\n" +
+		`{"model":"llama3.2","message":{"role":"assistant","content":"\n\nThe last page was skipped.\n"},"done":false}` + "\n" +
+		`{"model":"llama3.2","message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":40,"eval_count":9}` + "\n" +
+		`{"model":"llama3.2","message":{"role":"assistant","content":"ignored"},"done":false}` + "\n"
+
+	var out bytes.Buffer
+	content, meta, err := readOllamaStream(context.Background(), strings.NewReader(stream), &out)
+	if err != nil {
+		t.Fatalf("readOllamaStream() error = %v", err)
+	}
+	expected := "Fix pagination\n\nThe last page was skipped."
+	if content != expected {
+		t.Errorf("readOllamaStream() = %q, expected %q", content, expected)
+	}
+	if out.String() != expected+"\n" {
+		t.Errorf("readOllamaStream() wrote %q, expected %q", out.String(), expected+"\n")
+	}
+	if meta.model != "llama3.2" || meta.totalTokens != 49 {
+		t.Errorf("readOllamaStream() meta = %+v, expected model llama3.2 and 49 tokens", meta)
+	}
+
+	tests := []struct {
+		name     string
+		stream   string
+		expected string
+	}{
+		{"empty", `{"message":{"content":""},"done":true}` + "\n", errEmptyResponse.Error()},
+		{"error object", `{"error":"model not found"}` + "\n", "API stream failed: model not found"},
+		{"malformed", "{\n", "failed to decode stream object: unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readOllamaStream(context.Background(), strings.NewReader(tt.stream), io.Discard)
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("readOllamaStream() error = %v, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+// cancelWriter cancels a context on the first write
+type cancelWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return len(p), nil
+}
+
+func TestProvidersSendSamePrompt(t *testing.T) {
+	sent := map[string][]chatMessage{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []chatMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		sent[r.URL.Path] = req.Messages
+		if r.URL.Path == "/api/chat" {
+			fmt.Fprint(w, `{"message":{"content":"Fix parser"},"done":true}`)
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"Fix parser"}}]}`)
+	}))
+	defer server.Close()
+
+	prompt, err := buildPrompt(config{output: "commit"}, promptData{Changes: "diff"})
+	if err != nil {
+		t.Fatalf("buildPrompt() error = %v", err)
+	}
+	messages := []chatMessage{{Role: "user", Content: prompt}}
+	cfg := config{apiEndpoint: server.URL, model: "m", apiKey: "secret"}
+	for _, p := range []Provider{ollamaProvider{}, openRouterProvider{}} {
+		if _, _, err := p.Describe(context.Background(), cfg, messages); err != nil {
+			t.Fatalf("%T.Describe() error = %v", p, err)
+		}
+	}
+	if !reflect.DeepEqual(sent["/api/chat"], messages) || !reflect.DeepEqual(sent["/chat/completions"], messages) {
+		t.Errorf("providers sent %v and %v, expected both to send %v", sent["/api/chat"], sent["/chat/completions"], messages)
+	}
+}
+
+func TestPrintPrompt(t *testing.T) {
+	var b strings.Builder
+	printPrompt(&b, []chatMessage{{Role: "system", Content: "Be brief"}, {Role: "user", Content: "diff"}})
+	expected := "[DEBUG] === Full prompt being sent to LLM ===\n[system]\nBe brief\n[user]\ndiff\n[DEBUG] === End of prompt ===\n"
+	if b.String() != expected {
+		t.Errorf("printPrompt() = %q, expected %q", b.String(), expected)
+	}
+}
+
+func TestOllamaStreamCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["stream"] != true {
+			t.Errorf("request stream = %v (%v), expected true", body["stream"], err)
+		}
+		fmt.Fprintln(w, `{"message":{"content":"Fix"},"done":false}`)
+		w.(http.Flusher).Flush()
+		// Never finish on our own
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := config{apiEndpoint: server.URL, model: "llama3.2", streamTo: cancelWriter{cancel}}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := (ollamaProvider{}).Describe(ctx, cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ollamaProvider.Describe() error = %v, expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ollamaProvider.Describe() kept reading after the context was cancelled")
+	}
+}
+
+func TestOpenRouterStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if !req.Stream {
+			t.Errorf("request stream = false, expected true")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, fragment := range []string{"Add", " retry", " to uploads"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", fragment)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	cfg := config{provider: "openrouter", apiEndpoint: server.URL, model: "openai/gpt-4o", stream: true, streamTo: &out}
+	result, _, err := (openRouterProvider{}).Describe(context.Background(), cfg, []chatMessage{{Role: "user", Content: "prompt"}})
+	if err != nil {
+		t.Fatalf("Describe() error = %v", err)
+	}
+	if result != "Add retry to uploads" || out.String() != "Add retry to uploads" {
+		t.Errorf("Describe() = %q, wrote %q, expected %q", result, out.String(), "Add retry to uploads")
+	}
+}
+
+func TestStreamOptionConflicts(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OPENROUTER_API_KEY", "secret")
+	t.Setenv("ANTHROPIC_API_KEY", "secret")
+
+	for _, provider := range []string{"openrouter", "ollama"} {
+		if _, _, err := getConfig([]string{"-provider", provider, "-stream"}); err != nil {
+			t.Errorf("getConfig() error = %v", err)
+		}
+	}
+	for _, args := range [][]string{
+		{"-provider", "anthropic", "-stream"},
+		{"-provider", "openrouter", "-stream", "-json"},
+		{"-provider", "openrouter", "-stream", "-polish"},
+		{"-provider", "openrouter", "-stream", "-output", "pr"},
+		{"-provider", "openrouter", "-stream", "-clean-markdown"},
+		{"-provider", "openrouter", "-stream", "-no-body"},
+		{"-provider", "openrouter", "-stream", "-body-format", "none"},
+	} {
+		if _, _, err := getConfig(args); err == nil {
+			t.Errorf("getConfig(%v) expected error", args)
+		}
+	}
+}
+
+func TestReviewMarkdownOptionConflicts(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OPENROUTER_API_KEY", "secret")
+
+	if _, _, err := getConfig([]string{"-output", "review-md"}); err != nil {
+		t.Errorf("getConfig() error = %v", err)
+	}
+	for _, args := range [][]string{
+		{"-output", "review-md", "-commit"},
+		{"-output", "review-md", "-add-note", "HEAD"},
+		{"-output", "review-md", "-message-file", "COMMIT_EDITMSG"},
+	} {
+		if _, _, err := getConfig(args); err == nil {
+			t.Errorf("getConfig(%v) expected error", args)
+		}
+	}
+}
+
+func TestBuildPromptSubjectReminder(t *testing.T) {
+	long := strings.Repeat("+line\n", 10)
+	tests := []struct {
+		name     string
+		cfg      config
+		expected bool
+	}{
+		{"short diff", config{output: "commit", subjectReminderLines: 20}, false},
+		{"long diff", config{output: "commit", subjectReminderLines: 10}, true},
+		{"disabled", config{output: "commit", subjectReminderLines: 0}, false},
+		{"pull request", config{output: "pr", subjectReminderLines: 10}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := buildPrompt(tt.cfg, promptData{Changes: long})
+			if err != nil {
+				t.Fatalf("buildPrompt() error = %v", err)
+			}
+			if got := strings.HasSuffix(prompt, "\n\n"+subjectReminder); got != tt.expected {
+				t.Errorf("buildPrompt() ends with reminder = %v, expected %v:\n%s", got, tt.expected, prompt)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileLayers(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	if _, err := git.PlainInit(root, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(filepath.Join(root, "sub"))
+
+	writeConfig := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(filepath.Join(xdg, "describe", "config.yaml"),
+		"provider: openrouter\nmodel: user-model\nmax_lines: 500\ntemperature: 0.3\nignore_dirs: [build]\nmodel_prompts:\n  user-model: user prompt\n")
+	writeConfig(filepath.Join(root, repoConfigFile),
+		"model: repo-model\nignore_dirs: [gen]\nmodel_prompts:\n  repo-model: repo prompt\n")
+	personal := filepath.Join(t.TempDir(), "personal.yaml")
+	writeConfig(personal, "max_lines: 42\n")
+	t.Setenv("DESCRIBE_CONFIG", personal)
+
+	cfg, err := loadConfigFile()
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if cfg.Provider != "openrouter" || cfg.Model != "repo-model" || cfg.MaxLines != 42 {
+		t.Errorf("loadConfigFile() provider, model, max_lines = %q, %q, %d, expected openrouter, repo-model, 42", cfg.Provider, cfg.Model, cfg.MaxLines)
+	}
+	if cfg.Temperature == nil || *cfg.Temperature != 0.3 {
+		t.Errorf("loadConfigFile() temperature = %v, expected 0.3 from the user config", cfg.Temperature)
+	}
+	if !reflect.DeepEqual(cfg.IgnoreDirs, []string{"gen"}) {
+		t.Errorf("loadConfigFile() ignore_dirs = %v, expected [gen]", cfg.IgnoreDirs)
+	}
+	expectedPrompts := map[string]string{"user-model": "user prompt", "repo-model": "repo prompt"}
+	if !reflect.DeepEqual(cfg.ModelPrompts, expectedPrompts) {
+		t.Errorf("loadConfigFile() model_prompts = %v, expected %v", cfg.ModelPrompts, expectedPrompts)
+	}
+
+	keys, err := configFileKeys()
+	if err != nil {
+		t.Fatalf("configFileKeys() error = %v", err)
+	}
+	for _, key := range []string{"provider", "model", "max_lines", "temperature"} {
+		if !keys[key] {
+			t.Errorf("configFileKeys() missing %q", key)
+		}
+	}
+
+	t.Setenv("DESCRIBE_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := loadConfigFile(); err == nil {
+		t.Error("loadConfigFile() expected error for a missing DESCRIBE_CONFIG file")
+	}
+}
+
+func TestRepoConfigTrust(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DESCRIBE_CONFIG", "")
+	root := t.TempDir()
+	if _, err := git.PlainInit(root, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(root)
+	if err := os.WriteFile(filepath.Join(root, repoConfigFile), []byte("prompt_prefix: Be brief.\ncontext_command: curl evil.example\napi_endpoint: https://evil.example\ntrusted_repos: [/]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	userConfig := filepath.Join(xdg, "describe", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(userConfig), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(userConfig, []byte("api_endpoint: http://localhost:11434\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfigFile()
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if cfg.PromptPrefix != "Be brief." || cfg.ContextCommand != "" || cfg.APIEndpoint != "http://localhost:11434" {
+		t.Errorf("untrusted repo: prompt_prefix, context_command, api_endpoint = %q, %q, %q, expected only prompt_prefix from the repo", cfg.PromptPrefix, cfg.ContextCommand, cfg.APIEndpoint)
+	}
+	if keys, err := configFileKeys(); err != nil || keys["context_command"] {
+		t.Errorf("configFileKeys() = %v, %v, expected context_command to be left out", keys, err)
+	}
+
+	if err := os.WriteFile(userConfig, []byte("trusted_repos: ["+root+"]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfigFile()
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if cfg.ContextCommand != "curl evil.example" || cfg.APIEndpoint != "https://evil.example" {
+		t.Errorf("trusted repo: context_command, api_endpoint = %q, %q, expected the repo's values", cfg.ContextCommand, cfg.APIEndpoint)
+	}
+}
+
+func TestBuildPromptTruncationNote(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     promptData
+		expected bool
+	}{
+		{"full diff", promptData{Changes: "+a\n"}, false},
+		{"truncated", promptData{Changes: "+a\n" + truncationMarker(12, "3 smaller hunks") + "\n", Truncated: true}, true},
+		{"marker text in the diff", promptData{Changes: "+\t\t\"[... 12 lines truncated ...]\"\n"}, false},
+		{"summary text in the diff", promptData{Changes: "+// (summary only, full diffs omitted)\n"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := buildPrompt(config{output: "commit"}, tt.data)
+			if err != nil {
+				t.Fatalf("buildPrompt() error = %v", err)
+			}
+			if got := strings.Contains(prompt, truncationNote); got != tt.expected {
+				t.Errorf("buildPrompt() has truncation note = %v, expected %v:\n%s", got, tt.expected, prompt)
+			}
+		})
+	}
+}
+
+func TestSplitAnalysis(t *testing.T) {
+	tests := []struct {
+		name             string
+		response         string
+		expectedMessage  string
+		expectedTrailers []trailer
+	}{
+		{"no analysis", "Fix login\n", "Fix login", nil},
+		{
+			"both trailers",
+			"Fix login\n\nReject expired tokens.\n" + analysisSeparator + "\nChange-Type: fix\nAffected-Components: auth, web, auth\n",
+			"Fix login\n\nReject expired tokens.",
+			[]trailer{{"Change-Type", "fix"}, {"Affected-Components", "auth,web"}},
+		},
+		{
+			"markdown and unknown type",
+			"Tidy up\n\n" + analysisSeparator + "\n- **Change-Type:** Cleanup\n- Affected-Components: `CLI`\n",
+			"Tidy up",
+			[]trailer{{"Affected-Components", "cli"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, trailers := splitAnalysis(tt.response)
+			if message != tt.expectedMessage {
+				t.Errorf("splitAnalysis() message = %q, expected %q", message, tt.expectedMessage)
+			}
+			if !reflect.DeepEqual(trailers, tt.expectedTrailers) {
+				t.Errorf("splitAnalysis() trailers = %v, expected %v", trailers, tt.expectedTrailers)
+			}
+		})
+	}
+}
+
+func TestAppendTrailers(t *testing.T) {
+	trailers := []trailer{{"Change-Type", "feature"}, {"Affected-Components", "auth"}}
+	tests := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{"subject only", "Add login", "Add login\n\nChange-Type: feature\nAffected-Components: auth"},
+		{"with body", "Add login\n\nUsers can sign in.\n", "Add login\n\nUsers can sign in.\n\nChange-Type: feature\nAffected-Components: auth"},
+		{"existing trailers", "Add login\n\nUsers can sign in.\n\nRefs: #12", "Add login\n\nUsers can sign in.\n\nRefs: #12\nChange-Type: feature\nAffected-Components: auth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendTrailers(tt.message, trailers); got != tt.expected {
+				t.Errorf("appendTrailers() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+	if got := appendTrailers("Add login", nil); got != "Add login" {
+		t.Errorf("appendTrailers() without trailers = %q, expected the message unchanged", got)
+	}
+}
+
+func TestGetChangesCanceled(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "one\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, fs, "a.txt", "two\n")
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg := config{maxLines: 10000}
+	if _, err := getStagedChanges(ctx, repo, cfg); !errors.Is(err, context.Canceled) {
+		t.Errorf("getStagedChanges() error = %v, expected %v", err, context.Canceled)
+	}
+	if _, err := getChangesAgainst(ctx, repo, cfg, "HEAD"); !errors.Is(err, context.Canceled) {
+		t.Errorf("getChangesAgainst() error = %v, expected %v", err, context.Canceled)
+	}
+	if _, err := getCommitChanges(ctx, repo, cfg, head.Hash()); !errors.Is(err, context.Canceled) {
+		t.Errorf("getCommitChanges() error = %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestBinaryNote(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 2040)
+	change := fileChange{path: "docs/shot.png", status: git.Added, newContent: png, binary: true}
+	tests := []struct {
+		summary  string
+		expected string
+	}{
+		{"name", "binary file added: docs/shot.png\n"},
+		{"name-size", "binary file added: docs/shot.png (2kB)\n"},
+		{"mime", "binary file added: docs/shot.png (2kB, image/png)\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.summary, func(t *testing.T) {
+			if got := binaryNote(change, tt.summary); got != tt.expected {
+				t.Errorf("binaryNote(%q) = %q, expected %q", tt.summary, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBinarySummaryConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	cfg, _, err := getConfig([]string{"-binary-summary", "skip"})
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.binaryFiles != "skip" {
+		t.Errorf("getConfig() binaryFiles = %q, expected skip", cfg.binaryFiles)
+	}
+	if _, _, err := getConfig([]string{"-binary-summary", "hexdump"}); err == nil {
+		t.Error("getConfig() expected error for an unknown binary_summary")
+	}
+}
+
+func TestPromptFile(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"plain instructions", "Write release notes for these changes.\n", "Write release notes for these changes.\n\nChanges:\n+fix\n"},
+		{"placeholder", "Release notes ({{.Languages}}):\n{{.Changes}}\nNotes:", "Release notes (Go):\n+fix\nNotes:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := write(strings.ReplaceAll(tt.name, " ", "-")+".tmpl", tt.content)
+			cfg, _, err := getConfig([]string{"-prompt-file", path, "-preset", "detailed", "-prompt-prefix", "ignored", "-instruction", "ignored too"})
+			if err != nil {
+				t.Fatalf("getConfig() error = %v", err)
+			}
+			prompt, err := buildPrompt(cfg, promptData{Changes: "+fix", Languages: "Go"})
+			if err != nil {
+				t.Fatalf("buildPrompt() error = %v", err)
+			}
+			if prompt != tt.expected {
+				t.Errorf("buildPrompt() = %q, expected %q", prompt, tt.expected)
+			}
+		})
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing.tmpl"), write("broken.tmpl", "{{.Changes")} {
+		if _, _, err := getConfig([]string{"-prompt-file", path}); err == nil {
+			t.Errorf("getConfig(-prompt-file %s) expected error", filepath.Base(path))
+		}
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	messages := []chatMessage{{Role: "user", Content: "hello world"}}
+	tests := []struct {
+		model         string
+		expected      int
+		expectedExact bool
+	}{
+		{"gpt-4o", 8, true},
+		{"openai/gpt-4o", 8, true},
+		{"openai/gpt-3.5-turbo", 8, true},
+		{"anthropic/claude-4.5-sonnet", 2, false},
+		{"llama3.2", 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			tokens, exact := countTokens(tt.model, messages)
+			if tokens != tt.expected || exact != tt.expectedExact {
+				t.Errorf("countTokens(%q) = %d, %v, expected %d, %v", tt.model, tokens, exact, tt.expected, tt.expectedExact)
+			}
+		})
+	}
+}
+
+func TestMergeChanges(t *testing.T) {
+	header := "diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go\n"
+	first := "@@ -1,2 +1,2 @@\n-one\n+ONE\n two\n"
+	later := "@@ -10,2 +10,2 @@\n ten\n-eleven\n+ELEVEN\n"
+	nextLine := "@@ -2,2 +2,2 @@\n-two\n+TWO\n three\n"
+	overlapping := "@@ -1,2 +1,2 @@\n-one\n+Uno\n two\n"
+	other := "diff --git a/other.go b/other.go\n--- a/other.go\n+++ b/other.go\n@@ -1 +1 @@\n-a\n+b\n"
+
+	tests := []struct {
+		name             string
+		staged, stashed  string
+		expectedPatch    string
+		expectedOverlaps []string
+		expectedFiles    []string
+	}{
+		{"identical hunk kept once", header + first, header + first, header + first, nil, []string{"main.go"}},
+		{"hunks ordered by line", header + later, header + first, header + first + later, nil, []string{"main.go"}},
+		{"shared context not reported", header + first, header + nextLine, header + first + nextLine, nil, []string{"main.go"}},
+		{"overlap reported", header + first, header + overlapping, header + first + overlapping,
+			[]string{"main.go: the stash changes line 1, the staged changes line 1"}, []string{"main.go"}},
+		{"stash-only file appended", header + first, other, header + first + other, nil, []string{"main.go", "other.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staged := stagedChanges{patch: tt.staged, unstaged: []string{"dirty.go"}}
+			for _, f := range parsePatch(tt.staged) {
+				staged.files = append(staged.files, stagedFile{path: f.path, status: git.Modified})
+			}
+			stashed := stagedChanges{patch: tt.stashed}
+			for _, f := range parsePatch(tt.stashed) {
+				stashed.files = append(stashed.files, stagedFile{path: f.path, status: git.Modified})
+			}
+			merged, overlaps := mergeChanges(staged, stashed)
+			if merged.patch != tt.expectedPatch {
+				t.Errorf("mergeChanges() patch = %q, expected %q", merged.patch, tt.expectedPatch)
+			}
+			if !reflect.DeepEqual(overlaps, tt.expectedOverlaps) {
+				t.Errorf("mergeChanges() overlaps = %q, expected %q", overlaps, tt.expectedOverlaps)
+			}
+			if !reflect.DeepEqual(merged.unstaged, staged.unstaged) {
+				t.Errorf("mergeChanges() unstaged = %v, expected %v", merged.unstaged, staged.unstaged)
+			}
+			var paths []string
+			for _, f := range merged.files {
+				paths = append(paths, f.path)
+			}
+			if !reflect.DeepEqual(paths, tt.expectedFiles) {
+				t.Errorf("mergeChanges() files = %v, expected %v", paths, tt.expectedFiles)
+			}
+		})
+	}
+}
+
+func TestGetStashChanges(t *testing.T) {
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := w.Filesystem
+	stageTestFile(t, repo, fs, "main.go", "one\ntwo\nthree\n")
+	commitTestRepo(t, repo)
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record two stash entries as commits on top of HEAD, then go back to it
+	var stashes []plumbing.Hash
+	for _, content := range []string{"one\ntwo\nTHREE\n", "one\nTWO\nthree\n"} {
+		stageTestFile(t, repo, fs, "main.go", content)
+		hash, err := w.Commit("WIP", &git.CommitOptions{
+			Author:  &object.Signature{Name: "Test", Email: "test@example.com", When: time.Unix(0, 0)},
+			Parents: []plumbing.Hash{head.Hash()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stashes = append(stashes, hash)
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/stash", stashes[1])); err != nil {
+		t.Fatal(err)
+	}
+	reflog := fmt.Sprintf("%s %s Test <test@example.com> 0 +0000\tWIP\n%s %s Test <test@example.com> 0 +0000\tWIP\n",
+		plumbing.ZeroHash, stashes[0], stashes[0], stashes[1])
+	if err := os.MkdirAll(filepath.Join(root, ".git", "logs", "refs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, ".git", "logs", "refs", "stash"), []byte(reflog), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"stash@{1}", "stash@{0}"} {
+		hash, err := resolveStash(repo, name)
+		if err != nil {
+			t.Fatalf("resolveStash(%q) error = %v", name, err)
+		}
+		if hash != stashes[i] {
+			t.Errorf("resolveStash(%q) = %s, expected %s", name, hash, stashes[i])
+		}
+	}
+	if _, err := resolveStash(repo, "stash@{2}"); err == nil {
+		t.Error("resolveStash(\"stash@{2}\") expected an error")
+	}
+
+	stageTestFile(t, repo, fs, "main.go", "ONE\ntwo\nthree\n")
+	staged, err := getStagedChanges(context.Background(), repo, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stashed, note, err := getStashChanges(context.Background(), repo, config{}, "stash@{1}")
+	if err != nil {
+		t.Fatalf("getStashChanges() error = %v", err)
+	}
+	if note != "" {
+		t.Errorf("getStashChanges() note = %q, expected none for a stash made on HEAD", note)
+	}
+	merged, overlaps := mergeChanges(staged, stashed)
+	if !strings.Contains(merged.patch, "+ONE") || !strings.Contains(merged.patch, "+THREE") {
+		t.Errorf("mergeChanges() patch = %q, expected both the staged and stashed edits", merged.patch)
+	}
+	if len(overlaps) != 0 {
+		t.Errorf("mergeChanges() overlaps = %q, expected none for changes that only share context", overlaps)
+	}
+}
+
+func TestChangedSpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		hunk     string
+		expected [][2]int
+	}{
+		{"replacement", "@@ -1,4 +1,4 @@\n one\n-two\n-three\n+TWO\n four\n", [][2]int{{2, 3}}},
+		{"insertion", "@@ -4,2 +4,3 @@\n four\n+new\n five\n", [][2]int{{4, 4}}},
+		{"two runs", "@@ -1,5 +1,5 @@\n-one\n+ONE\n two\n three\n-four\n+FOUR\n five\n", [][2]int{{1, 1}, {4, 4}}},
+		{"new file", "@@ -0,0 +1,2 @@\n+a\n+b\n", [][2]int{{1, 1}}},
+		{"no counts", "@@ -3 +3 @@\n-c\n+C\n", [][2]int{{3, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedSpans(tt.hunk); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("changedSpans() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRenderDiff(t *testing.T) {
+	diff := "@@ -1,4 +1,4 @@\n one\n-two\n-three\n+TWO\n four\n"
+	tests := []struct {
+		name     string
+		diff     string
+		format   string
+		expected string
+	}{
+		{"unified", diff, "unified", diff},
+		{"before-after", diff, "before-after",
+			"Before (lines 1-4):\none\ntwo\nthree\nfour\nAfter (lines 1-3):\none\nTWO\nfour\n"},
+		{"before-after new file", "@@ -0,0 +1,2 @@\n+a\n+b\n", "before-after", "After (lines 1-2):\na\nb\n"},
+		{"before-after without counts", "@@ -3 +3 @@\n-c\n+C\n", "before-after", "Before (lines 3-3):\nc\nAfter (lines 3-3):\nC\n"},
+		{"before-after keeps file header", "--- old.txt\n+++ new.txt\n@@ -3 +3 @@\n-c\n+C\n", "before-after",
+			"--- old.txt\n+++ new.txt\nBefore (lines 3-3):\nc\nAfter (lines 3-3):\nC\n"},
+		{"side-by-side", diff, "side-by-side",
+			"(old on the left, new on the right; | changed, < removed, > added)\n@@ -1,4 +1,4 @@\none     one\ntwo   | TWO\nthree <\nfour    four\n"},
+		{"side-by-side insertion", "@@ -1 +1,2 @@\n a\n+b\n\\ No newline at end of file\n", "side-by-side",
+			"(old on the left, new on the right; | changed, < removed, > added)\n@@ -1 +1,2 @@\na   a\n  > b\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := renderDiff(tt.diff, tt.format); result != tt.expected {
+				t.Errorf("renderDiff() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRenderPatch(t *testing.T) {
+	patch := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-a\n+A\n" +
+		"diff --git a/b.go b/b.go\n--- a/b.go\n+++ b/b.go\n@@ -2 +2 @@\n-b\n+B\n"
+	expected := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\nBefore (lines 1-1):\na\nAfter (lines 1-1):\nA\n" +
+		"diff --git a/b.go b/b.go\n--- a/b.go\n+++ b/b.go\nBefore (lines 2-2):\nb\nAfter (lines 2-2):\nB\n"
+	if result := renderPatch(patch, "before-after"); result != expected {
+		t.Errorf("renderPatch() = %q, expected %q", result, expected)
+	}
+	if result := renderPatch(patch, "unified"); result != patch {
+		t.Errorf("renderPatch() = %q, expected the patch unchanged", result)
+	}
+}
+
+func TestDiffFormatConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	cfg, _, err := getConfig(nil)
+	if err != nil {
+		t.Fatalf("getConfig() error = %v", err)
+	}
+	if cfg.diffFormat != "unified" {
+		t.Errorf("getConfig() diffFormat = %q, expected unified", cfg.diffFormat)
+	}
+	for _, args := range [][]string{{"-diff-format", "html"}, {"-diff-format", "before-after", "-max-hunks-per-file", "2"}} {
+		if _, _, err := getConfig(args); err == nil {
+			t.Errorf("getConfig(%q) expected an error", args)
+		}
+	}
+}
+
+func TestTruncatePatch(t *testing.T) {
+	a := "diff --git a/a.go b/a.go\n@@ -1,2 +1,2 @@\n-one\n+ONE\n two\n"
+	b := "diff --git a/b.go b/b.go\n@@ -1 +1 @@\n-x\n+y\n"
+	c := "diff --git a/c.go b/c.go\n@@ -1 +1 @@\n-p\n+q\n"
+	tests := []struct {
+		name     string
+		maxLines int
+		expected string
+	}{
+		{"under the limit", 20, a + b + c},
+		{"no limit", 0, a + b + c},
+		{"cut inside a file", 7, a + "diff --git a/b.go b/b.go\n@@ -1 +1 @@\n" +
+			"[... 6 lines truncated (max_lines, not shown: c.go) ...]\n"},
+		{"cut at a file boundary", 5, a + "[... 8 lines truncated (max_lines, not shown: b.go, c.go) ...]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, truncated := truncatePatch(a+b+c, tt.maxLines)
+			if result != tt.expected {
+				t.Errorf("truncatePatch() = %q, expected %q", result, tt.expected)
+			}
+			if truncated != (tt.expected != a+b+c) {
+				t.Errorf("truncatePatch() truncated = %v, expected %v", truncated, tt.expected != a+b+c)
+			}
+		})
+	}
+}
+
+func TestTruncateOnLimit(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", strings.Repeat("line\n", 20))
+
+	if _, err := getStagedChanges(context.Background(), repo, config{maxLines: 10}); err == nil {
+		t.Fatal("getStagedChanges() expected the max_lines error")
+	}
+	staged, err := getStagedChanges(context.Background(), repo, config{maxLines: 10, truncateOnLimit: true})
+	if err != nil {
+		t.Fatalf("getStagedChanges() error = %v", err)
+	}
+	if lines := strings.Count(staged.patch, "\n"); lines != 11 {
+		t.Errorf("getStagedChanges() patch has %d lines, expected 10 and a marker", lines)
+	}
+	if len(staged.files) != 1 {
+		t.Errorf("getStagedChanges() files = %+v, expected a.txt", staged.files)
+	}
+	if !staged.truncated {
+		t.Error("getStagedChanges() truncated = false, expected true")
+	}
+}
+
+func TestGetRebaseChanges(t *testing.T) {
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageTestFile(t, repo, w.Filesystem, "main.go", "one\ntwo\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, w.Filesystem, "main.go", "one\nTWO\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, w.Filesystem, "extra.go", "extra\n")
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitDir := filepath.Join(root, ".git")
+
+	if _, err := getRebaseChanges(context.Background(), repo, config{}); err == nil {
+		t.Error("getRebaseChanges() expected an error with no rebase in progress")
+	}
+
+	// Stopped to resolve a cherry-pick: the staged changes are the commit
+	if err := os.WriteFile(filepath.Join(gitDir, "CHERRY_PICK_HEAD"), []byte(head.Hash().String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := getRebaseChanges(context.Background(), repo, config{})
+	if err != nil {
+		t.Fatalf("getRebaseChanges() error = %v", err)
+	}
+	if !strings.Contains(changes.patch, "+extra") || strings.Contains(changes.patch, "+TWO") {
+		t.Errorf("getRebaseChanges() patch = %q, expected only the staged file", changes.patch)
+	}
+	if err := os.Remove(filepath.Join(gitDir, "CHERRY_PICK_HEAD")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopped to edit HEAD: its own changes plus the staged amendment
+	if err := os.MkdirAll(filepath.Join(gitDir, "rebase-merge"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "rebase-merge", "amend"), []byte(head.Hash().String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = getRebaseChanges(context.Background(), repo, config{})
+	if err != nil {
+		t.Fatalf("getRebaseChanges() error = %v", err)
+	}
+	if !strings.Contains(changes.patch, "+extra") || !strings.Contains(changes.patch, "+TWO") {
+		t.Errorf("getRebaseChanges() patch = %q, expected the edited commit and the staged file", changes.patch)
+	}
+}
+
+func TestReviewMarkdown(t *testing.T) {
+	a := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-x\n+y\n"
+	b := "diff --git a/doc<1>.md b/doc<1>.md\n--- a/doc<1>.md\n+++ b/doc<1>.md\n@@ -1 +1,2 @@\n ```go\n+```\n"
+	files := []stagedFile{{path: "a.go", added: 1, removed: 1}, {path: "doc<1>.md", added: 1}}
+
+	result := reviewMarkdown("Fix parser\n\nHandles empty input.", a+b, files)
+	expected := "## Fix parser\n\nHandles empty input.\n\n### Changes\n" +
+		"\n<details>\n<summary>a.go (+1 -1)</summary>\n\n```diff\n" + strings.TrimSuffix(a, "\n") + "\n```\n\n</details>\n" +
+		"\n<details>\n<summary>doc&lt;1&gt;.md (+1 -0)</summary>\n\n````diff\n" + strings.TrimSuffix(b, "\n") + "\n````\n\n</details>"
+	if result != expected {
+		t.Errorf("reviewMarkdown() = %q, expected %q", result, expected)
+	}
+
+	summary := reviewMarkdown("# Title", "2 files changed (summary only, full diffs omitted):\nModified a.go (+1 -1)\n", nil)
+	if expected := "## Title\n\n### Changes\n\n```\n2 files changed (summary only, full diffs omitted):\nModified a.go (+1 -1)\n```"; summary != expected {
+		t.Errorf("reviewMarkdown() = %q, expected %q", summary, expected)
+	}
+}
+
+func TestNewHTTPClientForceHTTP1(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(client *http.Client) string {
+		t.Helper()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if proto := get(server.Client()); proto != "HTTP/2.0" {
+		t.Fatalf("test server spoke %s, expected HTTP/2.0", proto)
+	}
+
+	client := newHTTPClient(config{forceHTTP1: true})
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("newHTTPClient() transport = %T, expected *http.Transport", client.Transport)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	if proto := get(client); proto != "HTTP/1.1" {
+		t.Errorf("newHTTPClient() with force_http1 spoke %s, expected HTTP/1.1", proto)
+	}
+}
+
+func TestAddChangeID(t *testing.T) {
+	repo, fs := newTestRepo(t)
+	stageTestFile(t, repo, fs, "a.txt", "a\n")
+	commitTestRepo(t, repo)
+	stageTestFile(t, repo, fs, "a.txt", "b\n")
+	now := time.Unix(1700000000, 0)
+
+	message, err := addChangeID(repo, "Fix parser\n\nHandles empty input.", now)
+	if err != nil {
+		t.Fatalf("addChangeID() error = %v", err)
+	}
+	subject, id, ok := strings.Cut(message, "\n\nHandles empty input.\n\nChange-Id: I")
+	if !ok || subject != "Fix parser" || len(id) != 40 {
+		t.Fatalf("addChangeID() = %q, expected a Change-Id trailer paragraph", message)
+	}
+	again, err := addChangeID(repo, "Fix parser\n\nHandles empty input.", now)
+	if err != nil || again != message {
+		t.Errorf("addChangeID() = %q, expected the same id for the same inputs", again)
+	}
+	later, err := addChangeID(repo, "Fix parser\n\nHandles empty input.", now.Add(time.Second))
+	if err != nil || later == message {
+		t.Errorf("addChangeID() = %q, expected a different id at a different time", later)
+	}
+
+	existing := "Fix parser\n\nSigned-off-by: A <a@example.com>\nChange-Id: I" + strings.Repeat("0", 40)
+	if result, err := addChangeID(repo, existing, now); err != nil || result != existing {
+		t.Errorf("addChangeID() = %q, expected an existing Change-Id to be kept", result)
+	}
+	result, err := addChangeID(repo, "Fix parser\n\nSigned-off-by: A <a@example.com>", now)
+	if err != nil || !strings.HasPrefix(result, "Fix parser\n\nSigned-off-by: A <a@example.com>\nChange-Id: I") {
+		t.Errorf("addChangeID() = %q, expected the Change-Id to join the trailer block", result)
+	}
+}